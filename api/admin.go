@@ -0,0 +1,534 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/utils"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (s *Server) handleAdminSetTokenGrant(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	tName := ctx.Param("name")
+	pattern := ctx.Param("pattern")
+	if !utils.IsValidTokenName(tName) || !utils.IsValidChannelPattern(pattern) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	var req CapabilitiesRepr
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+
+	var caps []db.Capability
+	caps, err = db.ParseCapabilities(req.Capabilities, db.ChannelCapabilities)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+	if len(caps) == 0 {
+		handleUserError(ctx, fmt.Errorf("no capabilities provided"))
+		return
+	}
+
+	grant := db.TokenGrant{
+		ChannelPattern: pattern,
+		Capabilities:   db.JoinCapabilities(caps),
+	}
+	err = s.store.SetTokenGrants(db.TokenActor(token.ID), tName, []db.TokenGrant{grant})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"reason": "token or channel not found"})
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Token grant changed", "token", token.Name, "target_token", tName, "pattern", pattern)
+	ctx.JSON(http.StatusOK, TokenGrantToRepr(grant))
+}
+
+func (s *Server) handleAdminRevokeTokenGrant(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	tName := ctx.Param("name")
+	pattern := ctx.Param("pattern")
+	if !utils.IsValidTokenName(tName) || !utils.IsValidChannelPattern(pattern) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	err := s.store.RevokeTokenGrants(db.TokenActor(token.ID), tName, []string{pattern})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"reason": "token or grant not found"})
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Token grant revoked", "token", token.Name, "target_token", tName, "pattern", pattern)
+	ctx.Status(http.StatusNoContent)
+}
+
+func (s *Server) handleAdminSetTokenCapabilities(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	tName := ctx.Param("name")
+	if !utils.IsValidTokenName(tName) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	var req CapabilitiesRepr
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+
+	var caps []db.Capability
+	caps, err = db.ParseCapabilities(req.Capabilities, db.GlobalCapabilities)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+
+	err = s.store.SetTokenGlobalCapabilities(db.TokenActor(token.ID), tName, caps)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Token capabilities changed", "token", token.Name, "target_token", tName)
+	ctx.JSON(http.StatusOK, CapabilitiesToRepr(caps))
+}
+
+func (s *Server) handleAdminGetTokenStats(ctx *gin.Context) {
+	const defaultDays = 30
+	const maxDays = 366
+
+	tName := ctx.Param("name")
+	if !utils.IsValidTokenName(tName) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	days := defaultDays
+	if daysStr := ctx.Query("days"); daysStr != "" {
+		var err error
+		days, err = strconv.Atoi(daysStr)
+		if err != nil || days < 1 || days > maxDays {
+			handleUserError(ctx, fmt.Errorf("days must be between 1 and %d", maxDays))
+			return
+		}
+	}
+
+	t, err := s.store.GetTokenByName(tName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"reason": "token not found"})
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	var usage []db.TokenUsage
+	usage, err = s.store.GetTokenUsage(t.ID, time.Now().AddDate(0, 0, -(days-1)))
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+
+	resp := TokenStatsRepr{
+		Name:         t.Name,
+		CreatedAt:    t.CreatedAt,
+		LastUsed:     t.LastUsed,
+		LastSourceIP: t.LastSourceIP,
+		ExpiresAt:    t.ExpiresAt,
+		Days:         make([]TokenUsageRepr, len(usage)),
+	}
+	var total db.TokenUsage
+	for i, u := range usage {
+		total.Add(u)
+		resp.Days[i] = TokenUsageToRepr(u)
+	}
+	resp.Total = TokenUsageToRepr(total)
+
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) handleAdminListTokens(ctx *gin.Context) {
+	tokens, err := s.store.GetAllTokens()
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+
+	resp := make([]TokenRepr, len(tokens))
+	for i, t := range tokens {
+		resp[i] = TokenToRepr(t)
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) handleAdminGetToken(ctx *gin.Context) {
+	tName := ctx.Param("name")
+	if !utils.IsValidTokenName(tName) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	t, err := s.store.GetTokenByName(tName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, TokenToRepr(*t))
+}
+
+func (s *Server) handleAdminCreateToken(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	var req NewTokenRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+	if !utils.IsValidTokenName(req.Name) {
+		handleUserError(ctx, fmt.Errorf("invalid token name"))
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		handleUserError(ctx, fmt.Errorf("expires_at must be in the future"))
+		return
+	}
+
+	grants := make([]db.TokenGrant, len(req.Grants))
+	for i, g := range req.Grants {
+		if !utils.IsValidChannelPattern(g.ChannelPattern) {
+			handleUserError(ctx, fmt.Errorf("invalid channel name or pattern: %s", g.ChannelPattern))
+			return
+		}
+		var caps []db.Capability
+		caps, err = db.ParseCapabilities(g.Capabilities, db.ChannelCapabilities)
+		if err != nil {
+			handleUserError(ctx, err)
+			return
+		}
+		if len(caps) == 0 {
+			handleUserError(ctx, fmt.Errorf("no capabilities provided for %s", g.ChannelPattern))
+			return
+		}
+		grants[i] = db.TokenGrant{
+			ChannelPattern: g.ChannelPattern,
+			Capabilities:   db.JoinCapabilities(caps),
+		}
+	}
+
+	var globalCaps []db.Capability
+	globalCaps, err = db.ParseCapabilities(req.GlobalCapabilities, db.GlobalCapabilities)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+	if len(grants) == 0 && len(globalCaps) == 0 {
+		handleUserError(ctx, fmt.Errorf("no capabilities provided"))
+		return
+	}
+
+	var secret string
+	secret, err = utils.GenerateRandomString(48)
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+
+	newToken := db.Token{
+		Name:               req.Name,
+		TokenHash:          utils.TokenHash(secret),
+		ExpiresAt:          req.ExpiresAt,
+		GlobalCapabilities: db.JoinCapabilities(globalCaps),
+	}
+	_, err = s.store.CreateToken(&newToken, grants)
+	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			ctx.JSON(http.StatusConflict, gin.H{"reason": "token name already in use"})
+			return
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"reason": "channel not found"})
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	var created *db.Token
+	created, err = s.store.GetTokenByName(req.Name)
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Token created", "token", token.Name, "target_token", req.Name)
+	ctx.JSON(http.StatusCreated, TokenSecretRepr{TokenRepr: TokenToRepr(*created), Secret: secret})
+}
+
+func (s *Server) handleAdminDeleteToken(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	tName := ctx.Param("name")
+	if !utils.IsValidTokenName(tName) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	err := s.store.DeleteTokenByName(tName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Token deleted", "token", token.Name, "target_token", tName)
+	ctx.Status(http.StatusNoContent)
+}
+
+func (s *Server) handleAdminRotateToken(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	tName := ctx.Param("name")
+	if !utils.IsValidTokenName(tName) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	var req RotateTokenRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil && !errors.Is(err, io.EOF) { // the body is optional
+		handleUserError(ctx, err)
+		return
+	}
+	if req.NeverExpire && req.ExpiresAt != nil {
+		handleUserError(ctx, fmt.Errorf("only one of expires_at and never_expire may be set"))
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		handleUserError(ctx, fmt.Errorf("expires_at must be in the future"))
+		return
+	}
+	updateExpiry := req.NeverExpire || req.ExpiresAt != nil
+
+	var secret, hmacSecret string
+	secret, err = utils.GenerateRandomString(48)
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+	hmacSecret, err = utils.GenerateRandomString(48)
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+
+	var hmacRotated bool
+	hmacRotated, err = s.store.RotateToken(db.TokenActor(token.ID), tName, utils.TokenHash(secret), hmacSecret, s.rotationGrace, updateExpiry, req.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	var rotated *db.Token
+	rotated, err = s.store.GetTokenByName(tName)
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+
+	resp := TokenSecretRepr{TokenRepr: TokenToRepr(*rotated), Secret: secret}
+	if hmacRotated {
+		resp.HmacSecret = hmacSecret
+	}
+
+	logger.InfoContext(ctx, "Token rotated", "token", token.Name, "target_token", tName)
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) handleAdminSetTokenAuth(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	tName := ctx.Param("name")
+	if !utils.IsValidTokenName(tName) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	var req AuthSchemeRepr
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+
+	resp := AuthSchemeRepr{AuthScheme: req.AuthScheme}
+	if req.AuthScheme == db.AuthSchemeHmac {
+		resp.HmacSecret, err = utils.GenerateRandomString(48)
+		if err != nil {
+			handleInternalError(ctx, err)
+			return
+		}
+	}
+
+	err = s.store.SetTokenAuthScheme(db.TokenActor(token.ID), tName, resp.AuthScheme, resp.HmacSecret)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Token auth scheme changed", "token", token.Name, "target_token", tName, "scheme", resp.AuthScheme)
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) handleAdminSetTokenIPs(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	tName := ctx.Param("name")
+	if !utils.IsValidTokenName(tName) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	var req AllowedCIDRsRepr
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+
+	prefixes, err := utils.ParseCIDRList(strings.Join(req.AllowedCIDRs, ","))
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+	cidrs := utils.JoinCIDRList(prefixes)
+
+	err = s.store.SetTokenAllowedCIDRs(db.TokenActor(token.ID), tName, cidrs)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	resp := AllowedCIDRsRepr{AllowedCIDRs: []string{}}
+	if cidrs != "" {
+		resp.AllowedCIDRs = strings.Split(cidrs, ",")
+	}
+
+	logger.InfoContext(ctx, "Token allowed sources changed", "token", token.Name, "target_token", tName, "cidrs", cidrs)
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) handleAdminSetTokenLimits(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	tName := ctx.Param("name")
+	if !utils.IsValidTokenName(tName) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	var req LimitsRepr
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+
+	err = s.store.SetTokenLimits(db.TokenActor(token.ID), tName, req.RateLimit, req.RateBurst, req.DailyQuota)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Token limits changed", "token", token.Name, "target_token", tName)
+	ctx.JSON(http.StatusOK, req)
+}
@@ -0,0 +1,332 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/utils"
+	"gorm.io/gorm"
+	"net/http"
+	"slices"
+)
+
+// validateChannelRequest checks the fields the same way as /editchan and the manifest import do
+func validateChannelRequest(req ChannelRequest) error {
+	if req.DefaultPriority != nil && !slices.Contains(db.ValidPriorities, *req.DefaultPriority) {
+		return fmt.Errorf("invalid default_priority: %s", *req.DefaultPriority)
+	}
+	// maximum lengths, as declared in the model
+	if req.Description != nil && len(*req.Description) > 256 {
+		return fmt.Errorf("description too long, maximum is 256 bytes")
+	}
+	if req.Icon != nil && len(*req.Icon) > 16 {
+		return fmt.Errorf("icon too long, maximum is 16 bytes")
+	}
+	if req.Icon != nil && *req.Icon != "" && !utils.IsSingleEmoji(*req.Icon) {
+		return fmt.Errorf("icon must be a single emoji")
+	}
+	if req.OwnerContact != nil && len(*req.OwnerContact) > 128 {
+		return fmt.Errorf("owner_contact too long, maximum is 128 bytes")
+	}
+	return nil
+}
+
+func (s *Server) handleAdminListChannels(ctx *gin.Context) {
+	channels, err := s.store.GetAllChannels()
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+
+	resp := make([]ChannelRepr, len(channels))
+	for i, c := range channels {
+		resp[i] = ChannelToRepr(c)
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) handleAdminGetChannel(ctx *gin.Context) {
+	chName := ctx.Param("name")
+	if !utils.IsValidChannelName(chName) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	channel, err := s.store.GetChannelByName(ctx, chName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, ChannelToRepr(*channel))
+}
+
+func (s *Server) handleAdminCreateChannel(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	var req ChannelRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+	if !utils.IsValidChannelName(req.Name) {
+		handleUserError(ctx, fmt.Errorf("invalid channel name"))
+		return
+	}
+	err = validateChannelRequest(req)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+
+	channel := db.Channel{
+		Name:            req.Name,
+		DefaultPriority: db.PriorityNormal,
+	}
+	if req.Description != nil {
+		channel.Description = *req.Description
+	}
+	if req.Icon != nil {
+		channel.Icon = *req.Icon
+	}
+	if req.DefaultPriority != nil {
+		channel.DefaultPriority = *req.DefaultPriority
+	}
+	if req.OwnerContact != nil {
+		channel.OwnerContact = *req.OwnerContact
+	}
+
+	_, err = s.store.CreateChannel(&channel)
+	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			ctx.JSON(http.StatusConflict, gin.H{"reason": "channel name already used by a current or archived channel"})
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Channel created", "token", token.Name, "channel", channel.Name)
+	ctx.JSON(http.StatusCreated, ChannelToRepr(channel))
+}
+
+func (s *Server) handleAdminEditChannel(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	chName := ctx.Param("name")
+	if !utils.IsValidChannelName(chName) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	var req ChannelRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+	if req.Name != "" && req.Name != chName {
+		handleUserError(ctx, fmt.Errorf("channels can be renamed with the rename endpoint"))
+		return
+	}
+	err = validateChannelRequest(req)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if req.Description != nil {
+		updates["description"] = *req.Description
+	}
+	if req.Icon != nil {
+		updates["icon"] = *req.Icon
+	}
+	if req.DefaultPriority != nil {
+		updates["default_priority"] = *req.DefaultPriority
+	}
+	if req.OwnerContact != nil {
+		updates["owner_contact"] = *req.OwnerContact
+	}
+	if len(updates) == 0 {
+		handleUserError(ctx, fmt.Errorf("nothing to change"))
+		return
+	}
+
+	err = s.store.UpdateChannel(chName, updates)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Channel edited", "token", token.Name, "channel", chName)
+	s.handleAdminGetChannel(ctx)
+}
+
+func (s *Server) handleAdminRenameChannel(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	chName := ctx.Param("name")
+	if !utils.IsValidChannelName(chName) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	var req RenameRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+	if !utils.IsValidChannelName(req.Name) {
+		handleUserError(ctx, fmt.Errorf("invalid channel name"))
+		return
+	}
+
+	err = s.store.RenameChannel(db.TokenActor(token.ID), chName, req.Name)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			ctx.JSON(http.StatusConflict, gin.H{"reason": "channel name already used by a current or archived channel"})
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Channel renamed", "token", token.Name, "channel", chName, "new_name", req.Name)
+	ctx.Status(http.StatusNoContent)
+}
+
+func (s *Server) handleAdminSetChannelLimits(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	chName := ctx.Param("name")
+	if !utils.IsValidChannelName(chName) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	var req LimitsRepr
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+	if req.DailyQuota != 0 {
+		handleUserError(ctx, fmt.Errorf("channels have no daily quota"))
+		return
+	}
+
+	err = s.store.SetChannelLimits(db.TokenActor(token.ID), chName, req.RateLimit, req.RateBurst)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Channel limits changed", "token", token.Name, "channel", chName)
+	ctx.JSON(http.StatusOK, req)
+}
+
+// handleAdminDeleteChannel archives the channel, or purges an already archived channel if the purge query parameter is true
+func (s *Server) handleAdminDeleteChannel(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	chName := ctx.Param("name")
+	if !utils.IsValidChannelName(chName) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	purge := ctx.Query("purge") == "true"
+
+	var err error
+	if purge {
+		err = s.store.PurgeChannelByName(db.TokenActor(token.ID), chName)
+	} else {
+		err = s.store.ArchiveChannelByName(db.TokenActor(token.ID), chName)
+	}
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if purge {
+				ctx.JSON(http.StatusNotFound, gin.H{"reason": "archived channel not found, channels must be archived before purging"})
+			} else {
+				ctx.Status(http.StatusNotFound)
+			}
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	if purge {
+		logger.InfoContext(ctx, "Channel purged", "token", token.Name, "channel", chName)
+	} else {
+		logger.InfoContext(ctx, "Channel archived", "token", token.Name, "channel", chName)
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+func (s *Server) handleAdminRestoreChannel(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	chName := ctx.Param("name")
+	if !utils.IsValidChannelName(chName) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	err := s.store.RestoreChannelByName(db.TokenActor(token.ID), chName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"reason": "archived channel not found"})
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Channel restored", "token", token.Name, "channel", chName)
+	ctx.Status(http.StatusNoContent)
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+)
+
+// getUserIdParam parses the id of the user from the path, aborts with 404 if it is not a valid id
+func getUserIdParam(ctx *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return 0, false
+	}
+	return id, true
+}
+
+func (s *Server) handleAdminListUsers(ctx *gin.Context) {
+	users, err := s.store.GetAllUsers()
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+
+	resp := make([]AdminUserRepr, len(users))
+	for i, u := range users {
+		resp[i] = UserToAdminUserRepr(u)
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) handleAdminGetUser(ctx *gin.Context) {
+	id, ok := getUserIdParam(ctx)
+	if !ok {
+		return
+	}
+
+	user, err := s.store.GetUserById(ctx, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, UserToAdminUserRepr(*user))
+}
+
+// handleAdminPutUser creates or replaces the user, the id must be the Telegram user id
+func (s *Server) handleAdminPutUser(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	id, ok := getUserIdParam(ctx)
+	if !ok {
+		return
+	}
+
+	var req UserRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+
+	user := db.User{
+		ID:        id,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Username:  req.Username,
+		PhotoUrl:  req.PhotoUrl,
+		Active:    &req.Active,
+		Admin:     &req.Admin,
+	}
+	err = s.store.SaveUser(db.TokenActor(token.ID), &user)
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "User saved", "token", token.Name, "user", id)
+	ctx.JSON(http.StatusOK, UserToAdminUserRepr(user))
+}
+
+func (s *Server) handleAdminDeleteUser(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	id, ok := getUserIdParam(ctx)
+	if !ok {
+		return
+	}
+
+	err := s.store.DeleteUserById(db.TokenActor(token.ID), id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, gorm.ErrForeignKeyViolated) {
+			ctx.JSON(http.StatusConflict, gin.H{"reason": "user created channels or tokens, deactivate it instead"})
+			return
+		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "User deleted", "token", token.Name, "user", id)
+	ctx.Status(http.StatusNoContent)
+}
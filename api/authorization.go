@@ -0,0 +1,68 @@
+package api
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/memdb"
+	"gorm.io/gorm"
+	"net/http"
+)
+
+// authorize checks if the token has any of the capabilities on at least one channel, aborts the request with 403 otherwise.
+// Should be used where the channel is not known, object level permissions must be checked separately.
+func authorize(ctx *gin.Context, token *db.Token, capabilities ...db.Capability) bool {
+	for _, capability := range capabilities {
+		if token.CanAnywhere(capability) {
+			return true
+		}
+	}
+	ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"reason": "capability disallowed"})
+	return false
+}
+
+// canReadQuestion tells if the token may read the answer of the question.
+// Besides the token that asked it, tokens with read-history on the channel of the question are allowed.
+func canReadQuestion(token *db.Token, q *memdb.QuestionData) bool {
+	if q.SourceTokenID == token.ID {
+		return true
+	}
+	return q.ChannelName != "" && token.Can(db.CapReadHistory, q.ChannelName)
+}
+
+// authorizeChannel checks if the token has the capability on the channel, and loads it (with subscribers) if so.
+// Aborts the request with 404 otherwise, so the existence of channels is not revealed.
+func (s *Server) authorizeChannel(ctx *gin.Context, token *db.Token, capability db.Capability, channelName string) (*db.Channel, bool) {
+	if !token.Can(capability, channelName) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"reason": "channel not found or no permission"})
+		return nil, false
+	}
+
+	channel, err := s.store.GetChannelByName(ctx, channelName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"reason": "channel not found or no permission"})
+			return nil, false
+		}
+		handleInternalError(ctx, err)
+		return nil, false
+	}
+
+	return channel, true
+}
+
+// requireGlobalCapability creates a middleware that allows only tokens having the global capability
+func requireGlobalCapability(capability db.Capability) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token := getTokenFromContext(ctx)
+		if token == nil {
+			handleInternalError(ctx, errors.New("invalid token"))
+			return
+		}
+
+		if !token.HasGlobalCapability(capability) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"reason": "capability disallowed"})
+			return
+		}
+	}
+}
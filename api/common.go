@@ -2,14 +2,19 @@ package api
 
 import (
 	"github.com/gin-gonic/gin"
-	"log"
+	"github.com/marcsello/marcsellocorp-bot/logging"
+	"github.com/marcsello/marcsellocorp-bot/utils"
 	"net/http"
 )
 
-// handleInternalError create a 500 response for error
+// handleInternalError create a 500 response for error, the details are only logged, the client gets an ID to refer to them
 func handleInternalError(ctx *gin.Context, err error) {
-	log.Println("INTERNAL ERROR HAPPENED: ", err)
-	ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	errorId, idErr := utils.GenerateRandomString(16)
+	if idErr != nil {
+		errorId = logging.RequestID(ctx)
+	}
+	logger.ErrorContext(ctx, "Internal error", "error_id", errorId, "error", err)
+	ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"reason": "internal error", "error_id": errorId})
 }
 
 // handleUserError create a 400 response for error
@@ -0,0 +1,338 @@
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/memdb"
+	"github.com/marcsello/marcsellocorp-bot/utils"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+// The fakes embed the interface they implement, so calling a method not implemented by the fake panics
+
+type fakeStore struct {
+	Store
+
+	mu        sync.Mutex
+	tokens    map[string]*db.Token // by hex encoded hash
+	channels  map[string]*db.Channel
+	users     map[int64]*db.User
+	templates map[string]*db.Template
+	scheduled []db.ScheduledNotification
+	usage     map[uint]db.TokenUsage
+	touched   []uint
+	pingErr   error
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		tokens:    map[string]*db.Token{},
+		channels:  map[string]*db.Channel{},
+		users:     map[int64]*db.User{},
+		templates: map[string]*db.Template{},
+		usage:     map[uint]db.TokenUsage{},
+	}
+}
+
+// addToken stores the token and returns the secret to authenticate with
+func (f *fakeStore) addToken(token *db.Token) string {
+	secret := fmt.Sprintf("secret-of-%s", token.Name)
+	token.TokenHash = utils.TokenHash(secret)
+	if token.AuthScheme == "" {
+		token.AuthScheme = db.AuthSchemeBearer
+	}
+	f.tokens[hex.EncodeToString(token.TokenHash)] = token
+	return secret
+}
+
+func (f *fakeStore) addChannel(name string, subscribers ...int64) *db.Channel {
+	ch := &db.Channel{Name: name}
+	ch.ID = uint(len(f.channels) + 1)
+	for _, id := range subscribers {
+		ch.Subscribers = append(ch.Subscribers, &db.User{ID: id})
+	}
+	f.channels[name] = ch
+	return ch
+}
+
+func (f *fakeStore) LookupTokenByHash(_ context.Context, tokenHashBytes []byte) (*db.Token, error) {
+	token, ok := f.tokens[hex.EncodeToString(tokenHashBytes)]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return token, nil
+}
+
+func (f *fakeStore) LookupTokenByName(_ context.Context, name string) (*db.Token, error) {
+	for _, token := range f.tokens {
+		if token.Name == name {
+			return token, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (f *fakeStore) TouchToken(tokenId uint, _ string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.touched = append(f.touched, tokenId)
+}
+
+func (f *fakeStore) QueueTokenUsage(tokenId uint, _ time.Time, delta db.TokenUsage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	usage := f.usage[tokenId]
+	usage.Add(delta)
+	f.usage[tokenId] = usage
+}
+
+func (f *fakeStore) tokenUsage(tokenId uint) db.TokenUsage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.usage[tokenId]
+}
+
+func (f *fakeStore) GetChannelByName(_ context.Context, name string) (*db.Channel, error) {
+	ch, ok := f.channels[name]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return ch, nil
+}
+
+func (f *fakeStore) GetUserById(_ context.Context, id int64) (*db.User, error) {
+	user, ok := f.users[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return user, nil
+}
+
+func (f *fakeStore) GetTemplateByName(name string) (*db.Template, error) {
+	template, ok := f.templates[name]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return template, nil
+}
+
+func (f *fakeStore) CreateScheduledNotification(scheduled *db.ScheduledNotification) (*db.ScheduledNotification, error) {
+	scheduled.ID = uint(len(f.scheduled) + 1)
+	f.scheduled = append(f.scheduled, *scheduled)
+	return scheduled, nil
+}
+
+func (f *fakeStore) Ping(context.Context) error {
+	return f.pingErr
+}
+
+type fakeQuestionStore struct {
+	QuestionStore
+
+	mu            sync.Mutex
+	notifications map[string]memdb.NotificationData
+	questions     map[string]memdb.QuestionData
+	answers       chan memdb.QuestionData // WaitForAnswer returns what is sent on this
+	pingErr       error
+}
+
+func newFakeQuestionStore() *fakeQuestionStore {
+	return &fakeQuestionStore{
+		notifications: map[string]memdb.NotificationData{},
+		questions:     map[string]memdb.QuestionData{},
+		answers:       make(chan memdb.QuestionData, 1),
+	}
+}
+
+func (f *fakeQuestionStore) StoreNotification(_ context.Context, data memdb.NotificationData) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := fmt.Sprintf("n%d", len(f.notifications)+1)
+	f.notifications[id] = data
+	return id, nil
+}
+
+func (f *fakeQuestionStore) GetNotificationData(_ context.Context, randomId string) (*memdb.NotificationData, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, ok := f.notifications[randomId]
+	if !ok {
+		return nil, redis.Nil
+	}
+	return &n, nil
+}
+
+func (f *fakeQuestionStore) DeleteNotification(_ context.Context, randomId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.notifications, randomId)
+	return nil
+}
+
+func (f *fakeQuestionStore) GetQuestionData(_ context.Context, randomId string) (*memdb.QuestionData, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q, ok := f.questions[randomId]
+	if !ok {
+		return nil, redis.Nil
+	}
+	return &q, nil
+}
+
+func (f *fakeQuestionStore) WaitForAnswer(ctx context.Context, _ string) (*memdb.QuestionData, error) {
+	select {
+	case q := <-f.answers:
+		return &q, nil
+	case <-ctx.Done():
+		return nil, nil
+	}
+}
+
+func (f *fakeQuestionStore) Ping(context.Context) error {
+	return f.pingErr
+}
+
+// fakeLimiter never limits, unless a wait is set
+type fakeLimiter struct {
+	Limiter
+
+	tokenWait   time.Duration
+	channelWait time.Duration
+	usedToday   int64
+	nonces      map[string]bool
+
+	tokenTaken   int // taken and not refunded
+	channelTaken int
+}
+
+func (f *fakeLimiter) TakeTokenRateLimit(context.Context, uint, int, int) (time.Duration, error) {
+	if f.tokenWait == 0 {
+		f.tokenTaken++
+	}
+	return f.tokenWait, nil
+}
+
+func (f *fakeLimiter) TakeChannelRateLimit(context.Context, uint, int, int) (time.Duration, error) {
+	if f.channelWait == 0 {
+		f.channelTaken++
+	}
+	return f.channelWait, nil
+}
+
+func (f *fakeLimiter) RefundTokenRateLimit(context.Context, uint, int) error {
+	f.tokenTaken--
+	return nil
+}
+
+func (f *fakeLimiter) RefundChannelRateLimit(context.Context, uint, int) error {
+	f.channelTaken--
+	return nil
+}
+
+func (f *fakeLimiter) RefundDailyUsage(context.Context, uint, string) error {
+	f.usedToday--
+	return nil
+}
+
+func (f *fakeLimiter) CountDailyUsage(context.Context, uint, string) (int64, error) {
+	f.usedToday++
+	return f.usedToday, nil
+}
+
+func (f *fakeLimiter) MarkQuotaAlertSent(context.Context, uint, string) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeLimiter) UseNonce(_ context.Context, tokenId uint, nonce string, _ time.Duration) (bool, error) {
+	if f.nonces == nil {
+		f.nonces = map[string]bool{}
+	}
+	key := fmt.Sprintf("%d_%s", tokenId, nonce)
+	if f.nonces[key] {
+		return false, nil
+	}
+	f.nonces[key] = true
+	return true, nil
+}
+
+type sentMessage struct {
+	chatId int64
+	text   string
+}
+
+// fakeMessenger records the messages instead of sending them
+type fakeMessenger struct {
+	Messenger
+
+	mu         sync.Mutex
+	sent       []sentMessage
+	edited     []memdb.StoredMessage
+	deleted    []memdb.StoredMessage
+	questions  []string
+	sendCtxErr error // the error of the context of the last send
+	sendErr    error
+	failAfter  int // SendToSubscribers fails with sendErr after this many messages if set
+	pingErr    error
+}
+
+func (f *fakeMessenger) SendToSubscribers(_ context.Context, channel *db.Channel, msg string, _ ...interface{}) ([]memdb.StoredMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sendErr != nil && f.failAfter == 0 {
+		return nil, f.sendErr
+	}
+	stored := make([]memdb.StoredMessage, 0, len(channel.Subscribers))
+	for _, sub := range channel.Subscribers {
+		if f.sendErr != nil && len(stored) == f.failAfter {
+			return stored, f.sendErr
+		}
+		f.sent = append(f.sent, sentMessage{chatId: sub.ID, text: msg})
+		stored = append(stored, memdb.StoredMessage{MessageID: len(f.sent), ChatID: sub.ID})
+	}
+	return stored, nil
+}
+
+func (f *fakeMessenger) SendQuestion(ctx context.Context, _ uint, channel *db.Channel, msg string, _ []memdb.QuestionOption) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sendErr != nil {
+		return "", f.sendErr
+	}
+	f.sendCtxErr = ctx.Err()
+	for _, sub := range channel.Subscribers {
+		f.sent = append(f.sent, sentMessage{chatId: sub.ID, text: msg})
+	}
+	id := fmt.Sprintf("q%d", len(f.questions)+1)
+	f.questions = append(f.questions, id)
+	return id, nil
+}
+
+func (f *fakeMessenger) SendToUser(_ context.Context, userId int64, msg string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, sentMessage{chatId: userId, text: msg})
+	return nil
+}
+
+func (f *fakeMessenger) EditMessages(_ context.Context, messages []memdb.StoredMessage, _ string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.edited = append(f.edited, messages...)
+	return nil
+}
+
+func (f *fakeMessenger) DeleteMessages(_ context.Context, messages []memdb.StoredMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, messages...)
+	return nil
+}
+
+func (f *fakeMessenger) Ping(context.Context) error {
+	return f.pingErr
+}
@@ -2,31 +2,29 @@ package api
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/marcsello/marcsellocorp-bot/common"
 	"github.com/marcsello/marcsellocorp-bot/db"
 	"github.com/marcsello/marcsellocorp-bot/memdb"
+	"github.com/marcsello/marcsellocorp-bot/metrics"
 	"github.com/marcsello/marcsellocorp-bot/telegram"
 	"github.com/redis/go-redis/v9"
-	"gopkg.in/telebot.v3"
-	"log"
+	"gorm.io/gorm"
 	"net/http"
+	"strconv"
 	"sync/atomic"
 	"time"
 )
 
-func handleNotify(ctx *gin.Context) {
+func (s *Server) handleNotify(ctx *gin.Context) {
 	token := getTokenFromContext(ctx)
 	if token == nil {
 		handleInternalError(ctx, fmt.Errorf("invalid token"))
 		return
 	}
 
-	if !token.CapNotify {
-		ctx.JSON(http.StatusForbidden, gin.H{"reason": "capability disallowed"})
+	if !authorize(ctx, token, db.CapNotify) {
 		return
 	}
 
@@ -36,55 +34,268 @@ func handleNotify(ctx *gin.Context) {
 		handleUserError(ctx, err)
 		return
 	}
-	if req.Text == "" {
-		handleUserError(ctx, fmt.Errorf("text may not be empty"))
+	var ok bool
+	req.Text, ok = s.resolveText(ctx, req.Text, req.Template, req.Vars)
+	if !ok {
 		return
 	}
 
-	var targetChannel *db.Channel = nil
+	targetChannel, ok := s.authorizeChannel(ctx, token, db.CapNotify, req.Channel)
+	if !ok {
+		return
+	}
+
+	if !s.enforceLimits(ctx, token, targetChannel) {
+		return
+	}
 
-	for _, ch := range token.AllowedChannels {
-		if ch.Name == req.Channel {
-			targetChannel = ch
-			break
+	if req.SendAt != nil || req.Delay != 0 {
+		s.scheduleNotification(ctx, token, targetChannel, req)
+		return
+	}
+
+	msg := telegram.FormatMessage(token.Name, targetChannel.Name, req.Text)
+
+	var sentMessages []memdb.StoredMessage
+	sentMessages, err = s.messenger.SendToSubscribers(deliveryContext(ctx), targetChannel, msg)
+	if err != nil {
+		if len(sentMessages) == 0 {
+			handleInternalError(ctx, err)
+			return
 		}
+		// the delivered messages are stored anyway, so they can still be edited or deleted
+		logger.ErrorContext(ctx, "Notification delivered partially", "token", token.Name, "channel", targetChannel.Name, "error", err)
 	}
-	if targetChannel == nil {
-		ctx.JSON(http.StatusNotFound, gin.H{"reason": "channel not found or no permission"})
+	partial := err != nil
+
+	var id string
+	id, err = s.questions.StoreNotification(deliveryContext(ctx), memdb.NotificationData{
+		RelatedMessages: sentMessages,
+		SourceTokenID:   token.ID,
+		ChannelName:     targetChannel.Name,
+	})
+	if err != nil {
+		handleInternalError(ctx, err)
 		return
 	}
 
-	// fill subscribers basically
-	targetChannel, err = db.GetChannelById(targetChannel.ID)
+	resp := NotifyResponse{
+		ID:                id,
+		DeliveredToAnyone: len(sentMessages) > 0,
+		PartialDelivery:   partial,
+	}
 
-	msg := fmt.Sprintf("[%s -> %s]\n\n%s", token.Name, targetChannel.Name, req.Text)
+	addUsage(ctx, db.TokenUsage{Notifications: 1})
+	logger.InfoContext(ctx, "New notification created", "token", token.Name, "channel", targetChannel.Name)
+	ctx.JSON(http.StatusOK, resp)
+}
 
-	delivered := false
-	for _, sub := range targetChannel.Subscribers {
+// maxSchedulingHorizon is how far in the future notifications may be scheduled
+const maxSchedulingHorizon = 365 * 24 * time.Hour
 
-		_, err = telegram.GetBot().Send(&telebot.User{ID: sub.ID}, msg, telebot.ModeDefault)
-		if err != nil {
-			handleInternalError(ctx, err)
+// scheduleNotification stores the notification to be delivered later by the scheduler
+func (s *Server) scheduleNotification(ctx *gin.Context, token *db.Token, targetChannel *db.Channel, req NotifyRequest) {
+	if req.SendAt != nil && req.Delay != 0 {
+		handleUserError(ctx, fmt.Errorf("only one of send_at and delay may be set"))
+		return
+	}
+
+	// checked before converting, as large delays overflow time.Duration
+	if req.Delay > uint(maxSchedulingHorizon/time.Second) {
+		handleUserError(ctx, fmt.Errorf("delay too long, maximum is %d seconds", maxSchedulingHorizon/time.Second))
+		return
+	}
+
+	var sendAt time.Time
+	if req.SendAt != nil {
+		sendAt = *req.SendAt
+	} else {
+		sendAt = time.Now().Add(time.Duration(req.Delay) * time.Second)
+	}
+
+	if !sendAt.After(time.Now()) {
+		handleUserError(ctx, fmt.Errorf("send_at must be in the future"))
+		return
+	}
+	if sendAt.After(time.Now().Add(maxSchedulingHorizon)) {
+		handleUserError(ctx, fmt.Errorf("send_at too far in the future, maximum is %s", maxSchedulingHorizon))
+		return
+	}
+
+	scheduled, err := s.store.CreateScheduledNotification(&db.ScheduledNotification{
+		SendAt:    sendAt,
+		Text:      req.Text,
+		TokenID:   token.ID,
+		ChannelID: targetChannel.ID,
+		Channel:   targetChannel,
+	})
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "New notification scheduled", "token", token.Name, "channel", targetChannel.Name, "send_at", sendAt)
+	ctx.JSON(http.StatusAccepted, ScheduledNotificationToRepr(*scheduled))
+}
+
+func (s *Server) handleListScheduledNotify(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	if !authorize(ctx, token, db.CapNotify) {
+		return
+	}
+
+	scheduled, err := s.store.GetScheduledNotificationsByToken(token.ID)
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+
+	resp := make([]ScheduledNotificationRepr, len(scheduled))
+	for i, sn := range scheduled {
+		resp[i] = ScheduledNotificationToRepr(sn)
+	}
+
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) handleDeleteScheduledNotify(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	if !authorize(ctx, token, db.CapNotify) {
+		return
+	}
+
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 32)
+	if err != nil {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	err = s.store.DeleteScheduledNotification(token.ID, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.Status(http.StatusNotFound)
 			return
 		}
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Scheduled notification deleted", "token", token.Name, "id", id)
+	ctx.Status(http.StatusNoContent)
+}
 
-		delivered = true
+// getOwnNotification loads the notification data, and makes sure it was sent by the current token
+func (s *Server) getOwnNotification(ctx *gin.Context, token *db.Token) (*memdb.NotificationData, bool) {
+	n, err := s.questions.GetNotificationData(ctx, ctx.Param("id"))
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			ctx.Status(http.StatusNotFound)
+			return nil, false
+		}
+		handleInternalError(ctx, err)
+		return nil, false
+	}
+
+	if n == nil || n.SourceTokenID != token.ID {
+		ctx.Status(http.StatusNotFound)
+		return nil, false
+	}
+
+	return n, true
+}
+
+func (s *Server) handleEditNotify(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	if !authorize(ctx, token, db.CapNotify) {
+		return
+	}
+
+	var req NotifyEditRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+	var ok bool
+	req.Text, ok = s.resolveText(ctx, req.Text, req.Template, req.Vars)
+	if !ok {
+		return
+	}
+
+	n, ok := s.getOwnNotification(ctx, token)
+	if !ok {
+		return
 	}
 
-	resp := NotifyResponse{DeliveredToAnyone: delivered}
+	err = s.messenger.EditMessages(ctx, n.RelatedMessages, telegram.FormatMessage(token.Name, n.ChannelName, req.Text))
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+
+	resp := NotifyResponse{
+		ID:                ctx.Param("id"),
+		DeliveredToAnyone: len(n.RelatedMessages) > 0,
+	}
 
-	log.Println("API: New notification created: ", token.Name, " -- ch: ", targetChannel.Name)
+	logger.InfoContext(ctx, "Notification edited", "token", token.Name, "channel", n.ChannelName)
 	ctx.JSON(http.StatusOK, resp)
 }
 
-func handleNewQuestion(ctx *gin.Context) {
+func (s *Server) handleDeleteNotify(ctx *gin.Context) {
 	token := getTokenFromContext(ctx)
 	if token == nil {
 		handleInternalError(ctx, fmt.Errorf("invalid token"))
 		return
 	}
-	if !token.CapQuestion {
-		ctx.JSON(http.StatusForbidden, gin.H{"reason": "capability disallowed"})
+
+	if !authorize(ctx, token, db.CapNotify) {
+		return
+	}
+
+	n, ok := s.getOwnNotification(ctx, token)
+	if !ok {
+		return
+	}
+
+	err := s.messenger.DeleteMessages(ctx, n.RelatedMessages)
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+
+	err = s.questions.DeleteNotification(ctx, ctx.Param("id"))
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Notification deleted", "token", token.Name, "channel", n.ChannelName)
+	ctx.Status(http.StatusNoContent)
+}
+
+func (s *Server) handleNewQuestion(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+	if !authorize(ctx, token, db.CapQuestion) {
 		return
 	}
 
@@ -98,8 +309,9 @@ func handleNewQuestion(ctx *gin.Context) {
 		handleUserError(ctx, fmt.Errorf("no options provided"))
 		return
 	}
-	if req.Text == "" {
-		handleUserError(ctx, fmt.Errorf("text may not be empty"))
+	var ok bool
+	req.Text, ok = s.resolveText(ctx, req.Text, req.Template, req.Vars)
+	if !ok {
 		return
 	}
 	for _, op := range req.Options {
@@ -119,88 +331,50 @@ func handleNewQuestion(ctx *gin.Context) {
 		}
 	}
 
-	var targetChannel *db.Channel = nil
-
-	for _, ch := range token.AllowedChannels {
-		if ch.Name == req.Channel {
-			targetChannel = ch
-			break
-		}
-	}
-	if targetChannel == nil {
-		ctx.JSON(http.StatusNotFound, gin.H{"reason": "channel not found or no permission"})
+	targetChannel, ok := s.authorizeChannel(ctx, token, db.CapQuestion, req.Channel)
+	if !ok {
 		return
 	}
 
-	// fill subscribers basically
-	targetChannel, err = db.GetChannelById(targetChannel.ID)
-
 	if len(targetChannel.Subscribers) == 0 {
 		handleUserError(ctx, fmt.Errorf("no subscribers on this channel"))
 		return
 	}
 
-	var newQuestionTx memdb.NewQuestionTx
-	newQuestionTx, err = memdb.BeginNewQuestion(ctx, token.ID)
-	if err != nil {
-		handleInternalError(ctx, err)
+	if !s.enforceLimits(ctx, token, targetChannel) {
 		return
 	}
 
-	// compile message
-	markup := &telebot.ReplyMarkup{}
-	rows := make([]telebot.Row, len(req.Options))
+	options := make([]memdb.QuestionOption, len(req.Options))
 	for i, op := range req.Options {
-
-		newQuestionTx.AddOption(op.Data, op.Label) // store the original label in redis
-
-		label := op.Label
-		if label == "" {
-			label = op.Data
-		}
-
-		var btnData []byte
-		btnData, err = json.Marshal(common.CallbackData{
-			RandomID: newQuestionTx.RandomID(),
-			Data:     op.Data,
-		})
-		if err != nil {
-			handleInternalError(ctx, err)
-			return
-		}
-
-		rows[i] = markup.Row(markup.Data(label, common.CallbackIDQuestion, string(btnData)))
+		options[i] = memdb.QuestionOption{Data: op.Data, Label: op.Label}
 	}
-	markup.Inline(rows...)
-
-	msg := fmt.Sprintf("[%s -> %s]\n\n%s", token.Name, targetChannel.Name, req.Text)
-
-	for _, sub := range targetChannel.Subscribers {
-		var m *telebot.Message
-		m, err = telegram.GetBot().Send(&telebot.User{ID: sub.ID}, msg, telebot.ModeDefault, markup)
-		if err != nil {
-			handleInternalError(ctx, err)
-			return
-		}
 
-		newQuestionTx.AddRelatedMessage(memdb.StoredMessage{MessageID: m.ID, ChatID: m.Chat.ID})
-	}
+	msg := telegram.FormatMessage(token.Name, targetChannel.Name, req.Text)
 
-	err = newQuestionTx.Close()
+	var id string
+	id, err = s.messenger.SendQuestion(deliveryContext(ctx), token.ID, targetChannel, msg, options)
 	if err != nil {
 		handleInternalError(ctx, err)
 		return
 	}
 
 	resp := QuestionResponse{
-		ID: newQuestionTx.RandomID(),
+		ID: id,
 	}
 
-	log.Println("API: New question created: ", token.Name, " -- ch: ", targetChannel.Name, " -- op:", len(req.Options))
+	addUsage(ctx, db.TokenUsage{Questions: 1})
+	logger.InfoContext(ctx, "New question created", "token", token.Name, "channel", targetChannel.Name, "options", len(req.Options))
 	ctx.JSON(http.StatusCreated, resp)
 }
 
-func memdbAnswerToApiResponse(id string, q memdb.QuestionData) (QuestionResponse, error) {
+// deliveryContext carries the values of the request, but is not cancelled when the client disconnects.
+// Once the messages are being sent they must be recorded, or they could not be edited, deleted or answered later.
+func deliveryContext(ctx *gin.Context) context.Context {
+	return context.WithoutCancel(ctx.Request.Context())
+}
+
+func (s *Server) memdbAnswerToApiResponse(ctx context.Context, id string, q memdb.QuestionData) (QuestionResponse, error) {
 	var err error
 
 	resp := QuestionResponse{
@@ -213,7 +387,7 @@ func memdbAnswerToApiResponse(id string, q memdb.QuestionData) (QuestionResponse
 
 		// get answerer data from db
 		var user *db.User
-		user, err = db.GetUserById(*q.AnswererID)
+		user, err = s.store.GetUserById(ctx, *q.AnswererID)
 		if err != nil {
 			return resp, err
 		}
@@ -229,20 +403,19 @@ func memdbAnswerToApiResponse(id string, q memdb.QuestionData) (QuestionResponse
 
 }
 
-func handleQuestionAnswer(ctx *gin.Context) {
+func (s *Server) handleQuestionAnswer(ctx *gin.Context) {
 	token := getTokenFromContext(ctx)
 	if token == nil {
 		handleInternalError(ctx, fmt.Errorf("invalid token"))
 		return
 	}
-	if !token.CapQuestion {
-		ctx.JSON(http.StatusForbidden, gin.H{"reason": "capability disallowed"})
+	if !authorize(ctx, token, db.CapQuestion, db.CapReadHistory) {
 		return
 	}
 
 	id := ctx.Param("id")
 
-	q, err := memdb.GetQuestionData(ctx, id)
+	q, err := s.questions.GetQuestionData(ctx, id)
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
 			ctx.Status(http.StatusNotFound)
@@ -253,13 +426,13 @@ func handleQuestionAnswer(ctx *gin.Context) {
 		return
 	}
 
-	if q == nil || q.SourceTokenID != token.ID {
+	if q == nil || !canReadQuestion(token, q) {
 		ctx.Status(http.StatusNotFound)
 		return
 	}
 
 	var resp QuestionResponse
-	resp, err = memdbAnswerToApiResponse(id, *q)
+	resp, err = s.memdbAnswerToApiResponse(ctx, id, *q)
 	if err != nil {
 		handleInternalError(ctx, err)
 		return
@@ -268,21 +441,20 @@ func handleQuestionAnswer(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, resp)
 }
 
-func handleQuestionAnswerPolling(ctx *gin.Context) {
+func (s *Server) handleQuestionAnswerPolling(ctx *gin.Context) {
 	token := getTokenFromContext(ctx)
 	if token == nil {
 		handleInternalError(ctx, fmt.Errorf("invalid token"))
 		return
 	}
-	if !token.CapQuestion {
-		ctx.JSON(http.StatusForbidden, gin.H{"reason": "capability disallowed"})
+	if !authorize(ctx, token, db.CapQuestion, db.CapReadHistory) {
 		return
 	}
 
 	id := ctx.Param("id")
 
 	// we have to load the data at least once, to determine if we are allowed to read it
-	preCheckQ, err := memdb.GetQuestionData(ctx, id)
+	preCheckQ, err := s.questions.GetQuestionData(ctx, id)
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
 			ctx.Status(http.StatusNotFound)
@@ -292,7 +464,7 @@ func handleQuestionAnswerPolling(ctx *gin.Context) {
 		return
 	}
 
-	if preCheckQ == nil || preCheckQ.SourceTokenID != token.ID {
+	if preCheckQ == nil || !canReadQuestion(token, preCheckQ) {
 		ctx.Status(http.StatusNotFound)
 		return
 	}
@@ -301,7 +473,7 @@ func handleQuestionAnswerPolling(ctx *gin.Context) {
 
 	// well, it looks like it's already answered...
 	if preCheckQ.IsAnswered() {
-		resp, err = memdbAnswerToApiResponse(id, *preCheckQ)
+		resp, err = s.memdbAnswerToApiResponse(ctx, id, *preCheckQ)
 		if err != nil {
 			handleInternalError(ctx, err)
 			return
@@ -311,8 +483,10 @@ func handleQuestionAnswerPolling(ctx *gin.Context) {
 	}
 
 	// we are allowed to read it, and not answered yet, set up waiting meme
+	metrics.ActiveLongPolls.Inc()
+	defer metrics.ActiveLongPolls.Dec()
 
-	ctx2, cancel := context.WithTimeout(ctx, 120*time.Second)
+	ctx2, cancel := context.WithTimeout(ctx, s.pollTimeout)
 	defer cancel()
 
 	answeredQuestionChan := make(chan *memdb.QuestionData)
@@ -324,7 +498,7 @@ func handleQuestionAnswerPolling(ctx *gin.Context) {
 	defer connectionClosed.Store(true)
 
 	go func() {
-		q, internalErr := memdb.WaitForAnswer(ctx2, id)
+		q, internalErr := s.questions.WaitForAnswer(ctx2, id)
 		if connectionClosed.Load() {
 			// channels are possibly closed, or will be closed soon, don't send anything on them
 			return
@@ -345,7 +519,7 @@ func handleQuestionAnswerPolling(ctx *gin.Context) {
 			return
 		}
 
-		resp, err = memdbAnswerToApiResponse(id, *q)
+		resp, err = s.memdbAnswerToApiResponse(ctx, id, *q)
 		if err != nil {
 			handleInternalError(ctx, err)
 			return
@@ -361,12 +535,13 @@ func handleQuestionAnswerPolling(ctx *gin.Context) {
 		}
 		handleInternalError(ctx, err)
 		return
-	case <-ctx.Writer.CloseNotify():
-		// client closed request, ctx2 close is deferred
-		return
 	case <-ctx.Request.Context().Done():
 		// client closed request, ctx2 close is deferred
 		return
+	case <-s.shuttingDown:
+		// same as if no answer arrived, the client should poll again
+		ctx.Status(http.StatusNoContent)
+		return
 	}
 
 }
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/marcsello/marcsellocorp-bot/version"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	readinessCacheTTL     = 10 * time.Second // probes are frequent, getMe should not be called on every one of them
+	readinessCheckTimeout = 3 * time.Second
+)
+
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// readinessChecks lists the dependencies the API can not work without
+func (s *Server) readinessChecks() []readinessCheck {
+	return []readinessCheck{
+		{"postgres", s.store.Ping},
+		{"redis", s.questions.Ping},
+		{"telegram", s.messenger.Ping},
+	}
+}
+
+type ReadinessRepr struct {
+	Ready     bool              `json:"ready"`
+	Checks    map[string]string `json:"checks"` // "ok" or "failed", the errors are only logged as they may contain secrets
+	CheckedAt time.Time         `json:"checked_at"`
+}
+
+// checkReadiness runs the checks in parallel, or returns the cached result if it is recent enough
+func (s *Server) checkReadiness() ReadinessRepr {
+	s.readinessMutex.Lock()
+	defer s.readinessMutex.Unlock()
+
+	if s.readinessResult != nil && time.Since(s.readinessResult.CheckedAt) < readinessCacheTTL {
+		return *s.readinessResult
+	}
+
+	// not bound to the request, the result is shared with the other probes
+	checkCtx, cancel := context.WithTimeout(context.Background(), readinessCheckTimeout)
+	defer cancel()
+
+	checks := s.readinessChecks()
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c readinessCheck) {
+			defer wg.Done()
+			errs[i] = c.check(checkCtx)
+		}(i, c)
+	}
+	wg.Wait()
+
+	result := ReadinessRepr{
+		Ready:     true,
+		Checks:    make(map[string]string, len(checks)),
+		CheckedAt: time.Now(),
+	}
+	for i, c := range checks {
+		if errs[i] != nil {
+			logger.Warn("Readiness check failed", "check", c.name, "error", errs[i])
+			result.Ready = false
+			result.Checks[c.name] = "failed" // the request URL in the errors of telebot contains the bot token
+		} else {
+			result.Checks[c.name] = "ok"
+		}
+	}
+
+	s.readinessResult = &result
+	return result
+}
+
+// handleHealthz is the liveness probe, it only tells that the process is able to serve requests
+func handleHealthz(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleReadyz is the readiness probe, it fails if any of the dependencies are unreachable
+func (s *Server) handleReadyz(ctx *gin.Context) {
+	select {
+	case <-s.shuttingDown:
+		ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"reason": "shutting down"})
+		return
+	default:
+	}
+
+	result := s.checkReadiness()
+	if !result.Ready {
+		ctx.JSON(http.StatusServiceUnavailable, result)
+		return
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+func handleVersion(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, version.Info())
+}
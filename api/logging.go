@@ -0,0 +1,47 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/marcsello/marcsellocorp-bot/logging"
+	"github.com/marcsello/marcsellocorp-bot/utils"
+	"regexp"
+	"time"
+)
+
+var logger = logging.Component("api")
+
+const requestIdHeader = "X-Request-ID"
+
+// request IDs set by the client (or a proxy) are accepted only if they are safe to log
+var requestIdRe = regexp.MustCompile(`^[A-Za-z0-9._-]{8,64}$`)
+
+// requestIdMiddleware assigns an ID to the request, which is logged with every record related to it, and returned to the client
+func requestIdMiddleware(ctx *gin.Context) {
+	requestId := ctx.GetHeader(requestIdHeader)
+	if !requestIdRe.MatchString(requestId) {
+		var err error
+		requestId, err = utils.GenerateRandomString(16)
+		if err != nil {
+			handleInternalError(ctx, err)
+			return
+		}
+	}
+
+	ctx.Request = ctx.Request.WithContext(logging.WithRequestID(ctx.Request.Context(), requestId))
+	ctx.Header(requestIdHeader, requestId)
+	ctx.Next()
+}
+
+// accessLogMiddleware logs every request on debug level
+func accessLogMiddleware(ctx *gin.Context) {
+	start := time.Now()
+	ctx.Next()
+
+	logger.DebugContext(ctx, "Request handled",
+		"method", ctx.Request.Method,
+		"path", ctx.Request.URL.Path,
+		"status", ctx.Writer.Status(),
+		"client_ip", ctx.ClientIP(),
+		"elapsed", time.Since(start),
+	)
+}
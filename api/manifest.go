@@ -0,0 +1,87 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/manifest"
+	"io"
+	"net/http"
+)
+
+const maxManifestSize = 4 << 20
+
+func (s *Server) handleAdminExportManifest(ctx *gin.Context) {
+	format := ctx.DefaultQuery("format", manifest.FormatJSON)
+	if format != manifest.FormatJSON && format != manifest.FormatYAML {
+		handleUserError(ctx, fmt.Errorf("unknown format: %s", format))
+		return
+	}
+
+	m, err := manifest.Export(s.store)
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+
+	var data []byte
+	data, err = manifest.Encode(m, format)
+	if err != nil {
+		handleInternalError(ctx, err)
+		return
+	}
+
+	contentType := "application/json"
+	if format == manifest.FormatYAML {
+		contentType = "application/yaml"
+	}
+	ctx.Data(http.StatusOK, contentType, data)
+}
+
+// handleAdminImportManifest accepts manifests in both YAML and JSON format
+func (s *Server) handleAdminImportManifest(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(ctx.Request.Body, maxManifestSize+1))
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+	if len(data) > maxManifestSize {
+		ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"reason": "manifest too large"})
+		return
+	}
+
+	m, err := manifest.Parse(data)
+	if err != nil {
+		handleUserError(ctx, err)
+		return
+	}
+
+	opts := manifest.Options{
+		DryRun: ctx.Query("dry_run") == "true",
+		Prune:  ctx.Query("prune") == "true",
+	}
+	result, err := manifest.Import(s.store, m, db.TokenActor(token.ID), opts)
+	if err != nil {
+		if errors.Is(err, manifest.ErrInvalid) {
+			handleUserError(ctx, err)
+			return
+		}
+		if result == nil {
+			handleInternalError(ctx, err)
+			return
+		}
+		logger.InfoContext(ctx, "Manifest import failed", "token", token.Name, "applied", result.Applied, "error", err)
+		ctx.JSON(http.StatusConflict, gin.H{"reason": err.Error(), "result": result})
+		return
+	}
+
+	logger.InfoContext(ctx, "Manifest imported", "token", token.Name, "changes", len(result.Changes), "dry_run", opts.DryRun)
+	ctx.JSON(http.StatusOK, result)
+}
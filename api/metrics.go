@@ -0,0 +1,27 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/marcsello/marcsellocorp-bot/metrics"
+	"strconv"
+	"time"
+)
+
+// metricsMiddleware counts every request, the token is known only after the handler chain has run
+func metricsMiddleware(ctx *gin.Context) {
+	start := time.Now()
+	ctx.Next()
+
+	route := ctx.FullPath()
+	if route == "" {
+		route = "unmatched" // the raw path would have unbounded cardinality
+	}
+
+	tokenName := ""
+	if token := getTokenFromContext(ctx); token != nil {
+		tokenName = token.Name
+	}
+
+	metrics.ApiRequests.WithLabelValues(ctx.Request.Method, route, strconv.Itoa(ctx.Writer.Status()), tokenName).Inc()
+	metrics.ApiRequestDuration.WithLabelValues(ctx.Request.Method, route).Observe(time.Since(start).Seconds())
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/marcsello/marcsellocorp-bot/utils"
 	"gorm.io/gorm"
 	"net/http"
+	"net/netip"
 	"strings"
 )
 
@@ -29,29 +30,50 @@ func getTokenFromContext(ctx *gin.Context) *db.Token {
 	return t
 }
 
-func requireValidTokenMiddleware(ctx *gin.Context) {
+func (s *Server) requireValidTokenMiddleware(ctx *gin.Context) {
 
-	key, ok := parseAuthHeader(ctx, "Bearer")
-	if !ok {
+	var token *db.Token
+	if key, ok := parseAuthHeader(ctx, "Bearer"); ok {
+		var err error
+		token, err = s.store.LookupTokenByHash(ctx, utils.TokenHash(key))
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				ctx.AbortWithStatus(http.StatusUnauthorized)
+			} else {
+				handleInternalError(ctx, err)
+				ctx.Abort()
+			}
+			return
+		}
+		if token.AuthScheme != db.AuthSchemeBearer {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"reason": "token requires signed requests"})
+			return
+		}
+	} else if credentials, ok := parseAuthHeader(ctx, hmacAuthType); ok {
+		token, ok = s.verifySignedRequest(ctx, credentials)
+		if !ok {
+			return
+		}
+	} else {
 		ctx.AbortWithStatus(http.StatusUnauthorized)
 		return
 	}
 
-	token, err := db.GetAndUpdateTokenByHash(utils.TokenHash(key))
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			ctx.AbortWithStatus(http.StatusUnauthorized)
-		} else {
-			handleInternalError(ctx, err)
-			ctx.Abort()
-		}
+	if token.IsExpired() {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"reason": "token expired"})
 		return
 	}
-	if token == nil {
-		ctx.AbortWithStatus(http.StatusUnauthorized)
-		return
+
+	if token.AllowedCIDRs != "" {
+		// ClientIP only honors X-Forwarded-For when the request comes from a trusted proxy
+		addr, err := netip.ParseAddr(ctx.ClientIP())
+		if err != nil || !token.AllowsSource(addr) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"reason": "source address not allowed"})
+			return
+		}
 	}
 
+	s.store.TouchToken(token.ID, ctx.ClientIP())
 	ctx.Set("token", token)
 }
 
@@ -2,6 +2,7 @@ package api
 
 import (
 	"github.com/marcsello/marcsellocorp-bot/db"
+	"strings"
 	"time"
 )
 
@@ -10,10 +11,48 @@ import (
 type NotifyRequest struct {
 	Text    string `json:"text"`
 	Channel string `json:"channel"`
+
+	// Optional, can be used instead of Text
+	Template string                 `json:"template"`
+	Vars     map[string]interface{} `json:"vars"`
+
+	// Optional, setting any of these schedules the notification instead of sending it right away
+	SendAt *time.Time `json:"send_at"`
+	Delay  uint       `json:"delay"` // seconds
+}
+
+type NotifyEditRequest struct {
+	Text string `json:"text"`
+
+	// Optional, can be used instead of Text
+	Template string                 `json:"template"`
+	Vars     map[string]interface{} `json:"vars"`
 }
 
 type NotifyResponse struct {
+	ID string `json:"id"` // RandomID stored in the db, can be used to edit or delete the notification
+
 	DeliveredToAnyone bool `json:"delivered_to_anyone"`
+	PartialDelivery   bool `json:"partial_delivery,omitempty"` // delivering to some subscribers failed, sending again would duplicate the rest
+}
+
+type ScheduledNotificationRepr struct {
+	ID      uint      `json:"id"`
+	Text    string    `json:"text"`
+	Channel string    `json:"channel"`
+	SendAt  time.Time `json:"send_at"`
+}
+
+func ScheduledNotificationToRepr(s db.ScheduledNotification) ScheduledNotificationRepr {
+	repr := ScheduledNotificationRepr{
+		ID:     s.ID,
+		Text:   s.Text,
+		SendAt: s.SendAt,
+	}
+	if s.Channel != nil {
+		repr.Channel = s.Channel.Name
+	}
+	return repr
 }
 
 // Question
@@ -45,6 +84,10 @@ type QuestionRequest struct {
 	Text    string `json:"text"`
 	Channel string `json:"channel"`
 
+	// Optional, can be used instead of Text
+	Template string                 `json:"template"`
+	Vars     map[string]interface{} `json:"vars"`
+
 	Options []QuestionOption `json:"options"`
 }
 
@@ -59,3 +102,197 @@ type QuestionResponse struct {
 
 	Answer *QuestionAnswer `json:"answer"`
 }
+
+// Admin
+
+type CapabilitiesRepr struct {
+	Capabilities []string `json:"capabilities"`
+}
+
+func CapabilitiesToRepr(caps []db.Capability) CapabilitiesRepr {
+	repr := CapabilitiesRepr{Capabilities: make([]string, len(caps))}
+	for i, c := range caps {
+		repr.Capabilities[i] = string(c)
+	}
+	return repr
+}
+
+type TokenGrantRepr struct {
+	ChannelPattern string   `json:"channel_pattern"`
+	Capabilities   []string `json:"capabilities"`
+}
+
+func TokenGrantToRepr(g db.TokenGrant) TokenGrantRepr {
+	return TokenGrantRepr{
+		ChannelPattern: g.ChannelPattern,
+		Capabilities:   CapabilitiesToRepr(db.SplitCapabilities(g.Capabilities)).Capabilities,
+	}
+}
+
+type TokenUsageRepr struct {
+	Day           string `json:"day,omitempty"` // YYYY-MM-DD, empty for totals
+	Requests      int64  `json:"requests"`
+	Notifications int64  `json:"notifications"`
+	Questions     int64  `json:"questions"`
+	Errors        int64  `json:"errors"`
+}
+
+func TokenUsageToRepr(u db.TokenUsage) TokenUsageRepr {
+	repr := TokenUsageRepr{
+		Requests:      u.Requests,
+		Notifications: u.Notifications,
+		Questions:     u.Questions,
+		Errors:        u.Errors,
+	}
+	if !u.Day.IsZero() {
+		repr.Day = u.Day.Format(time.DateOnly)
+	}
+	return repr
+}
+
+type TokenStatsRepr struct {
+	Name         string     `json:"name"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsed     *time.Time `json:"last_used"`
+	LastSourceIP string     `json:"last_source_ip"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+
+	Total TokenUsageRepr   `json:"total"`
+	Days  []TokenUsageRepr `json:"days"`
+}
+
+type ChannelRepr struct {
+	Name            string     `json:"name"`
+	Description     string     `json:"description"`
+	Icon            string     `json:"icon"`
+	DefaultPriority string     `json:"default_priority"`
+	OwnerContact    string     `json:"owner_contact"`
+	RateLimit       int        `json:"rate_limit"`
+	RateBurst       int        `json:"rate_burst"`
+	CreatedAt       time.Time  `json:"created_at"`
+	LastActivity    *time.Time `json:"last_activity"`
+}
+
+func ChannelToRepr(c db.Channel) ChannelRepr {
+	return ChannelRepr{
+		Name:            c.Name,
+		Description:     c.Description,
+		Icon:            c.Icon,
+		DefaultPriority: c.DefaultPriority,
+		OwnerContact:    c.OwnerContact,
+		RateLimit:       c.RateLimit,
+		RateBurst:       c.RateBurst,
+		CreatedAt:       c.CreatedAt,
+		LastActivity:    c.LastActivity,
+	}
+}
+
+// ChannelRequest is used to create and edit channels, fields left out are not changed on edit
+type ChannelRequest struct {
+	Name            string  `json:"name"` // only used on create
+	Description     *string `json:"description"`
+	Icon            *string `json:"icon"`
+	DefaultPriority *string `json:"default_priority"`
+	OwnerContact    *string `json:"owner_contact"`
+}
+
+type RenameRequest struct {
+	Name string `json:"name"`
+}
+
+type LimitsRepr struct {
+	RateLimit  int `json:"rate_limit" binding:"min=0"`
+	RateBurst  int `json:"rate_burst" binding:"min=0"`
+	DailyQuota int `json:"daily_quota" binding:"min=0"` // tokens only
+}
+
+type AdminUserRepr struct {
+	UserRepr
+	Active bool `json:"active"`
+	Admin  bool `json:"admin"`
+}
+
+func UserToAdminUserRepr(u db.User) AdminUserRepr {
+	return AdminUserRepr{
+		UserRepr: UserToUserRepr(u),
+		Active:   u.IsActive(),
+		Admin:    u.IsAdmin(),
+	}
+}
+
+type UserRequest struct {
+	FirstName string `json:"first_name" binding:"required,max=64"`
+	LastName  string `json:"last_name" binding:"max=64"`
+	Username  string `json:"username" binding:"max=32"`
+	PhotoUrl  string `json:"photo_url" binding:"max=128"`
+	Active    bool   `json:"active"`
+	Admin     bool   `json:"admin"`
+}
+
+type TokenRepr struct {
+	Name               string           `json:"name"`
+	CreatedAt          time.Time        `json:"created_at"`
+	LastUsed           *time.Time       `json:"last_used"`
+	LastSourceIP       string           `json:"last_source_ip"`
+	ExpiresAt          *time.Time       `json:"expires_at"`
+	AuthScheme         string           `json:"auth_scheme"`
+	Grants             []TokenGrantRepr `json:"grants"`
+	GlobalCapabilities []string         `json:"global_capabilities"`
+	AllowedCIDRs       []string         `json:"allowed_cidrs"`
+	Limits             LimitsRepr       `json:"limits"`
+}
+
+func TokenToRepr(t db.Token) TokenRepr {
+	repr := TokenRepr{
+		Name:               t.Name,
+		CreatedAt:          t.CreatedAt,
+		LastUsed:           t.LastUsed,
+		LastSourceIP:       t.LastSourceIP,
+		ExpiresAt:          t.ExpiresAt,
+		AuthScheme:         t.AuthScheme,
+		Grants:             make([]TokenGrantRepr, len(t.Grants)),
+		GlobalCapabilities: CapabilitiesToRepr(db.SplitCapabilities(t.GlobalCapabilities)).Capabilities,
+		AllowedCIDRs:       []string{},
+		Limits: LimitsRepr{
+			RateLimit:  t.RateLimit,
+			RateBurst:  t.RateBurst,
+			DailyQuota: t.DailyQuota,
+		},
+	}
+	for i, g := range t.Grants {
+		repr.Grants[i] = TokenGrantToRepr(g)
+	}
+	if t.AllowedCIDRs != "" {
+		repr.AllowedCIDRs = strings.Split(t.AllowedCIDRs, ",")
+	}
+	return repr
+}
+
+type NewTokenRequest struct {
+	Name               string           `json:"name"`
+	Grants             []TokenGrantRepr `json:"grants"`
+	GlobalCapabilities []string         `json:"global_capabilities"`
+	ExpiresAt          *time.Time       `json:"expires_at"`
+}
+
+type RotateTokenRequest struct {
+	// Optional, the expiry is not changed if left out
+	ExpiresAt   *time.Time `json:"expires_at"`
+	NeverExpire bool       `json:"never_expire"`
+}
+
+// TokenSecretRepr is only returned when a secret is generated, it can not be retrieved later
+type TokenSecretRepr struct {
+	TokenRepr
+	Secret     string `json:"secret"`
+	HmacSecret string `json:"hmac_secret,omitempty"` // only when a token signing its requests is rotated
+}
+
+type AuthSchemeRepr struct {
+	AuthScheme string `json:"auth_scheme" binding:"required,oneof=bearer hmac"`
+	HmacSecret string `json:"hmac_secret,omitempty"` // only in responses, when a new secret is generated
+}
+
+type AllowedCIDRsRepr struct {
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// abortRateLimited aborts the request with 429, telling the client when to retry
+func abortRateLimited(ctx *gin.Context, reason string, retryAfter time.Duration) {
+	ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"reason": reason})
+}
+
+// enforceLimits takes a message from the rate limits of the token and the channel, and counts it towards the daily quota of the token.
+// Aborts the request with 429 if any of them is exceeded, what was taken by the other limits is given back then,
+// so rejected requests do not use up the limits.
+func (s *Server) enforceLimits(ctx *gin.Context, token *db.Token, channel *db.Channel) bool {
+	var refunds []func() error
+	refund := func() {
+		for _, r := range refunds {
+			err := r()
+			if err != nil {
+				logger.ErrorContext(ctx, "Failed to refund limit", "error", err)
+			}
+		}
+	}
+
+	if token.RateLimit > 0 {
+		wait, err := s.limiter.TakeTokenRateLimit(ctx, token.ID, token.RateLimit, token.RateBurst)
+		if err != nil {
+			handleInternalError(ctx, err)
+			return false
+		}
+		if wait > 0 {
+			abortRateLimited(ctx, "token rate limit exceeded", wait)
+			return false
+		}
+		refunds = append(refunds, func() error {
+			return s.limiter.RefundTokenRateLimit(ctx, token.ID, token.RateBurst)
+		})
+	}
+
+	if channel.RateLimit > 0 {
+		wait, err := s.limiter.TakeChannelRateLimit(ctx, channel.ID, channel.RateLimit, channel.RateBurst)
+		if err != nil {
+			refund()
+			handleInternalError(ctx, err)
+			return false
+		}
+		if wait > 0 {
+			refund()
+			abortRateLimited(ctx, "channel rate limit exceeded", wait)
+			return false
+		}
+		refunds = append(refunds, func() error {
+			return s.limiter.RefundChannelRateLimit(ctx, channel.ID, channel.RateBurst)
+		})
+	}
+
+	if token.DailyQuota > 0 {
+		now := time.Now().UTC()
+		day := now.Format(time.DateOnly)
+		used, err := s.limiter.CountDailyUsage(ctx, token.ID, day)
+		if err != nil {
+			refund()
+			handleInternalError(ctx, err)
+			return false
+		}
+		if used > int64(token.DailyQuota) {
+			refunds = append(refunds, func() error {
+				return s.limiter.RefundDailyUsage(ctx, token.ID, day)
+			})
+			refund()
+			s.alertQuotaExceeded(ctx, token, day)
+			tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+			abortRateLimited(ctx, "daily quota exceeded", tomorrow.Sub(now))
+			return false
+		}
+	}
+
+	return true
+}
+
+// alertQuotaExceeded notifies the creator of the token about the exceeded quota, once a day
+func (s *Server) alertQuotaExceeded(ctx *gin.Context, token *db.Token, day string) {
+	if token.CreatorID == nil {
+		return
+	}
+
+	first, err := s.limiter.MarkQuotaAlertSent(ctx, token.ID, day)
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to mark quota alert", "error", err)
+		return
+	}
+	if !first {
+		return
+	}
+
+	msg := fmt.Sprintf("Token %s exceeded its daily quota of %d messages, further messages are rejected until the end of the day (UTC).", token.Name, token.DailyQuota)
+	err = s.messenger.SendToUser(ctx, *token.CreatorID, msg)
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to send quota alert", "error", err)
+		return
+	}
+	logger.InfoContext(ctx, "Quota alert sent", "token", token.Name, "user", *token.CreatorID)
+}
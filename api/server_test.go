@@ -0,0 +1,635 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/marcsello/marcsellocorp-bot/config"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/memdb"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testServer struct {
+	server    *Server
+	store     *fakeStore
+	questions *fakeQuestionStore
+	limiter   *fakeLimiter
+	messenger *fakeMessenger
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	ts := &testServer{
+		store:     newFakeStore(),
+		questions: newFakeQuestionStore(),
+		limiter:   &fakeLimiter{},
+		messenger: &fakeMessenger{},
+	}
+
+	cfg := config.Default()
+	cfg.API.PollTimeout = config.Duration(time.Second)
+
+	var err error
+	ts.server, err = NewServer(cfg.API, cfg.Tokens, ts.store, ts.questions, ts.limiter, ts.messenger, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+// newNotifierToken adds a token allowed to send notifications and questions to the channel, and returns its secret
+func (ts *testServer) newNotifierToken(id uint, channel string) (*db.Token, string) {
+	token := &db.Token{
+		Name:   fmt.Sprintf("notifier%d", id),
+		Grants: []db.TokenGrant{{ChannelPattern: channel, Capabilities: "notify,question"}},
+	}
+	token.ID = id
+	return token, ts.store.addToken(token)
+}
+
+func (ts *testServer) do(t *testing.T, method, path, secret string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	return ts.doWithContext(t, context.Background(), method, path, secret, body)
+}
+
+func (ts *testServer) doWithContext(t *testing.T, ctx context.Context, method, path, secret string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&reqBody).Encode(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, &reqBody).WithContext(ctx)
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rec := httptest.NewRecorder()
+	ts.server.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, rec.Code, rec.Body.String())
+	}
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	err := json.Unmarshal(rec.Body.Bytes(), v)
+	if err != nil {
+		t.Fatalf("invalid response %q: %s", rec.Body.String(), err)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	ts := newTestServer(t)
+
+	rec := ts.do(t, http.MethodGet, "/healthz", "", nil)
+	expectStatus(t, rec, http.StatusOK)
+}
+
+func TestMetricsNotOnAPI(t *testing.T) {
+	ts := newTestServer(t)
+
+	// served on api.metrics_bind only, as they reveal token names
+	rec := ts.do(t, http.MethodGet, "/metrics", "", nil)
+	expectStatus(t, rec, http.StatusNotFound)
+}
+
+func TestReadyz(t *testing.T) {
+	ts := newTestServer(t)
+
+	rec := ts.do(t, http.MethodGet, "/readyz", "", nil)
+	expectStatus(t, rec, http.StatusOK)
+
+	// the result is cached, so a new server is needed to see the failure
+	ts = newTestServer(t)
+	cfg := config.Default()
+	cfg.Telegram.Token = "123456:SECRET-BOT-TOKEN"
+	ts.messenger.pingErr = fmt.Errorf(`telebot: Post "http://127.0.0.1:1/bot%s/getMe": dial tcp 127.0.0.1:1: connect: connection refused`, cfg.Telegram.Token)
+
+	rec = ts.do(t, http.MethodGet, "/readyz", "", nil)
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	if strings.Contains(rec.Body.String(), cfg.Telegram.Token) {
+		t.Fatalf("bot token leaked: %s", rec.Body.String())
+	}
+
+	var result ReadinessRepr
+	decode(t, rec, &result)
+	if result.Ready || result.Checks["telegram"] != "failed" || result.Checks["postgres"] != "ok" || result.Checks["redis"] != "ok" {
+		t.Fatalf("unexpected readiness: %+v", result)
+	}
+}
+
+func TestRequiresValidToken(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addChannel("alerts", 1)
+
+	rec := ts.do(t, http.MethodPost, "/notify", "", NotifyRequest{Channel: "alerts", Text: "hi"})
+	expectStatus(t, rec, http.StatusUnauthorized)
+
+	rec = ts.do(t, http.MethodPost, "/notify", "not-a-token", NotifyRequest{Channel: "alerts", Text: "hi"})
+	expectStatus(t, rec, http.StatusUnauthorized)
+
+	if len(ts.messenger.sent) != 0 {
+		t.Fatal("message sent without a valid token")
+	}
+}
+
+// signedRequest signs the request the same way clients of the hmac auth scheme do
+func signedRequest(t *testing.T, tokenName, secret, path string, body interface{}) *http.Request {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Now().Unix()
+	nonce := fmt.Sprintf("nonce-%d", time.Now().UnixNano())
+	signature := computeRequestSignature(secret, http.MethodPost, path, ts, nonce, data)
+
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("%s %s:%d:%s:%x", hmacAuthType, tokenName, ts, nonce, signature))
+	return req
+}
+
+func TestSignedRequest(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addChannel("alerts", 10)
+	ts.newNotifierToken(1, "alerts") // bearer
+	signer, _ := ts.newNotifierToken(2, "alerts")
+	signer.AuthScheme = db.AuthSchemeHmac
+	signer.HmacSecret = "hmac-secret"
+
+	body := NotifyRequest{Channel: "alerts", Text: "hello"}
+
+	// the responses must not tell whether the token exists or which scheme it uses
+	var rejections []string
+	for _, c := range []struct{ name, secret string }{
+		{"nonexistent", "hmac-secret"},
+		{"notifier1", "hmac-secret"},
+		{"notifier2", "wrong-secret"},
+	} {
+		rec := httptest.NewRecorder()
+		ts.server.Handler().ServeHTTP(rec, signedRequest(t, c.name, c.secret, "/notify", body))
+		expectStatus(t, rec, http.StatusUnauthorized)
+		rejections = append(rejections, rec.Body.String())
+	}
+	if rejections[0] != rejections[1] || rejections[1] != rejections[2] {
+		t.Fatalf("rejections differ: %q", rejections)
+	}
+	if len(ts.store.touched) != 0 {
+		t.Fatalf("tokens touched by rejected requests: %v", ts.store.touched)
+	}
+
+	rec := httptest.NewRecorder()
+	ts.server.Handler().ServeHTTP(rec, signedRequest(t, "notifier2", "hmac-secret", "/notify", body))
+	expectStatus(t, rec, http.StatusOK)
+	if len(ts.store.touched) != 1 || ts.store.touched[0] != signer.ID {
+		t.Fatalf("unexpected touched tokens: %v", ts.store.touched)
+	}
+}
+
+func TestSignedRequestPreviousSecret(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addChannel("alerts", 10)
+	signer, _ := ts.newNotifierToken(1, "alerts")
+	signer.AuthScheme = db.AuthSchemeHmac
+	signer.HmacSecret = "new-secret"
+	signer.PreviousHmacSecret = "old-secret"
+	graceEnd := time.Now().Add(time.Hour)
+	signer.PreviousTokenHashExpiresAt = &graceEnd
+
+	body := NotifyRequest{Channel: "alerts", Text: "hello"}
+	for _, secret := range []string{"new-secret", "old-secret"} {
+		rec := httptest.NewRecorder()
+		ts.server.Handler().ServeHTTP(rec, signedRequest(t, "notifier1", secret, "/notify", body))
+		expectStatus(t, rec, http.StatusOK)
+	}
+
+	graceEnd = time.Now().Add(-time.Minute)
+	rec := httptest.NewRecorder()
+	ts.server.Handler().ServeHTTP(rec, signedRequest(t, "notifier1", "old-secret", "/notify", body))
+	expectStatus(t, rec, http.StatusUnauthorized)
+}
+
+func TestExpiredToken(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addChannel("alerts", 1)
+	token, secret := ts.newNotifierToken(1, "alerts")
+	expired := time.Now().Add(-time.Minute)
+	token.ExpiresAt = &expired
+
+	rec := ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Text: "hi"})
+	expectStatus(t, rec, http.StatusUnauthorized)
+}
+
+func TestNotify(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addChannel("alerts", 10, 11)
+	token, secret := ts.newNotifierToken(1, "alerts")
+
+	rec := ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Text: "disk full"})
+	expectStatus(t, rec, http.StatusOK)
+
+	var resp NotifyResponse
+	decode(t, rec, &resp)
+	if resp.ID == "" || !resp.DeliveredToAnyone {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+
+	if len(ts.messenger.sent) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(ts.messenger.sent))
+	}
+	for _, m := range ts.messenger.sent {
+		if !strings.Contains(m.text, "disk full") || !strings.Contains(m.text, token.Name) {
+			t.Fatalf("unexpected message: %q", m.text)
+		}
+	}
+
+	n, ok := ts.questions.notifications[resp.ID]
+	if !ok || n.SourceTokenID != token.ID || len(n.RelatedMessages) != 2 {
+		t.Fatalf("notification not stored properly: %+v", n)
+	}
+
+	usage := ts.store.tokenUsage(token.ID)
+	if usage.Requests != 1 || usage.Notifications != 1 || usage.Errors != 0 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+}
+
+func TestNotifyPartialDelivery(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addChannel("alerts", 10, 11)
+	_, secret := ts.newNotifierToken(1, "alerts")
+	ts.messenger.sendErr = errors.New("telegram is down")
+	ts.messenger.failAfter = 1
+
+	rec := ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Text: "disk full"})
+	expectStatus(t, rec, http.StatusOK)
+
+	var resp NotifyResponse
+	decode(t, rec, &resp)
+	if resp.ID == "" || !resp.DeliveredToAnyone || !resp.PartialDelivery {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+
+	// the delivered message can still be deleted
+	n, ok := ts.questions.notifications[resp.ID]
+	if !ok || len(n.RelatedMessages) != 1 {
+		t.Fatalf("notification not stored properly: %+v", n)
+	}
+
+	// nothing to store if nothing was delivered
+	ts.messenger.failAfter = 0
+	rec = ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Text: "disk full"})
+	expectStatus(t, rec, http.StatusInternalServerError)
+}
+
+func TestNotifyWithoutPermission(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addChannel("alerts", 10)
+	ts.store.addChannel("secret", 10)
+	token, secret := ts.newNotifierToken(1, "alerts")
+
+	// channels without permission look like they don't exist
+	for _, channel := range []string{"secret", "nonexistent"} {
+		rec := ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: channel, Text: "hi"})
+		expectStatus(t, rec, http.StatusNotFound)
+	}
+
+	if len(ts.messenger.sent) != 0 {
+		t.Fatal("message sent without permission")
+	}
+	if usage := ts.store.tokenUsage(token.ID); usage.Requests != 2 || usage.Errors != 2 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+}
+
+func TestNotifyTemplate(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addChannel("alerts", 10)
+	ts.store.templates["deploy"] = &db.Template{Name: "deploy", Body: "{{.app}} deployed"}
+	_, secret := ts.newNotifierToken(1, "alerts")
+
+	rec := ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Template: "deploy", Vars: map[string]interface{}{"app": "shop"}})
+	expectStatus(t, rec, http.StatusOK)
+	if !strings.HasSuffix(ts.messenger.sent[0].text, "shop deployed") {
+		t.Fatalf("template not rendered: %q", ts.messenger.sent[0].text)
+	}
+
+	rec = ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Template: "deploy", Text: "both"})
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	rec = ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Template: "missing"})
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+func TestNotifyRateLimited(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addChannel("alerts", 10)
+	token, secret := ts.newNotifierToken(1, "alerts")
+	token.RateLimit = 1
+	ts.limiter.tokenWait = 10 * time.Second
+
+	rec := ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Text: "hi"})
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	if rec.Header().Get("Retry-After") != "10" {
+		t.Fatalf("unexpected Retry-After: %q", rec.Header().Get("Retry-After"))
+	}
+	if len(ts.messenger.sent) != 0 {
+		t.Fatal("message sent over the rate limit")
+	}
+}
+
+func TestNotifyQuotaExceeded(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addChannel("alerts", 10)
+	token, secret := ts.newNotifierToken(1, "alerts")
+	token.DailyQuota = 1
+	creator := int64(99)
+	token.CreatorID = &creator
+
+	rec := ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Text: "first"})
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Text: "second"})
+	expectStatus(t, rec, http.StatusTooManyRequests)
+
+	// the first message went to the subscriber, the alert to the creator of the token
+	if len(ts.messenger.sent) != 2 || ts.messenger.sent[1].chatId != creator {
+		t.Fatalf("unexpected messages: %+v", ts.messenger.sent)
+	}
+	if ts.limiter.usedToday != 1 {
+		t.Fatalf("rejected message counted towards the quota: %d", ts.limiter.usedToday)
+	}
+}
+
+func TestNotifyRejectedLimitsRefunded(t *testing.T) {
+	ts := newTestServer(t)
+	channel := ts.store.addChannel("alerts", 10)
+	channel.RateLimit = 1
+	token, secret := ts.newNotifierToken(1, "alerts")
+	token.RateLimit = 1
+	token.DailyQuota = 1
+	ts.limiter.channelWait = 10 * time.Second
+
+	rec := ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Text: "hi"})
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	if ts.limiter.tokenTaken != 0 {
+		t.Fatal("token rate limit used by a message rejected by the channel limit")
+	}
+
+	ts.limiter.channelWait = 0
+	ts.limiter.usedToday = 1
+	rec = ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Text: "hi"})
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	if ts.limiter.tokenTaken != 0 || ts.limiter.channelTaken != 0 || ts.limiter.usedToday != 1 {
+		t.Fatalf("limits used by a message over the quota: %+v", ts.limiter)
+	}
+}
+
+func TestScheduleNotify(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addChannel("alerts", 10)
+	_, secret := ts.newNotifierToken(1, "alerts")
+
+	rec := ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Text: "later", Delay: 60})
+	expectStatus(t, rec, http.StatusAccepted)
+
+	if len(ts.store.scheduled) != 1 || ts.store.scheduled[0].Text != "later" {
+		t.Fatalf("notification not scheduled: %+v", ts.store.scheduled)
+	}
+	if len(ts.messenger.sent) != 0 {
+		t.Fatal("scheduled notification sent right away")
+	}
+
+	past := time.Now().Add(-time.Minute)
+	rec = ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Text: "past", SendAt: &past})
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	// would overflow time.Duration
+	rec = ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Text: "never", Delay: 1 << 40})
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	farAway := time.Now().Add(maxSchedulingHorizon + time.Hour)
+	rec = ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Text: "never", SendAt: &farAway})
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	if len(ts.store.scheduled) != 1 {
+		t.Fatalf("unexpected scheduled notifications: %+v", ts.store.scheduled)
+	}
+}
+
+func TestEditAndDeleteNotify(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addChannel("alerts", 10, 11)
+	_, secret := ts.newNotifierToken(1, "alerts")
+	_, otherSecret := ts.newNotifierToken(2, "alerts")
+
+	rec := ts.do(t, http.MethodPost, "/notify", secret, NotifyRequest{Channel: "alerts", Text: "hi"})
+	expectStatus(t, rec, http.StatusOK)
+	var resp NotifyResponse
+	decode(t, rec, &resp)
+
+	// notifications of other tokens are not visible
+	rec = ts.do(t, http.MethodPatch, "/notify/"+resp.ID, otherSecret, NotifyEditRequest{Text: "hijacked"})
+	expectStatus(t, rec, http.StatusNotFound)
+	rec = ts.do(t, http.MethodDelete, "/notify/"+resp.ID, otherSecret, nil)
+	expectStatus(t, rec, http.StatusNotFound)
+
+	rec = ts.do(t, http.MethodPatch, "/notify/"+resp.ID, secret, NotifyEditRequest{Text: "hello"})
+	expectStatus(t, rec, http.StatusOK)
+	if len(ts.messenger.edited) != 2 {
+		t.Fatalf("expected 2 edited messages, got %d", len(ts.messenger.edited))
+	}
+
+	rec = ts.do(t, http.MethodDelete, "/notify/"+resp.ID, secret, nil)
+	expectStatus(t, rec, http.StatusNoContent)
+	if len(ts.messenger.deleted) != 2 {
+		t.Fatalf("expected 2 deleted messages, got %d", len(ts.messenger.deleted))
+	}
+
+	rec = ts.do(t, http.MethodDelete, "/notify/"+resp.ID, secret, nil)
+	expectStatus(t, rec, http.StatusNotFound)
+}
+
+func TestNewQuestion(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addChannel("alerts", 10)
+	ts.store.addChannel("empty")
+	token, secret := ts.newNotifierToken(1, "*")
+
+	req := QuestionRequest{Channel: "alerts", Text: "deploy?", Options: []QuestionOption{{Data: "y", Label: "Yes"}, {Data: "n"}}}
+	rec := ts.do(t, http.MethodPost, "/question", secret, req)
+	expectStatus(t, rec, http.StatusCreated)
+
+	var resp QuestionResponse
+	decode(t, rec, &resp)
+	if resp.ID != "q1" || resp.Answer != nil {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if usage := ts.store.tokenUsage(token.ID); usage.Questions != 1 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+
+	for name, req := range map[string]QuestionRequest{
+		"no options":     {Channel: "alerts", Text: "deploy?"},
+		"long data":      {Channel: "alerts", Text: "deploy?", Options: []QuestionOption{{Data: "thisistoolongfordata"}}},
+		"no subscribers": {Channel: "empty", Text: "deploy?", Options: []QuestionOption{{Data: "y"}}},
+	} {
+		rec = ts.do(t, http.MethodPost, "/question", secret, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", name, rec.Code)
+		}
+	}
+}
+
+func TestNewQuestionClientGone(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.addChannel("alerts", 10)
+	_, secret := ts.newNotifierToken(1, "*")
+
+	// the question must be delivered and recorded even if the client disconnects in the meantime
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := QuestionRequest{Channel: "alerts", Text: "deploy?", Options: []QuestionOption{{Data: "y"}}}
+	rec := ts.doWithContext(t, ctx, http.MethodPost, "/question", secret, req)
+	expectStatus(t, rec, http.StatusCreated)
+	if ts.messenger.sendCtxErr != nil {
+		t.Fatalf("delivery cancelled with the request: %s", ts.messenger.sendCtxErr)
+	}
+}
+
+func TestQuestionAnswer(t *testing.T) {
+	ts := newTestServer(t)
+	active := true
+	ts.store.users[10] = &db.User{ID: 10, FirstName: "Marcell", Active: &active}
+	_, secret := ts.newNotifierToken(1, "alerts")
+	_, otherSecret := ts.newNotifierToken(2, "alerts")
+
+	ts.questions.questions["q1"] = memdb.QuestionData{SourceTokenID: 1, Ready: true}
+
+	rec := ts.do(t, http.MethodGet, "/question/q1", secret, nil)
+	expectStatus(t, rec, http.StatusOK)
+	var resp QuestionResponse
+	decode(t, rec, &resp)
+	if resp.Answer != nil {
+		t.Fatalf("unanswered question has an answer: %+v", resp.Answer)
+	}
+
+	rec = ts.do(t, http.MethodGet, "/question/q1", otherSecret, nil)
+	expectStatus(t, rec, http.StatusNotFound)
+	rec = ts.do(t, http.MethodGet, "/question/q2", secret, nil)
+	expectStatus(t, rec, http.StatusNotFound)
+
+	answerer := int64(10)
+	data := "y"
+	now := time.Now()
+	ts.questions.questions["q1"] = memdb.QuestionData{SourceTokenID: 1, Ready: true, AnswererID: &answerer, AnswerData: &data, AnsweredAt: &now}
+
+	rec = ts.do(t, http.MethodGet, "/question/q1", secret, nil)
+	expectStatus(t, rec, http.StatusOK)
+	decode(t, rec, &resp)
+	if resp.Answer == nil || resp.Answer.Data != "y" || resp.Answer.AnsweredBy.ID != 10 {
+		t.Fatalf("unexpected answer: %+v", resp.Answer)
+	}
+}
+
+func TestQuestionAnswerReadHistory(t *testing.T) {
+	ts := newTestServer(t)
+	reader := &db.Token{Name: "dashboard", Grants: []db.TokenGrant{{ChannelPattern: "alerts", Capabilities: "read-history"}}}
+	reader.ID = 2
+	secret := ts.store.addToken(reader)
+
+	ts.questions.questions["q1"] = memdb.QuestionData{SourceTokenID: 1, ChannelName: "alerts", Ready: true}
+	ts.questions.questions["q2"] = memdb.QuestionData{SourceTokenID: 1, ChannelName: "deploys", Ready: true}
+	ts.questions.questions["q3"] = memdb.QuestionData{SourceTokenID: 1, Ready: true} // created before the channel was stored
+
+	rec := ts.do(t, http.MethodGet, "/question/q1", secret, nil)
+	expectStatus(t, rec, http.StatusOK)
+	rec = ts.do(t, http.MethodGet, "/question/q2", secret, nil)
+	expectStatus(t, rec, http.StatusNotFound)
+	rec = ts.do(t, http.MethodGet, "/question/q3", secret, nil)
+	expectStatus(t, rec, http.StatusNotFound)
+
+	// reading history does not allow asking
+	rec = ts.do(t, http.MethodPost, "/question", secret, map[string]interface{}{"channel": "alerts", "text": "Deploy?", "options": []map[string]string{{"data": "y"}}})
+	expectStatus(t, rec, http.StatusForbidden)
+}
+
+func TestQuestionAnswerPolling(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.users[10] = &db.User{ID: 10, FirstName: "Marcell"}
+	_, secret := ts.newNotifierToken(1, "alerts")
+
+	ts.questions.questions["q1"] = memdb.QuestionData{SourceTokenID: 1, Ready: true}
+
+	// no answer within the poll timeout
+	rec := ts.do(t, http.MethodGet, "/question/q1/poll", secret, nil)
+	expectStatus(t, rec, http.StatusNoContent)
+
+	answerer := int64(10)
+	data := "n"
+	now := time.Now()
+	ts.questions.answers <- memdb.QuestionData{SourceTokenID: 1, Ready: true, AnswererID: &answerer, AnswerData: &data, AnsweredAt: &now}
+
+	rec = ts.do(t, http.MethodGet, "/question/q1/poll", secret, nil)
+	expectStatus(t, rec, http.StatusOK)
+	var resp QuestionResponse
+	decode(t, rec, &resp)
+	if resp.Answer == nil || resp.Answer.Data != "n" {
+		t.Fatalf("unexpected answer: %+v", resp.Answer)
+	}
+}
+
+func TestAdminRequiresCapability(t *testing.T) {
+	ts := newTestServer(t)
+	_, secret := ts.newNotifierToken(1, "*")
+
+	rec := ts.do(t, http.MethodGet, "/admin/channels", secret, nil)
+	expectStatus(t, rec, http.StatusForbidden)
+}
+
+func TestAdminChannelValidation(t *testing.T) {
+	ts := newTestServer(t)
+	token, secret := ts.newNotifierToken(1, "*")
+	token.GlobalCapabilities = "admin"
+
+	for _, body := range []map[string]interface{}{
+		{"default_priority": "urgent"},
+		{"default_priority": ""},
+		{"description": strings.Repeat("a", 257)},
+		{"icon": strings.Repeat("a", 17)},
+		{"icon": "a"},
+		{"icon": "🔥🔥"},
+		{"owner_contact": strings.Repeat("a", 129)},
+	} {
+		// the fake store panics if the channel is written
+		rec := ts.do(t, http.MethodPatch, "/admin/channels/deploys", secret, body)
+		expectStatus(t, rec, http.StatusBadRequest)
+
+		body["name"] = "deploys"
+		rec = ts.do(t, http.MethodPost, "/admin/channels", secret, body)
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+}
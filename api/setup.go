@@ -1,11 +1,111 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"github.com/gin-gonic/gin"
-	"gitlab.com/MikeTTh/env"
+	"github.com/marcsello/marcsellocorp-bot/config"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/manifest"
+	"github.com/marcsello/marcsellocorp-bot/memdb"
+	"github.com/marcsello/marcsellocorp-bot/metrics"
+	"github.com/marcsello/marcsellocorp-bot/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"net/http"
+	"sync"
+	"time"
 )
 
-func InitApi(debug bool) (func(), error) {
+// Store is the persistent storage used by the API, implemented by db.Store
+type Store interface {
+	manifest.Store
+
+	GetAllChannels() ([]db.Channel, error)
+	RenameChannel(actor db.Actor, oldName, newName string) error
+	SetChannelLimits(actor db.Actor, name string, rateLimit, rateBurst int) error
+	RestoreChannelByName(actor db.Actor, name string) error
+	PurgeChannelByName(actor db.Actor, name string) error
+
+	LookupTokenByHash(ctx context.Context, tokenHashBytes []byte) (*db.Token, error)
+	LookupTokenByName(ctx context.Context, name string) (*db.Token, error)
+	GetTokenByName(name string) (*db.Token, error)
+	RotateToken(actor db.Actor, name string, newTokenHash []byte, newHmacSecret string, grace time.Duration, updateExpiry bool, expiresAt *time.Time) (bool, error)
+	TouchToken(tokenId uint, sourceIP string)
+	QueueTokenUsage(tokenId uint, at time.Time, delta db.TokenUsage)
+	GetTokenUsage(tokenId uint, since time.Time) ([]db.TokenUsage, error)
+
+	CreateScheduledNotification(scheduled *db.ScheduledNotification) (*db.ScheduledNotification, error)
+	GetScheduledNotificationsByToken(tokenId uint) ([]db.ScheduledNotification, error)
+	DeleteScheduledNotification(tokenId uint, id uint) error
+	GetTemplateByName(name string) (*db.Template, error)
+
+	Ping(ctx context.Context) error
+}
+
+// QuestionStore keeps the state of questions and sent notifications, implemented by memdb.Client
+type QuestionStore interface {
+	StoreNotification(ctx context.Context, data memdb.NotificationData) (string, error)
+	GetNotificationData(ctx context.Context, randomId string) (*memdb.NotificationData, error)
+	DeleteNotification(ctx context.Context, randomId string) error
+	GetQuestionData(ctx context.Context, randomId string) (*memdb.QuestionData, error)
+	WaitForAnswer(ctx context.Context, randomId string) (*memdb.QuestionData, error)
+	Ping(ctx context.Context) error
+}
+
+// Limiter enforces rate limits and quotas, and rejects reused nonces, implemented by memdb.Client
+type Limiter interface {
+	TakeTokenRateLimit(ctx context.Context, tokenId uint, perMinute, burst int) (time.Duration, error)
+	TakeChannelRateLimit(ctx context.Context, channelId uint, perMinute, burst int) (time.Duration, error)
+	RefundTokenRateLimit(ctx context.Context, tokenId uint, burst int) error
+	RefundChannelRateLimit(ctx context.Context, channelId uint, burst int) error
+	CountDailyUsage(ctx context.Context, tokenId uint, day string) (int64, error)
+	RefundDailyUsage(ctx context.Context, tokenId uint, day string) error
+	MarkQuotaAlertSent(ctx context.Context, tokenId uint, day string) (bool, error)
+	UseNonce(ctx context.Context, tokenId uint, nonce string, ttl time.Duration) (bool, error)
+}
+
+// Messenger delivers the messages to the subscribers, implemented by telegram.Bot
+type Messenger interface {
+	SendToSubscribers(ctx context.Context, channel *db.Channel, msg string, opts ...interface{}) ([]memdb.StoredMessage, error)
+	SendQuestion(ctx context.Context, sourceTokenId uint, channel *db.Channel, msg string, options []memdb.QuestionOption) (string, error)
+	SendToUser(ctx context.Context, userId int64, msg string) error
+	EditMessages(ctx context.Context, messages []memdb.StoredMessage, msg string) error
+	DeleteMessages(ctx context.Context, messages []memdb.StoredMessage) error
+	Ping(ctx context.Context) error
+}
+
+// Server is the HTTP API of the bot
+type Server struct {
+	store     Store
+	questions QuestionStore
+	limiter   Limiter
+	messenger Messenger
+
+	rotationGrace time.Duration // the previous secret of a rotated token remains valid for this long
+	pollTimeout   time.Duration // long-polls for answers return empty after this long
+
+	shuttingDown chan struct{} // closed when the API is shutting down
+
+	readinessMutex  sync.Mutex
+	readinessResult *ReadinessRepr
+
+	router          *gin.Engine
+	srv             *http.Server
+	metricsSrv      *http.Server // nil if metrics are disabled
+	shutdownTimeout time.Duration
+}
+
+func NewServer(cfg config.API, tokens config.Tokens, store Store, questions QuestionStore, limiter Limiter, messenger Messenger, debug bool) (*Server, error) {
+	s := &Server{
+		store:           store,
+		questions:       questions,
+		limiter:         limiter,
+		messenger:       messenger,
+		rotationGrace:   tokens.RotationGrace.D(),
+		pollTimeout:     cfg.PollTimeout.D(),
+		shuttingDown:    make(chan struct{}),
+		shutdownTimeout: cfg.ShutdownTimeout.D(),
+	}
 
 	if debug {
 		gin.SetMode(gin.DebugMode)
@@ -14,19 +114,126 @@ func InitApi(debug bool) (func(), error) {
 	}
 
 	router := gin.New()
-	router.Use(requireValidTokenMiddleware)
+	router.ContextWithFallback = true // so the request ID reaches everything the gin context is passed to
+
+	// X-Forwarded-For is only trusted when coming from one of these, none by default
+	err := router.SetTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	s.router = router
+
+	// incoming traceparent headers are honored, so the spans of the API show up in the traces of the callers
+	router.Use(otelgin.Middleware(tracing.ServiceName, otelgin.WithFilter(isTracedRequest)))
+	router.Use(requestIdMiddleware, metricsMiddleware, accessLogMiddleware)
+
+	// probes and build info, these are unauthenticated
+	router.GET("/healthz", handleHealthz)
+	router.GET("/readyz", s.handleReadyz)
+	router.GET("/version", handleVersion)
+
+	authenticated := router.Group("/", s.requireValidTokenMiddleware, s.recordUsageMiddleware)
 	// this is RPC style instead of REST style
-	router.POST("/notify", handleNotify)
-	router.POST("/question", handleNewQuestion)
-	router.GET("/question/:id", handleQuestionAnswer)
-	router.GET("/question/:id/poll", handleQuestionAnswerPolling)
-
-	runFunc := func() {
-		err := router.Run(env.String("API_BIND", ":8081"))
-		if err != nil {
-			panic(err)
+	authenticated.POST("/notify", s.handleNotify)
+	authenticated.PATCH("/notify/:id", s.handleEditNotify)
+	authenticated.DELETE("/notify/:id", s.handleDeleteNotify)
+	authenticated.GET("/notify/scheduled", s.handleListScheduledNotify)
+	authenticated.DELETE("/notify/scheduled/:id", s.handleDeleteScheduledNotify)
+	authenticated.POST("/question", s.handleNewQuestion)
+	authenticated.GET("/question/:id", s.handleQuestionAnswer)
+	authenticated.GET("/question/:id/poll", s.handleQuestionAnswerPolling)
+
+	// admins may manage the subscribers of any channel
+	authenticated.GET("/channels/:name/subscribers", s.handleListSubscribers)
+	authenticated.PUT("/channels/:name/subscribers/:id", s.handleChangeSubscription(true))
+	authenticated.DELETE("/channels/:name/subscribers/:id", s.handleChangeSubscription(false))
+
+	admin := authenticated.Group("/admin")
+	admin.Use(requireGlobalCapability(db.CapAdmin))
+	admin.GET("/channels", s.handleAdminListChannels)
+	admin.POST("/channels", s.handleAdminCreateChannel)
+	admin.GET("/channels/:name", s.handleAdminGetChannel)
+	admin.PATCH("/channels/:name", s.handleAdminEditChannel)
+	admin.DELETE("/channels/:name", s.handleAdminDeleteChannel)
+	admin.POST("/channels/:name/rename", s.handleAdminRenameChannel)
+	admin.POST("/channels/:name/restore", s.handleAdminRestoreChannel)
+	admin.PUT("/channels/:name/limits", s.handleAdminSetChannelLimits)
+	admin.GET("/tokens", s.handleAdminListTokens)
+	admin.POST("/tokens", s.handleAdminCreateToken)
+	admin.GET("/tokens/:name", s.handleAdminGetToken)
+	admin.DELETE("/tokens/:name", s.handleAdminDeleteToken)
+	admin.POST("/tokens/:name/rotate", s.handleAdminRotateToken)
+	admin.PUT("/tokens/:name/grants/:pattern", s.handleAdminSetTokenGrant)
+	admin.DELETE("/tokens/:name/grants/:pattern", s.handleAdminRevokeTokenGrant)
+	admin.PUT("/tokens/:name/capabilities", s.handleAdminSetTokenCapabilities)
+	admin.PUT("/tokens/:name/auth", s.handleAdminSetTokenAuth)
+	admin.PUT("/tokens/:name/ips", s.handleAdminSetTokenIPs)
+	admin.PUT("/tokens/:name/limits", s.handleAdminSetTokenLimits)
+	admin.GET("/tokens/:name/stats", s.handleAdminGetTokenStats)
+	admin.GET("/manifest", s.handleAdminExportManifest)
+	admin.POST("/manifest", s.handleAdminImportManifest)
+	admin.GET("/users", s.handleAdminListUsers)
+	admin.GET("/users/:id", s.handleAdminGetUser)
+	admin.PUT("/users/:id", s.handleAdminPutUser)
+	admin.DELETE("/users/:id", s.handleAdminDeleteUser)
+
+	s.srv = &http.Server{
+		Addr:    cfg.Bind,
+		Handler: router,
+	}
+
+	// the metrics reveal token names and traffic, so they are not served on the public API address
+	if cfg.MetricsBind != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metrics.Handler())
+		s.metricsSrv = &http.Server{
+			Addr:    cfg.MetricsBind,
+			Handler: metricsMux,
+		}
+	}
+
+	return s, nil
+}
+
+// Handler returns the router of the API, so it can be served by httptest as well
+func (s *Server) Handler() http.Handler {
+	return s.router
+}
+
+// Run serves the API until the context is cancelled, then waits for the in-flight requests to finish
+func (s *Server) Run(ctx context.Context) {
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+
+		close(s.shuttingDown) // long-polls would hold up the shutdown
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+		defer cancel()
+		shutdownErr := s.srv.Shutdown(shutdownCtx)
+		if shutdownErr != nil {
+			logger.Error("Failed to shut down gracefully", "error", shutdownErr)
+		}
+		if s.metricsSrv != nil {
+			shutdownErr = s.metricsSrv.Shutdown(shutdownCtx)
+			if shutdownErr != nil {
+				logger.Error("Failed to shut down the metrics server gracefully", "error", shutdownErr)
+			}
 		}
+	}()
+
+	if s.metricsSrv != nil {
+		go func() {
+			err := s.metricsSrv.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				panic(err)
+			}
+		}()
 	}
 
-	return runFunc, nil
+	err := s.srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		panic(err)
+	}
+	<-shutdownDone
 }
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	hmacAuthType      = "HMAC-SHA256"
+	maxTimestampSkew  = 5 * time.Minute
+	nonceTTL          = 2 * maxTimestampSkew // older requests are rejected by their timestamp anyway
+	maxSignedBodySize = 1 << 20
+)
+
+var nonceRe = regexp.MustCompile(`^[A-Za-z0-9_-]{16,64}$`)
+
+// unknownTokenHmacSecret is used to verify requests of tokens that can not sign requests, its value does not matter
+const unknownTokenHmacSecret = "unknown-token"
+
+type signedRequestAuth struct {
+	tokenName string
+	timestamp time.Time
+	nonce     string
+	signature []byte
+}
+
+// parseSignedRequestAuth parses the credentials of the HMAC-SHA256 auth scheme: <token name>:<unix timestamp>:<nonce>:<hex signature>
+func parseSignedRequestAuth(credentials string) (signedRequestAuth, error) {
+	parts := strings.Split(credentials, ":")
+	if len(parts) != 4 {
+		return signedRequestAuth{}, errors.New("malformed credentials")
+	}
+
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return signedRequestAuth{}, errors.New("malformed timestamp")
+	}
+
+	if !nonceRe.MatchString(parts[2]) {
+		return signedRequestAuth{}, errors.New("malformed nonce")
+	}
+
+	var signature []byte
+	signature, err = hex.DecodeString(parts[3])
+	if err != nil {
+		return signedRequestAuth{}, errors.New("malformed signature")
+	}
+
+	return signedRequestAuth{
+		tokenName: parts[0],
+		timestamp: time.Unix(ts, 0),
+		nonce:     parts[2],
+		signature: signature,
+	}, nil
+}
+
+// computeRequestSignature signs the method, path (with query), timestamp, nonce and the hash of the body, separated by newlines
+func computeRequestSignature(secret string, method, requestUri string, timestamp int64, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	stringToSign := strings.Join([]string{
+		method,
+		requestUri,
+		strconv.FormatInt(timestamp, 10),
+		nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stringToSign))
+	return mac.Sum(nil)
+}
+
+// verifySignedRequest authenticates a signed request, the body is read and restored for later handlers.
+// Returns the token if the request is valid, or aborts the request otherwise.
+func (s *Server) verifySignedRequest(ctx *gin.Context, credentials string) (*db.Token, bool) {
+	auth, err := parseSignedRequestAuth(credentials)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"reason": err.Error()})
+		return nil, false
+	}
+
+	skew := time.Since(auth.timestamp)
+	if skew > maxTimestampSkew || skew < -maxTimestampSkew {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"reason": "timestamp out of range"})
+		return nil, false
+	}
+
+	var body []byte
+	body, err = io.ReadAll(io.LimitReader(ctx.Request.Body, maxSignedBodySize+1))
+	if err != nil {
+		handleUserError(ctx, err)
+		return nil, false
+	}
+	if len(body) > maxSignedBodySize {
+		ctx.AbortWithStatus(http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	var token *db.Token
+	token, err = s.store.LookupTokenByName(ctx, auth.tokenName)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		handleInternalError(ctx, err)
+		return nil, false
+	}
+
+	// unknown tokens and tokens not using signed requests are rejected the same way as invalid signatures,
+	// and the signature is computed for them too, so token names and their auth schemes can not be probed
+	secret, previousSecret := unknownTokenHmacSecret, unknownTokenHmacSecret
+	signingEnabled := err == nil && token.AuthScheme == db.AuthSchemeHmac && token.HmacSecret != ""
+	previousValid := false
+	if signingEnabled {
+		secret = token.HmacSecret
+		// the secret replaced by a rotation stays valid for the same grace period as the previous token
+		previousValid = token.PreviousHmacSecret != "" && token.PreviousTokenHashExpiresAt != nil && time.Now().Before(*token.PreviousTokenHashExpiresAt)
+		if previousValid {
+			previousSecret = token.PreviousHmacSecret
+		}
+	}
+	expected := computeRequestSignature(secret, ctx.Request.Method, ctx.Request.URL.RequestURI(), auth.timestamp.Unix(), auth.nonce, body)
+	expectedPrevious := computeRequestSignature(previousSecret, ctx.Request.Method, ctx.Request.URL.RequestURI(), auth.timestamp.Unix(), auth.nonce, body)
+	valid := hmac.Equal(expected, auth.signature)
+	validPrevious := hmac.Equal(expectedPrevious, auth.signature) && previousValid
+	if !(valid || validPrevious) || !signingEnabled {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"reason": "invalid credentials"})
+		return nil, false
+	}
+
+	// only valid requests may use up nonces
+	var fresh bool
+	fresh, err = s.limiter.UseNonce(ctx, token.ID, auth.nonce, nonceTTL)
+	if err != nil {
+		handleInternalError(ctx, err)
+		return nil, false
+	}
+	if !fresh {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"reason": "nonce already used"})
+		return nil, false
+	}
+
+	return token, true
+}
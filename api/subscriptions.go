@@ -0,0 +1,101 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"gorm.io/gorm"
+	"net/http"
+)
+
+// authorizeSubscriptionManagement loads the channel if the token may manage its subscribers, either by the
+// manage-subscribers capability on the channel, or by being an admin
+func (s *Server) authorizeSubscriptionManagement(ctx *gin.Context, token *db.Token) (*db.Channel, bool) {
+	chName := ctx.Param("name")
+	if !token.HasGlobalCapability(db.CapAdmin) {
+		return s.authorizeChannel(ctx, token, db.CapManageSubscribers, chName)
+	}
+
+	channel, err := s.store.GetChannelByName(ctx, chName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"reason": "channel not found or no permission"})
+			return nil, false
+		}
+		handleInternalError(ctx, err)
+		return nil, false
+	}
+	return channel, true
+}
+
+func (s *Server) handleListSubscribers(ctx *gin.Context) {
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		handleInternalError(ctx, fmt.Errorf("invalid token"))
+		return
+	}
+
+	channel, ok := s.authorizeSubscriptionManagement(ctx, token)
+	if !ok {
+		return
+	}
+
+	resp := make([]UserRepr, len(channel.Subscribers))
+	for i, u := range channel.Subscribers {
+		resp[i] = UserToUserRepr(*u)
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) handleChangeSubscription(subscribed bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token := getTokenFromContext(ctx)
+		if token == nil {
+			handleInternalError(ctx, fmt.Errorf("invalid token"))
+			return
+		}
+
+		channel, ok := s.authorizeSubscriptionManagement(ctx, token)
+		if !ok {
+			return
+		}
+
+		userId, ok := getUserIdParam(ctx)
+		if !ok {
+			return
+		}
+
+		if subscribed {
+			// the bot only lets active users subscribe as well
+			user, err := s.store.GetUserById(ctx, userId)
+			if err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					ctx.JSON(http.StatusNotFound, gin.H{"reason": "user not found"})
+					return
+				}
+				handleInternalError(ctx, err)
+				return
+			}
+			if !user.IsActive() {
+				ctx.JSON(http.StatusConflict, gin.H{"reason": "user is not active"})
+				return
+			}
+		}
+
+		changed, err := s.store.ChangeSubscription(userId, channel.ID, subscribed)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				ctx.JSON(http.StatusNotFound, gin.H{"reason": "user not found"})
+				return
+			}
+			handleInternalError(ctx, err)
+			return
+		}
+
+		if changed {
+			logger.InfoContext(ctx, "Subscription changed", "token", token.Name, "channel", channel.Name, "user", userId, "subscribed", subscribed)
+		}
+		ctx.Status(http.StatusNoContent)
+	}
+}
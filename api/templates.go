@@ -0,0 +1,43 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/marcsello/marcsellocorp-bot/utils"
+	"gorm.io/gorm"
+)
+
+// resolveText returns the text to be sent, either the literal text or the rendered template.
+// The request is aborted with 400 if it can not be resolved.
+func (s *Server) resolveText(ctx *gin.Context, text, templateName string, vars map[string]interface{}) (string, bool) {
+	if templateName != "" {
+		if text != "" {
+			handleUserError(ctx, fmt.Errorf("only one of text and template may be set"))
+			return "", false
+		}
+
+		template, err := s.store.GetTemplateByName(templateName)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				handleUserError(ctx, fmt.Errorf("template not found"))
+				return "", false
+			}
+			handleInternalError(ctx, err)
+			return "", false
+		}
+
+		text, err = utils.RenderTemplate(template.Body, vars)
+		if err != nil {
+			handleUserError(ctx, fmt.Errorf("failed to render template: %w", err))
+			return "", false
+		}
+	}
+
+	if text == "" {
+		handleUserError(ctx, fmt.Errorf("text may not be empty"))
+		return "", false
+	}
+
+	return text, true
+}
@@ -0,0 +1,13 @@
+package api
+
+import "net/http"
+
+// isTracedRequest leaves the probes and metrics scrapes out of the traces, they would be just noise
+func isTracedRequest(req *http.Request) bool {
+	switch req.URL.Path {
+	case "/healthz", "/readyz", "/metrics":
+		return false
+	default:
+		return true
+	}
+}
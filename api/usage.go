@@ -0,0 +1,43 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"net/http"
+	"time"
+)
+
+const usageKey = "usage"
+
+// addUsage accounts extra usage to the current request, it is recorded by recordUsageMiddleware once the request is done
+func addUsage(ctx *gin.Context, delta db.TokenUsage) {
+	if uInt, ok := ctx.Get(usageKey); ok {
+		if u, ok := uInt.(*db.TokenUsage); ok {
+			u.Add(delta)
+			return
+		}
+	}
+	ctx.Set(usageKey, &delta)
+}
+
+// recordUsageMiddleware counts the request to the usage statistics of the token, must be used after requireValidTokenMiddleware
+func (s *Server) recordUsageMiddleware(ctx *gin.Context) {
+	ctx.Next()
+
+	token := getTokenFromContext(ctx)
+	if token == nil {
+		return
+	}
+
+	usage := db.TokenUsage{Requests: 1}
+	if uInt, ok := ctx.Get(usageKey); ok {
+		if u, ok := uInt.(*db.TokenUsage); ok {
+			usage.Add(*u)
+		}
+	}
+	if ctx.Writer.Status() >= http.StatusBadRequest {
+		usage.Errors++
+	}
+
+	s.store.QueueTokenUsage(token.ID, time.Now(), usage)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/marcsello/marcsellocorp-bot/config"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/manifest"
+	"github.com/marcsello/marcsellocorp-bot/memdb"
+	"io"
+	"log/slog"
+	"os"
+)
+
+const cliUsage = `Usage:
+  %[1]s                                       run the bot
+  %[1]s export [-format yaml|json] [-o file]  export channels, users, subscriptions and tokens
+  %[1]s import [-dry-run] [-prune] <file|->   import a manifest, created token secrets are printed
+`
+
+// runCommand runs a subcommand of the binary instead of the bot
+func runCommand(cfg *config.Config, args []string) error {
+	switch args[0] {
+	case "export":
+		return cmdExport(cfg, args[1:])
+	case "import":
+		return cmdImport(cfg, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, cliUsage, os.Args[0])
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+// connectForCommand connects to the databases, tokens changed by commands must be invalidated in the running instances as well
+func connectForCommand(cfg *config.Config) (*db.Store, *memdb.Client, error) {
+	store, err := db.Connect(cfg.Database)
+	if err != nil {
+		return nil, nil, err
+	}
+	mem, err := memdb.Connect(cfg.Redis)
+	if err != nil {
+		_ = store.Close()
+		return nil, nil, err
+	}
+	store.SetTokensChangedHook(func() {
+		pubErr := mem.PublishTokenInvalidation(context.Background())
+		if pubErr != nil {
+			slog.Error("Failed to publish token invalidation", "error", pubErr)
+		}
+	})
+	return store, mem, nil
+}
+
+func closeAfterCommand(store *db.Store, mem *memdb.Client) {
+	err := store.Close()
+	if err != nil {
+		slog.Error("Failed to close DB", "error", err)
+	}
+	err = mem.Close()
+	if err != nil {
+		slog.Error("Failed to close Redis", "error", err)
+	}
+}
+
+func cmdExport(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", manifest.FormatYAML, "output format, yaml or json")
+	output := flags.String("o", "-", "output file, - for stdout")
+	_ = flags.Parse(args)
+
+	store, mem, err := connectForCommand(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeAfterCommand(store, mem)
+
+	m, err := manifest.Export(store)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	data, err = manifest.Encode(m, *format)
+	if err != nil {
+		return err
+	}
+
+	if *output == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*output, data, 0600)
+}
+
+func cmdImport(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only print the changes")
+	prune := flags.Bool("prune", false, "remove everything not in the manifest, channels are archived")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, cliUsage, os.Args[0])
+		return fmt.Errorf("manifest file required")
+	}
+
+	var data []byte
+	var err error
+	if flags.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+
+	m, err := manifest.Parse(data)
+	if err != nil {
+		return err
+	}
+
+	store, mem, err := connectForCommand(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeAfterCommand(store, mem)
+
+	result, err := manifest.Import(store, m, db.Actor{}, manifest.Options{DryRun: *dryRun, Prune: *prune})
+	if result != nil {
+		for i, change := range result.Changes {
+			status := "pending"
+			if !result.DryRun {
+				status = "applied"
+				if i == result.Applied && err != nil {
+					status = "failed"
+				} else if i >= result.Applied {
+					status = "skipped"
+				}
+			}
+			fmt.Printf("[%s] %s\n", status, change)
+		}
+		if len(result.Changes) == 0 {
+			fmt.Println("Nothing to change")
+		}
+		for name, secret := range result.Secrets {
+			fmt.Printf("Secret of token %s: %s\n", name, secret)
+		}
+	}
+	return err
+}
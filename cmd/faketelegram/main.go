@@ -0,0 +1,26 @@
+// Command faketelegram runs a fake Telegram Bot API server, so the bot can be run locally without a real bot token.
+//
+// Point the bot to it with TELEGRAM_API_URL=http://localhost:8090 and TELEGRAM_UPDATES_MODE=polling, then act as a
+// user through the /fake/ endpoints, see the telegramtest package for details.
+package main
+
+import (
+	"flag"
+	"github.com/marcsello/marcsellocorp-bot/telegram/telegramtest"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+func main() {
+	listen := flag.String("listen", "localhost:8090", "address to listen on")
+	token := flag.String("token", "", "bot token to accept, any token is accepted when empty")
+	flag.Parse()
+
+	slog.Info("Fake Telegram Bot API listening", "address", *listen)
+	err := http.ListenAndServe(*listen, telegramtest.NewServer(*token))
+	if err != nil {
+		slog.Error("Failed to serve", "error", err)
+		os.Exit(1)
+	}
+}
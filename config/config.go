@@ -0,0 +1,134 @@
+package config
+
+import (
+	"time"
+)
+
+// Telegram update modes
+const (
+	UpdatesModeWebhook = "webhook"
+	UpdatesModePolling = "polling"
+)
+
+// Trace exporters
+const (
+	TraceExporterNone    = "none"
+	TraceExporterOTLP    = "otlp" // configured by the standard OTEL_EXPORTER_OTLP_* environment variables
+	TraceExporterStdout  = "stdout"
+	TraceExporterConsole = "console" // the name used by the OpenTelemetry spec for the same
+)
+
+// Config holds every setting of the bot. It is loaded from an optional file, then overridden by environment variables.
+type Config struct {
+	Debug bool `yaml:"debug"`
+
+	Log       Log       `yaml:"log"`
+	Tracing   Tracing   `yaml:"tracing"`
+	Database  Database  `yaml:"database"`
+	Redis     Redis     `yaml:"redis"`
+	Telegram  Telegram  `yaml:"telegram"`
+	API       API       `yaml:"api"`
+	Tokens    Tokens    `yaml:"tokens"`
+	Scheduler Scheduler `yaml:"scheduler"`
+}
+
+type Log struct {
+	Format string `yaml:"format"` // text or json
+	Level  string `yaml:"level"`  // debug, info, warn or error, debug if empty and Debug is set, info otherwise
+}
+
+type Tracing struct {
+	Exporter string `yaml:"exporter"`
+}
+
+type Database struct {
+	URL                   string   `yaml:"url"`
+	MaxOpenConns          int      `yaml:"max_open_conns"`
+	MaxIdleConns          int      `yaml:"max_idle_conns"`
+	ConnMaxLifetime       Duration `yaml:"conn_max_lifetime"`
+	SlowQueryThreshold    Duration `yaml:"slow_query_threshold"`
+	ActivityFlushInterval Duration `yaml:"activity_flush_interval"` // token activity is written in batches this often
+}
+
+type Redis struct {
+	URL                    string   `yaml:"url"`
+	InflightQuestionExpire Duration `yaml:"inflight_question_expire"` // questions not delivered to everyone by this time disappear
+	AnsweredQuestionExpire Duration `yaml:"answered_question_expire"` // answered questions can be retrieved for this long
+}
+
+type Telegram struct {
+	Token           string   `yaml:"token"`
+	APIURL          string   `yaml:"api_url"` // the official Bot API is used when empty
+	UpdatesMode     string   `yaml:"updates_mode"`
+	PollingTimeout  Duration `yaml:"polling_timeout"`
+	ShutdownTimeout Duration `yaml:"shutdown_timeout"` // in-flight updates are given this long to be handled on shutdown
+	Webhook         Webhook  `yaml:"webhook"`
+}
+
+type Webhook struct {
+	PublicURL   string `yaml:"public_url"`
+	Bind        string `yaml:"bind"`
+	PublicCert  string `yaml:"public_cert"` // uploaded to Telegram, only needed for self-signed certificates
+	SecretToken string `yaml:"secret_token"`
+	TLSCert     string `yaml:"tls_cert"`
+	TLSKey      string `yaml:"tls_key"`
+}
+
+type API struct {
+	Bind            string   `yaml:"bind"`
+	MetricsBind     string   `yaml:"metrics_bind"`     // /metrics is served separately from the API, so it is not public, disabled when empty
+	TrustedProxies  []string `yaml:"trusted_proxies"`  // X-Forwarded-For is only trusted when coming from one of these
+	ShutdownTimeout Duration `yaml:"shutdown_timeout"` // in-flight requests are given this long to finish on shutdown
+	PollTimeout     Duration `yaml:"poll_timeout"`     // long-polls for answers return empty after this long
+}
+
+type Tokens struct {
+	RotationGrace Duration `yaml:"rotation_grace"` // the previous secret of a rotated token remains valid for this long
+}
+
+type Scheduler struct {
+	TickInterval Duration `yaml:"tick_interval"`
+}
+
+// Default returns the configuration used when nothing is set
+func Default() *Config {
+	return &Config{
+		Log: Log{
+			Format: "text",
+		},
+		Tracing: Tracing{
+			Exporter: TraceExporterNone,
+		},
+		Database: Database{
+			MaxOpenConns:          10,
+			MaxIdleConns:          5,
+			ConnMaxLifetime:       Duration(15 * time.Minute),
+			SlowQueryThreshold:    Duration(200 * time.Millisecond),
+			ActivityFlushInterval: Duration(5 * time.Second),
+		},
+		Redis: Redis{
+			URL:                    "redis://localhost:6379/0",
+			InflightQuestionExpire: Duration(300 * time.Second),
+			AnsweredQuestionExpire: Duration(2 * time.Hour),
+		},
+		Telegram: Telegram{
+			UpdatesMode:     UpdatesModeWebhook,
+			PollingTimeout:  Duration(30 * time.Second),
+			ShutdownTimeout: Duration(25 * time.Second),
+			Webhook: Webhook{
+				Bind: ":8080",
+			},
+		},
+		API: API{
+			Bind:            ":8081",
+			ShutdownTimeout: Duration(25 * time.Second),
+			PollTimeout:     Duration(120 * time.Second),
+		},
+		Tokens: Tokens{
+			RotationGrace: Duration(24 * time.Hour),
+		},
+		Scheduler: Scheduler{
+			TickInterval: Duration(10 * time.Second),
+		},
+	}
+}
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"github.com/marcsello/marcsellocorp-bot/utils"
+	"time"
+)
+
+// Duration is a time.Duration that can be written as "90s", "15m" or "7d" in the config file
+type Duration time.Duration
+
+func (d Duration) D() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := utils.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
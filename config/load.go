@@ -0,0 +1,162 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Load reads the config file (YAML or JSON) if path is not empty, then applies the environment variables on top of it.
+// The result is not validated.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true) // typos should not be silently ignored
+		err = decoder.Decode(cfg)
+		if err != nil && !errors.Is(err, io.EOF) { // an empty file is fine
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	err := applyEnv(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// envBinding connects a setting to the environment variable overriding it
+type envBinding struct {
+	field string // path in the config file
+	env   string
+	set   func(value string) error
+}
+
+func envBindings(cfg *Config) []envBinding {
+	return []envBinding{
+		{"debug", "DEBUG", boolVar(&cfg.Debug)},
+
+		{"log.format", "LOG_FORMAT", stringVar(&cfg.Log.Format)},
+		{"log.level", "LOG_LEVEL", stringVar(&cfg.Log.Level)},
+
+		{"tracing.exporter", "OTEL_TRACES_EXPORTER", stringVar(&cfg.Tracing.Exporter)},
+
+		{"database.url", "DATABASE_URL", stringVar(&cfg.Database.URL)},
+		{"database.max_open_conns", "DATABASE_MAX_OPEN_CONNS", intVar(&cfg.Database.MaxOpenConns)},
+		{"database.max_idle_conns", "DATABASE_MAX_IDLE_CONNS", intVar(&cfg.Database.MaxIdleConns)},
+		{"database.conn_max_lifetime", "DATABASE_CONN_MAX_LIFETIME", durationVar(&cfg.Database.ConnMaxLifetime)},
+		{"database.slow_query_threshold", "DATABASE_SLOW_QUERY_THRESHOLD", durationVar(&cfg.Database.SlowQueryThreshold)},
+		{"database.activity_flush_interval", "TOKEN_ACTIVITY_FLUSH_INTERVAL", durationVar(&cfg.Database.ActivityFlushInterval)},
+
+		{"redis.url", "REDIS_URL", stringVar(&cfg.Redis.URL)},
+		{"redis.inflight_question_expire", "QUESTION_INFLIGHT_EXPIRE", durationVar(&cfg.Redis.InflightQuestionExpire)},
+		{"redis.answered_question_expire", "QUESTION_ANSWERED_EXPIRE", durationVar(&cfg.Redis.AnsweredQuestionExpire)},
+
+		{"telegram.token", "TELEGRAM_TOKEN", stringVar(&cfg.Telegram.Token)},
+		{"telegram.api_url", "TELEGRAM_API_URL", stringVar(&cfg.Telegram.APIURL)},
+		{"telegram.updates_mode", "TELEGRAM_UPDATES_MODE", stringVar(&cfg.Telegram.UpdatesMode)},
+		{"telegram.polling_timeout", "TELEGRAM_POLLING_TIMEOUT", durationVar(&cfg.Telegram.PollingTimeout)},
+		{"telegram.shutdown_timeout", "TELEGRAM_SHUTDOWN_TIMEOUT", durationVar(&cfg.Telegram.ShutdownTimeout)},
+		{"telegram.webhook.public_url", "WEBHOOK_PUBLIC_URL", stringVar(&cfg.Telegram.Webhook.PublicURL)},
+		{"telegram.webhook.bind", "WEBHOOK_BIND", stringVar(&cfg.Telegram.Webhook.Bind)},
+		{"telegram.webhook.public_cert", "WEBHOOK_PUBLIC_CERT", stringVar(&cfg.Telegram.Webhook.PublicCert)},
+		{"telegram.webhook.secret_token", "WEBHOOK_SECRET_TOKEN", stringVar(&cfg.Telegram.Webhook.SecretToken)},
+		{"telegram.webhook.tls_cert", "WEBHOOK_TLS_CERT", stringVar(&cfg.Telegram.Webhook.TLSCert)},
+		{"telegram.webhook.tls_key", "WEBHOOK_TLS_KEY", stringVar(&cfg.Telegram.Webhook.TLSKey)},
+
+		{"api.bind", "API_BIND", stringVar(&cfg.API.Bind)},
+		{"api.metrics_bind", "METRICS_BIND", stringVar(&cfg.API.MetricsBind)},
+		{"api.trusted_proxies", "TRUSTED_PROXIES", listVar(&cfg.API.TrustedProxies)},
+		{"api.shutdown_timeout", "API_SHUTDOWN_TIMEOUT", durationVar(&cfg.API.ShutdownTimeout)},
+		{"api.poll_timeout", "QUESTION_POLL_TIMEOUT", durationVar(&cfg.API.PollTimeout)},
+
+		{"tokens.rotation_grace", "TOKEN_ROTATION_GRACE", durationVar(&cfg.Tokens.RotationGrace)},
+
+		{"scheduler.tick_interval", "SCHEDULER_TICK_INTERVAL", durationVar(&cfg.Scheduler.TickInterval)},
+	}
+}
+
+// envNames maps the settings to their environment variables, so errors can mention both
+var envNames = func() map[string]string {
+	names := map[string]string{}
+	for _, b := range envBindings(&Config{}) {
+		names[b.field] = b.env
+	}
+	return names
+}()
+
+// applyEnv overrides the settings that have their environment variable set, every invalid value is reported
+func applyEnv(cfg *Config) error {
+	var errs []error
+	for _, b := range envBindings(cfg) {
+		value, ok := os.LookupEnv(b.env)
+		if !ok {
+			continue
+		}
+		err := b.set(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s=%q: %w", b.env, value, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func stringVar(target *string) func(string) error {
+	return func(value string) error {
+		*target = value
+		return nil
+	}
+}
+
+// listVar parses a comma separated list
+func listVar(target *[]string) func(string) error {
+	return func(value string) error {
+		*target = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*target = append(*target, item)
+			}
+		}
+		return nil
+	}
+}
+
+func boolVar(target *bool) func(string) error {
+	return func(value string) error {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		*target = parsed
+		return nil
+	}
+}
+
+func intVar(target *int) func(string) error {
+	return func(value string) error {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		*target = parsed
+		return nil
+	}
+}
+
+func durationVar(target *Duration) func(string) error {
+	return func(value string) error {
+		return target.UnmarshalText([]byte(value))
+	}
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// see https://core.telegram.org/bots/api#setwebhook
+var secretTokenRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+// validator collects every problem, so they can be fixed at once instead of one restart at a time
+type validator struct {
+	errs []error
+}
+
+func (v *validator) fail(field, format string, args ...interface{}) {
+	if env, ok := envNames[field]; ok {
+		field += " (" + env + ")"
+	}
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) required(field, value string) {
+	if value == "" {
+		v.fail(field, "must be set")
+	}
+}
+
+func (v *validator) positive(field string, value Duration) {
+	if value <= 0 {
+		v.fail(field, "must be positive")
+	}
+}
+
+func (v *validator) oneOf(field, value string, valid ...string) {
+	if !slices.Contains(valid, value) {
+		v.fail(field, "invalid value %q, must be one of %v", value, valid)
+	}
+}
+
+func (v *validator) url(field, value string, schemes ...string) {
+	if value == "" {
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || !slices.Contains(schemes, u.Scheme) {
+		v.fail(field, "must be a %v URL", schemes)
+	}
+}
+
+// Validate checks every setting needed to run the bot
+func (c *Config) Validate() error {
+	v := &validator{}
+	c.validateCommon(v)
+	c.validateTelegram(v)
+	c.validateAPI(v)
+	v.positive("tokens.rotation_grace", c.Tokens.RotationGrace)
+	v.positive("scheduler.tick_interval", c.Scheduler.TickInterval)
+	return errors.Join(v.errs...)
+}
+
+// ValidateStorage checks only the settings needed by the subcommands, which just access the databases
+func (c *Config) ValidateStorage() error {
+	v := &validator{}
+	c.validateCommon(v)
+	return errors.Join(v.errs...)
+}
+
+func (c *Config) validateCommon(v *validator) {
+	v.oneOf("log.format", c.Log.Format, "text", "json")
+	if c.Log.Level != "" {
+		var level slog.Level
+		if level.UnmarshalText([]byte(c.Log.Level)) != nil {
+			v.fail("log.level", "invalid value %q, must be one of [debug info warn error]", c.Log.Level)
+		}
+	}
+	v.oneOf("tracing.exporter", c.Tracing.Exporter, TraceExporterNone, TraceExporterOTLP, TraceExporterStdout, TraceExporterConsole)
+
+	v.required("database.url", c.Database.URL)
+	if c.Database.MaxOpenConns < 1 {
+		v.fail("database.max_open_conns", "must be at least 1")
+	}
+	if c.Database.MaxIdleConns < 0 || c.Database.MaxIdleConns > c.Database.MaxOpenConns {
+		v.fail("database.max_idle_conns", "must be between 0 and max_open_conns")
+	}
+	v.positive("database.conn_max_lifetime", c.Database.ConnMaxLifetime)
+	v.positive("database.slow_query_threshold", c.Database.SlowQueryThreshold)
+	v.positive("database.activity_flush_interval", c.Database.ActivityFlushInterval)
+
+	v.required("redis.url", c.Redis.URL)
+	v.url("redis.url", c.Redis.URL, "redis", "rediss", "unix")
+	v.positive("redis.inflight_question_expire", c.Redis.InflightQuestionExpire)
+	v.positive("redis.answered_question_expire", c.Redis.AnsweredQuestionExpire)
+}
+
+func (c *Config) validateTelegram(v *validator) {
+	v.required("telegram.token", c.Telegram.Token)
+	v.url("telegram.api_url", c.Telegram.APIURL, "http", "https")
+	v.oneOf("telegram.updates_mode", c.Telegram.UpdatesMode, UpdatesModeWebhook, UpdatesModePolling)
+	if c.Telegram.PollingTimeout < Duration(time.Second) {
+		v.fail("telegram.polling_timeout", "must be at least 1s") // Telegram accepts it in seconds
+	}
+	v.positive("telegram.shutdown_timeout", c.Telegram.ShutdownTimeout)
+
+	if c.Telegram.UpdatesMode != UpdatesModeWebhook {
+		return
+	}
+	webhook := c.Telegram.Webhook
+	if webhook.PublicURL == "" {
+		v.fail("telegram.webhook.public_url", "must be set in webhook mode")
+	}
+	v.url("telegram.webhook.public_url", webhook.PublicURL, "https")
+	v.required("telegram.webhook.bind", webhook.Bind)
+	if webhook.SecretToken != "" && !secretTokenRe.MatchString(webhook.SecretToken) {
+		v.fail("telegram.webhook.secret_token", "may only contain A-Z, a-z, 0-9, _ and - and must be at most 256 characters long")
+	}
+	if (webhook.TLSCert == "") != (webhook.TLSKey == "") {
+		v.fail("telegram.webhook.tls_cert", "must be set together with tls_key")
+	}
+}
+
+func (c *Config) validateAPI(v *validator) {
+	v.required("api.bind", c.API.Bind)
+	if c.API.MetricsBind != "" && c.API.MetricsBind == c.API.Bind {
+		v.fail("api.metrics_bind", "must differ from api.bind")
+	}
+	for _, proxy := range c.API.TrustedProxies {
+		_, prefixErr := netip.ParsePrefix(proxy)
+		_, addrErr := netip.ParseAddr(proxy)
+		if prefixErr != nil && addrErr != nil {
+			v.fail("api.trusted_proxies", "invalid address or CIDR %q", proxy)
+		}
+	}
+	v.positive("api.shutdown_timeout", c.API.ShutdownTimeout)
+	v.positive("api.poll_timeout", c.API.PollTimeout)
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+type tokenActivity struct {
+	lastUsed time.Time
+	sourceIP string
+}
+
+type usageKey struct {
+	tokenId uint
+	day     time.Time
+}
+
+// TouchToken records that the token was used just now from the source address, it is written to the database later
+func (s *Store) TouchToken(tokenId uint, sourceIP string) {
+	s.pendingActivityMutex.Lock()
+	s.pendingActivity[tokenId] = tokenActivity{lastUsed: time.Now(), sourceIP: sourceIP}
+	s.pendingActivityMutex.Unlock()
+}
+
+// QueueTokenUsage adds the counters to the usage of the token on the day of the given time, it is written to the database later
+func (s *Store) QueueTokenUsage(tokenId uint, at time.Time, delta TokenUsage) {
+	key := usageKey{tokenId: tokenId, day: UsageDay(at)}
+
+	s.pendingActivityMutex.Lock()
+	usage := s.pendingUsage[key]
+	usage.Add(delta)
+	s.pendingUsage[key] = usage
+	s.pendingActivityMutex.Unlock()
+}
+
+// FlushTokenActivity writes the collected token activity and usage to the database.
+// Activity of tokens deleted in the meantime is dropped, if writing fails the batch is kept for the next flush.
+func (s *Store) FlushTokenActivity() error {
+	s.pendingActivityMutex.Lock()
+	activity := s.pendingActivity
+	usage := s.pendingUsage
+	s.pendingActivity = map[uint]tokenActivity{}
+	s.pendingUsage = map[usageKey]TokenUsage{}
+	s.pendingActivityMutex.Unlock()
+
+	if len(activity) == 0 && len(usage) == 0 {
+		return nil
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		for id, a := range activity {
+			result := tx.Model(&Token{}).Where("id = ?", id).Updates(map[string]interface{}{
+				"last_used":      a.lastUsed,
+				"last_source_ip": a.sourceIP,
+			})
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		if len(usage) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, 0, len(usage))
+		for key := range usage {
+			ids = append(ids, key.tokenId)
+		}
+		var existingIds []uint
+		result := tx.Model(&Token{}).Where("id IN ?", ids).Pluck("id", &existingIds)
+		if result.Error != nil {
+			return result.Error
+		}
+		existing := make(map[uint]bool, len(existingIds))
+		for _, id := range existingIds {
+			existing[id] = true
+		}
+
+		rows := make([]TokenUsage, 0, len(usage))
+		for key, u := range usage {
+			if !existing[key.tokenId] {
+				continue
+			}
+			u.TokenID = key.tokenId
+			u.Day = key.day
+			rows = append(rows, u)
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+
+		return tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "token_id"}, {Name: "day"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"requests":      gorm.Expr("token_usages.requests + excluded.requests"),
+				"notifications": gorm.Expr("token_usages.notifications + excluded.notifications"),
+				"questions":     gorm.Expr("token_usages.questions + excluded.questions"),
+				"errors":        gorm.Expr("token_usages.errors + excluded.errors"),
+			}),
+		}).Create(&rows).Error
+	})
+	if err != nil {
+		s.requeueTokenActivity(activity, usage)
+	}
+	return err
+}
+
+// requeueTokenActivity merges a batch that failed to be written back to the pending activity, so it is retried on the next flush
+func (s *Store) requeueTokenActivity(activity map[uint]tokenActivity, usage map[usageKey]TokenUsage) {
+	s.pendingActivityMutex.Lock()
+	defer s.pendingActivityMutex.Unlock()
+
+	for id, a := range activity {
+		if _, newer := s.pendingActivity[id]; !newer {
+			s.pendingActivity[id] = a
+		}
+	}
+	for key, u := range usage {
+		pending := s.pendingUsage[key]
+		pending.Add(u)
+		s.pendingUsage[key] = pending
+	}
+}
+
+// flushTokenActivityPeriodically writes the token activity in batches, so API requests don't have to write the database
+func (s *Store) flushTokenActivityPeriodically(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := s.FlushTokenActivity()
+			if err != nil {
+				logger.Error("Failed to flush token activity", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package db
+
+import "gorm.io/gorm"
+
+func writeAuditLog(tx *gorm.DB, actor Actor, action, subject, details string) error {
+	entry := AuditLogEntry{
+		ActorID:      actor.UserID,
+		ActorTokenID: actor.TokenID,
+		Action:       action,
+		Subject:      subject,
+		Details:      details,
+	}
+	return tx.Create(&entry).Error
+}
+
+// WriteAuditLog records an action in the audit log
+func (s *Store) WriteAuditLog(actor Actor, action, subject, details string) error {
+	return writeAuditLog(s.db, actor, action, subject, details)
+}
+
+func (s *Store) GetLatestAuditLogEntries(limit int) ([]AuditLogEntry, error) {
+	var entries []AuditLogEntry
+	result := s.db.Preload("Actor").Order("created_at DESC").Limit(limit).Find(&entries)
+	return entries, result.Error
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type Capability string
+
+// Capabilities granted on channels
+const (
+	CapNotify            Capability = "notify"
+	CapQuestion          Capability = "question"
+	CapReadHistory       Capability = "read-history" // read the answers of questions asked by other tokens
+	CapManageSubscribers Capability = "manage-subscribers"
+)
+
+// Capabilities not bound to channels
+const (
+	CapAdmin Capability = "admin"
+)
+
+var (
+	ChannelCapabilities = []Capability{CapNotify, CapQuestion, CapReadHistory, CapManageSubscribers}
+	GlobalCapabilities  = []Capability{CapAdmin}
+	AllCapabilities     = []Capability{CapNotify, CapQuestion, CapReadHistory, CapManageSubscribers, CapAdmin}
+)
+
+func SplitCapabilities(capabilities string) []Capability {
+	if capabilities == "" {
+		return nil
+	}
+	parts := strings.Split(capabilities, ",")
+	caps := make([]Capability, len(parts))
+	for i, part := range parts {
+		caps[i] = Capability(part)
+	}
+	return caps
+}
+
+func JoinCapabilities(caps []Capability) string {
+	parts := make([]string, len(caps))
+	for i, c := range caps {
+		parts[i] = string(c)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseCapabilities validates a list of capability names against the valid ones, duplicates are removed
+func ParseCapabilities(names []string, valid []Capability) ([]Capability, error) {
+	caps := make([]Capability, 0, len(names))
+	for _, name := range names {
+		c := Capability(name)
+		if !slices.Contains(valid, c) {
+			return nil, fmt.Errorf("unknown capability: %s", name)
+		}
+		if !slices.Contains(caps, c) {
+			caps = append(caps, c)
+		}
+	}
+	return caps, nil
+}
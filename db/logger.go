@@ -0,0 +1,62 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/marcsello/marcsellocorp-bot/logging"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+	"log/slog"
+	"time"
+)
+
+var logger = logging.Component("db")
+
+// slogLogger passes the logs of gorm to slog, queries are logged with the request ID of their context
+type slogLogger struct {
+	level         gormlogger.LogLevel
+	slowThreshold time.Duration
+}
+
+func (l slogLogger) LogMode(level gormlogger.LogLevel) gormlogger.Interface {
+	return slogLogger{level: level, slowThreshold: l.slowThreshold}
+}
+
+func (l slogLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Info {
+		logger.InfoContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l slogLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Warn {
+		logger.WarnContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l slogLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Error {
+		logger.ErrorContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l slogLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	if l.level <= gormlogger.Silent {
+		return
+	}
+
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && l.level >= gormlogger.Error:
+		// most of these are handled by the caller (e.g. unique violations), so they are not errors of the application
+		sql, rows := fc()
+		logger.WarnContext(ctx, "Query failed", "sql", sql, "rows", rows, "elapsed", elapsed, "error", err)
+	case elapsed > l.slowThreshold && l.level >= gormlogger.Warn:
+		sql, rows := fc()
+		logger.WarnContext(ctx, "Slow query", "sql", sql, "rows", rows, "elapsed", elapsed)
+	case logger.Enabled(ctx, slog.LevelDebug):
+		sql, rows := fc()
+		logger.DebugContext(ctx, "Query", "sql", sql, "rows", rows, "elapsed", elapsed)
+	}
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"github.com/marcsello/marcsellocorp-bot/metrics"
+	"gorm.io/gorm"
+	"time"
+)
+
+const metricsStartKey = "metrics:start"
+
+// metricsPlugin observes the latency of every query gorm issues
+type metricsPlugin struct{}
+
+func (metricsPlugin) Name() string {
+	return "metrics"
+}
+
+func (metricsPlugin) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+	for _, reg := range []struct {
+		operation string
+		before    func(name string, fn func(*gorm.DB)) error
+		after     func(name string, fn func(*gorm.DB)) error
+	}{
+		{"create", callbacks.Create().Before("gorm:create").Register, callbacks.Create().After("gorm:create").Register},
+		{"query", callbacks.Query().Before("gorm:query").Register, callbacks.Query().After("gorm:query").Register},
+		{"update", callbacks.Update().Before("gorm:update").Register, callbacks.Update().After("gorm:update").Register},
+		{"delete", callbacks.Delete().Before("gorm:delete").Register, callbacks.Delete().After("gorm:delete").Register},
+		{"row", callbacks.Row().Before("gorm:row").Register, callbacks.Row().After("gorm:row").Register},
+		{"raw", callbacks.Raw().Before("gorm:raw").Register, callbacks.Raw().After("gorm:raw").Register},
+	} {
+		err := reg.before("metrics:before_"+reg.operation, startQueryTimer)
+		if err != nil {
+			return err
+		}
+		err = reg.after("metrics:after_"+reg.operation, observeQuery(reg.operation))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startQueryTimer(tx *gorm.DB) {
+	tx.InstanceSet(metricsStartKey, time.Now())
+}
+
+func observeQuery(operation string) func(tx *gorm.DB) {
+	return func(tx *gorm.DB) {
+		startInt, ok := tx.InstanceGet(metricsStartKey)
+		if !ok {
+			return
+		}
+		start, ok := startInt.(time.Time)
+		if !ok {
+			return
+		}
+		metrics.PostgresQueryDuration.WithLabelValues(operation, metrics.SuccessLabel(tx.Error)).Observe(time.Since(start).Seconds())
+	}
+}
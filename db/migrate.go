@@ -0,0 +1,47 @@
+package db
+
+import "gorm.io/gorm"
+
+// migrateLegacyTokenCapabilities converts the old per-token capability flags and channel list to grants
+func (s *Store) migrateLegacyTokenCapabilities() error {
+	if !s.db.Migrator().HasColumn(&Token{}, "cap_notify") {
+		return nil // already migrated, or never existed
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if tx.Migrator().HasTable("token_channels") {
+			result := tx.Exec(`INSERT INTO token_grants (token_id, channel_pattern, capabilities)
+				SELECT tc.token_id, c.name, concat_ws(',', CASE WHEN t.cap_notify THEN 'notify' END, CASE WHEN t.cap_question THEN 'question' END)
+				FROM token_channels tc
+				JOIN tokens t ON t.id = tc.token_id
+				JOIN channels c ON c.id = tc.channel_id
+				WHERE t.cap_notify OR t.cap_question
+				ON CONFLICT DO NOTHING`)
+			if result.Error != nil {
+				return result.Error
+			}
+
+			err := tx.Migrator().DropTable("token_channels")
+			if err != nil {
+				return err
+			}
+		}
+
+		if tx.Migrator().HasColumn(&Token{}, "cap_admin") {
+			result := tx.Exec("UPDATE tokens SET global_capabilities = 'admin' WHERE cap_admin")
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		for _, column := range []string{"cap_notify", "cap_question", "cap_admin"} {
+			if tx.Migrator().HasColumn(&Token{}, column) {
+				err := tx.Migrator().DropColumn(&Token{}, column)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -1,19 +1,48 @@
 package db
 
 import (
+	"github.com/marcsello/marcsellocorp-bot/utils"
 	"gorm.io/gorm"
+	"net/netip"
+	"path"
+	"slices"
 	"strings"
 	"time"
 )
 
+const (
+	PriorityLow    = "low" // delivered silently
+	PriorityNormal = "normal"
+)
+
+var ValidPriorities = []string{PriorityLow, PriorityNormal}
+
 type Channel struct {
 	gorm.Model
 	Name string `json:"name" gorm:"type:varchar(48) not null;unique"`
 
+	Description     string `json:"description" gorm:"type:varchar(256) not null;default:''"`
+	Icon            string `json:"icon" gorm:"type:varchar(16) not null;default:''"` // an emoji
+	DefaultPriority string `json:"default_priority" gorm:"type:varchar(8) not null;default:'normal'"`
+	OwnerContact    string `json:"owner_contact" gorm:"type:varchar(128) not null;default:''"`
+
+	LastActivity *time.Time `json:"last_activity" gorm:"null"`
+
+	RateLimit int `json:"rate_limit" gorm:"not null;default:0"` // messages per minute, unlimited if 0
+	RateBurst int `json:"rate_burst" gorm:"not null;default:0"`
+
 	Subscribers []*User `gorm:"many2many:subscriptions;constraint:OnDelete:CASCADE;"`
 
-	CreatorID int64
-	Creator   *User `gorm:"belongsTo:User"`
+	CreatorID *int64 `gorm:"null"` // nil if created through the API
+	Creator   *User  `gorm:"belongsTo:User"`
+}
+
+// DisplayName returns the name of the channel prefixed with its icon if it has one
+func (c *Channel) DisplayName() string {
+	if c.Icon == "" {
+		return c.Name
+	}
+	return c.Icon + " " + c.Name
 }
 
 type User struct {
@@ -53,6 +82,13 @@ func (u *User) Greet() string {
 
 }
 
+const (
+	AuthSchemeBearer = "bearer" // the secret is sent with each request
+	AuthSchemeHmac   = "hmac"   // requests are signed with a shared secret
+)
+
+var ValidAuthSchemes = []string{AuthSchemeBearer, AuthSchemeHmac}
+
 type Token struct {
 	gorm.Model
 
@@ -62,9 +98,198 @@ type Token struct {
 
 	TokenHash []byte `json:"-" gorm:"not null; unique"`
 
-	AllowedChannels []*Channel `gorm:"many2many:token_channels;constraint:OnDelete:CASCADE;"`
+	// the previous secret stays valid for a grace period after rotation
+	PreviousTokenHash          []byte     `json:"-" gorm:"null;index"`
+	PreviousTokenHashExpiresAt *time.Time `gorm:"null"`
+
+	AuthScheme string `gorm:"type:varchar(8) not null;default:'bearer'"`
+	HmacSecret string `json:"-" gorm:"not null;default:''"` // used to verify signed requests, only if AuthScheme is hmac
+	// the previous hmac secret stays valid until PreviousTokenHashExpiresAt, as it is rotated along with the token
+	PreviousHmacSecret string `json:"-" gorm:"not null;default:''"`
+
+	ExpiresAt           *time.Time `gorm:"null"` // never expires if nil
+	ExpiryWarningSentAt *time.Time `gorm:"null"`
+
+	CreatorID *int64 `gorm:"null"`
+	Creator   *User  `gorm:"belongsTo:User"`
+
+	Grants []TokenGrant `gorm:"constraint:OnDelete:CASCADE;"` // capabilities on channels
+
+	GlobalCapabilities string `gorm:"not null;default:''"` // comma separated, capabilities not bound to channels
+
+	AllowedCIDRs string `gorm:"not null;default:''"` // comma separated, the token can be used from anywhere if empty
+	LastSourceIP string `gorm:"type:varchar(45) not null;default:''"`
+
+	RateLimit  int `gorm:"not null;default:0"` // messages per minute, unlimited if 0
+	RateBurst  int `gorm:"not null;default:0"`
+	DailyQuota int `gorm:"not null;default:0"` // messages per day (UTC), unlimited if 0
+}
+
+// TokenUsage holds the usage counters of a token for a single day (UTC)
+type TokenUsage struct {
+	TokenID uint      `gorm:"primaryKey"`
+	Token   *Token    `gorm:"belongsTo:Token;constraint:OnDelete:CASCADE;"`
+	Day     time.Time `gorm:"type:date;primaryKey"`
+
+	Requests      int64 `gorm:"not null;default:0"`
+	Notifications int64 `gorm:"not null;default:0"`
+	Questions     int64 `gorm:"not null;default:0"`
+	Errors        int64 `gorm:"not null;default:0"`
+}
+
+// Add sums the counters of the other usage into this one
+func (u *TokenUsage) Add(other TokenUsage) {
+	u.Requests += other.Requests
+	u.Notifications += other.Notifications
+	u.Questions += other.Questions
+	u.Errors += other.Errors
+}
+
+type ScheduledNotification struct {
+	gorm.Model
+
+	SendAt time.Time `gorm:"not null;index"`
+	Text   string    `gorm:"not null"`
+
+	TokenID uint
+	Token   *Token `gorm:"belongsTo:Token;constraint:OnDelete:CASCADE;"`
+
+	ChannelID uint
+	Channel   *Channel `gorm:"belongsTo:Channel;constraint:OnDelete:CASCADE;"`
+}
+
+type RecurringMessage struct {
+	gorm.Model
+
+	Name string `gorm:"type:varchar(48) not null;unique"`
+
+	CronExpr string `gorm:"not null"`
+	Text     string `gorm:"not null"`
+	Options  string `gorm:"not null;default:''"` // comma separated labels, sent as a question if not empty
+
+	LastRunAt *time.Time `gorm:"null"`
+
+	ChannelID uint
+	Channel   *Channel `gorm:"belongsTo:Channel;constraint:OnDelete:CASCADE;"`
+
+	CreatorID int64
+	Creator   *User `gorm:"belongsTo:User"`
+}
+
+func (r *RecurringMessage) IsQuestion() bool {
+	return r.Options != ""
+}
+
+func (r *RecurringMessage) OptionLabels() []string {
+	if r.Options == "" {
+		return nil
+	}
+	return strings.Split(r.Options, ",")
+}
+
+type Template struct {
+	gorm.Model
+
+	Name string `gorm:"type:varchar(48) not null;unique"`
+	Body string `gorm:"not null"` // Go text/template
+
+	CreatorID int64
+	Creator   *User `gorm:"belongsTo:User"`
+}
+
+// Actor is whoever did something recorded in the audit log, at most one of the fields is set
+type Actor struct {
+	UserID  *int64
+	TokenID *uint
+}
+
+func UserActor(id int64) Actor {
+	return Actor{UserID: &id}
+}
+
+func TokenActor(id uint) Actor {
+	return Actor{TokenID: &id}
+}
+
+type AuditLogEntry struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+
+	ActorID *int64 `gorm:"null"` // nil if not done by a user
+	Actor   *User  `gorm:"belongsTo:User"`
+
+	ActorTokenID *uint `gorm:"null"` // set if done through the API, no constraint, so the entry outlives the token
+
+	Action  string `gorm:"type:varchar(32) not null"`
+	Subject string `gorm:"type:varchar(64) not null"`
+	Details string `gorm:"not null;default:''"`
+}
+
+func (t *Token) IsExpired() bool {
+	return t.ExpiresAt != nil && !t.ExpiresAt.After(time.Now())
+}
+
+func (t *Token) HasGlobalCapability(capability Capability) bool {
+	return slices.Contains(SplitCapabilities(t.GlobalCapabilities), capability)
+}
+
+// AllowsSource tells if the token may be used from the given address, malformed allowlist entries never match
+func (t *Token) AllowsSource(addr netip.Addr) bool {
+	if t.AllowedCIDRs == "" {
+		return true
+	}
+	prefixes, err := utils.ParseCIDRList(t.AllowedCIDRs)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Can tells if the token has the capability on the channel through any of its grants
+func (t *Token) Can(capability Capability, channelName string) bool {
+	for _, grant := range t.Grants {
+		if grant.Matches(channelName) && grant.Has(capability) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAnywhere tells if the token has the capability on at least one channel pattern
+func (t *Token) CanAnywhere(capability Capability) bool {
+	for _, grant := range t.Grants {
+		if grant.Has(capability) {
+			return true
+		}
+	}
+	return false
+}
+
+type TokenGrant struct {
+	ID uint `gorm:"primarykey"`
+
+	TokenID        uint   `gorm:"not null;uniqueIndex:idx_token_grant"`
+	ChannelPattern string `gorm:"type:varchar(48) not null;uniqueIndex:idx_token_grant"` // channel name, or a pattern with * and ? wildcards
+
+	Capabilities string `gorm:"not null"` // comma separated
+}
+
+func (g *TokenGrant) Matches(channelName string) bool {
+	matched, err := path.Match(g.ChannelPattern, channelName)
+	return err == nil && matched
+}
+
+func (g *TokenGrant) Has(capability Capability) bool {
+	return slices.Contains(SplitCapabilities(g.Capabilities), capability)
+}
 
-	// quick and dirty
-	CapNotify   bool `gorm:"not null;default:false"`
-	CapQuestion bool `gorm:"not null;default:false"`
+// IsWildcard tells if the pattern may match more than one channel
+func (g *TokenGrant) IsWildcard() bool {
+	return strings.ContainsAny(g.ChannelPattern, "*?")
 }
@@ -1,16 +1,20 @@
 package db
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/jackc/pgx/v5/pgconn"
 	"gorm.io/gorm"
 	"time"
 )
 
-func GetUserById(id int64) (*User, error) {
+func (s *Store) GetUserById(ctx context.Context, id int64) (*User, error) {
 	// preload subs
 	var user User
-	result := db.Preload("Subscriptions").Take(&user, id)
+	result := s.db.WithContext(ctx).Preload("Subscriptions").Take(&user, id)
 
 	if result.Error == nil && result.RowsAffected == 0 {
 		return nil, gorm.ErrRecordNotFound
@@ -19,21 +23,44 @@ func GetUserById(id int64) (*User, error) {
 	return &user, result.Error
 }
 
-func GetAllChannels() ([]Channel, error) {
+func (s *Store) GetAllChannels() ([]Channel, error) {
 	var channels []Channel
-	result := db.Find(&channels)
+	result := s.db.Find(&channels)
 	return channels, result.Error
 }
 
-func GetAllTokens() ([]Token, error) {
+func (s *Store) GetAllChannelsWithSubscribers() ([]Channel, error) {
+	var channels []Channel
+	result := s.db.Preload("Subscribers").Order("name").Find(&channels)
+	return channels, result.Error
+}
+
+// GetArchivedChannelsWithSubscribers returns the archived channels, their subscriptions are kept for when they are restored
+func (s *Store) GetArchivedChannelsWithSubscribers() ([]Channel, error) {
+	var channels []Channel
+	result := s.db.Unscoped().Preload("Subscribers").Where("deleted_at IS NOT NULL").Order("name").Find(&channels)
+	return channels, result.Error
+}
+
+func (s *Store) GetAllTokens() ([]Token, error) {
 	var tokens []Token
-	result := db.Preload("AllowedChannels").Omit("token_hash").Find(&tokens)
+	result := s.db.Preload("Grants").Omit("token_hash", "previous_token_hash", "hmac_secret", "previous_hmac_secret").Find(&tokens)
 	return tokens, result.Error
 }
 
-func GetChannelByName(name string) (*Channel, error) {
+// GetTokenByName loads a token with its grants, without any of its secrets
+func (s *Store) GetTokenByName(name string) (*Token, error) {
+	var token Token
+	result := s.db.Preload("Grants").Omit("token_hash", "previous_token_hash", "hmac_secret", "previous_hmac_secret").Where("name = ?", name).First(&token)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &token, nil
+}
+
+func (s *Store) GetChannelByName(ctx context.Context, name string) (*Channel, error) {
 	var channel Channel
-	result := db.Preload("Subscribers").Where("name = ?", name).First(&channel)
+	result := s.db.WithContext(ctx).Preload("Subscribers").Where("name = ?", name).First(&channel)
 
 	if result.Error == nil && result.RowsAffected == 0 {
 		return nil, gorm.ErrRecordNotFound
@@ -42,9 +69,9 @@ func GetChannelByName(name string) (*Channel, error) {
 	return &channel, result.Error
 }
 
-func GetChannelById(id uint) (*Channel, error) {
+func (s *Store) GetChannelById(id uint) (*Channel, error) {
 	var channel Channel
-	result := db.Preload("Subscribers").Take(&channel, id)
+	result := s.db.Preload("Subscribers").Take(&channel, id)
 
 	if result.Error == nil && result.RowsAffected == 0 {
 		return nil, gorm.ErrRecordNotFound
@@ -53,8 +80,63 @@ func GetChannelById(id uint) (*Channel, error) {
 	return &channel, result.Error
 }
 
-func CreateChannel(channel *Channel) (*Channel, error) {
-	result := db.Save(channel)
+func (s *Store) GetChannelInfoByName(name string) (*Channel, []Token, error) {
+	var channel Channel
+	result := s.db.Preload("Subscribers").Preload("Creator").Where("name = ?", name).First(&channel)
+	if result.Error != nil {
+		return nil, nil, result.Error
+	}
+
+	// patterns can not be matched in the database, so filter all tokens here
+	var allTokens []Token
+	result = s.db.Preload("Grants").Omit("token_hash", "previous_token_hash", "hmac_secret", "previous_hmac_secret").Order("name").Find(&allTokens)
+	if result.Error != nil {
+		return nil, nil, result.Error
+	}
+
+	tokens := make([]Token, 0)
+	for _, token := range allTokens {
+		for _, grant := range token.Grants {
+			if grant.Matches(channel.Name) {
+				tokens = append(tokens, token)
+				break
+			}
+		}
+	}
+
+	return &channel, tokens, nil
+}
+
+// UpdateChannelMetadata sets a single descriptive field of the channel
+func (s *Store) UpdateChannelMetadata(name, field, value string) error {
+	result := s.db.Model(&Channel{}).Where("name = ?", name).Update(field, value)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// UpdateChannel sets multiple fields of the channel at once, keys are column names
+func (s *Store) UpdateChannel(name string, updates map[string]interface{}) error {
+	result := s.db.Model(&Channel{}).Where("name = ?", name).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (s *Store) TouchChannel(ctx context.Context, id uint) error {
+	return s.db.WithContext(ctx).Model(&Channel{}).Where("id = ?", id).Update("last_activity", time.Now()).Error
+}
+
+func (s *Store) CreateChannel(channel *Channel) (*Channel, error) {
+	result := s.db.Save(channel)
 
 	if result.Error != nil {
 		if isPgError(result.Error, "ERROR", "23505") { // duplicate key
@@ -65,22 +147,18 @@ func CreateChannel(channel *Channel) (*Channel, error) {
 	return channel, nil
 }
 
-func CreateToken(token *Token, allowedChannelNames []string) (*Token, error) {
-	err := db.Transaction(func(tx *gorm.DB) error {
+// CreateToken saves a new token with its grants, channels referenced without wildcards must exist
+func (s *Store) CreateToken(token *Token, grants []TokenGrant) (*Token, error) {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
 
-		var channels []Channel
-		result := tx.Where("name IN ?", allowedChannelNames).Find(&channels)
-		if result.RowsAffected != int64(len(allowedChannelNames)) {
-			return gorm.ErrRecordNotFound
+		err := checkGrantedChannelsExist(tx, grants)
+		if err != nil {
+			return err
 		}
 
-		// turn array to array of pointers... for.. some... reason that's beyond me
-		token.AllowedChannels = make([]*Channel, len(channels))
-		for i := range channels {
-			token.AllowedChannels[i] = &channels[i]
-		}
+		token.Grants = grants
 
-		result = tx.Save(token)
+		result := tx.Save(token)
 		if result.Error != nil {
 			if isPgError(result.Error, "ERROR", "23505") { // duplicate key
 				return gorm.ErrDuplicatedKey
@@ -92,28 +170,166 @@ func CreateToken(token *Token, allowedChannelNames []string) (*Token, error) {
 	return token, err
 }
 
-func DeleteChannelByName(name string) error {
-	result := db.Where("name = ?", name).Delete(&Channel{})
-	if result.Error != nil {
-		return result.Error
-	}
-	if result.RowsAffected == 0 {
-		return gorm.ErrRecordNotFound
-	}
-	return nil
+func (s *Store) RenameChannel(actor Actor, oldName, newName string) error {
+	return s.afterTokensChanged(s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Channel{}).Where("name = ?", oldName).Update("name", newName)
+		if result.Error != nil {
+			if isPgError(result.Error, "ERROR", "23505") { // duplicate key
+				return gorm.ErrDuplicatedKey
+			}
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		// grants referencing the channel by name should follow it, wildcard grants are left alone
+		result = tx.Model(&TokenGrant{}).Where("channel_pattern = ?", oldName).Update("channel_pattern", newName)
+		if result.Error != nil {
+			if isPgError(result.Error, "ERROR", "23505") { // duplicate key
+				return gorm.ErrDuplicatedKey
+			}
+			return result.Error
+		}
+		return writeAuditLog(tx, actor, "channel_rename", oldName, "new name: "+newName)
+	}))
 }
 
-func DeleteTokenByName(name string) error {
-	result := db.Unscoped().Where("name = ?", name).Delete(&Token{})
+// ArchiveChannelByName soft-deletes the channel, subscriptions and token grants are kept, so it can be restored later
+func (s *Store) ArchiveChannelByName(actor Actor, name string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("name = ?", name).Delete(&Channel{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return writeAuditLog(tx, actor, "channel_archive", name, "")
+	})
+}
+
+// SetChannelLimits changes the rate limit of the channel, zero means unlimited
+func (s *Store) SetChannelLimits(actor Actor, name string, rateLimit, rateBurst int) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Channel{}).Where("name = ?", name).Updates(map[string]interface{}{
+			"rate_limit": rateLimit,
+			"rate_burst": rateBurst,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return writeAuditLog(tx, actor, "channel_limits", name, fmt.Sprintf("rate: %d/min, burst: %d", rateLimit, rateBurst))
+	})
+}
+
+func (s *Store) RestoreChannelByName(actor Actor, name string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().Model(&Channel{}).Where("name = ? AND deleted_at IS NOT NULL", name).Update("deleted_at", nil)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return writeAuditLog(tx, actor, "channel_restore", name, "")
+	})
+}
+
+// PurgeChannelByName permanently deletes an archived channel along with its subscriptions and token grants referencing it by name, so the name can be reused
+func (s *Store) PurgeChannelByName(actor Actor, name string) error {
+	return s.afterTokensChanged(s.db.Transaction(func(tx *gorm.DB) error {
+		var channel Channel
+		result := tx.Unscoped().Where("name = ? AND deleted_at IS NOT NULL", name).First(&channel)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		result = tx.Exec("DELETE FROM subscriptions WHERE channel_id = ?", channel.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Where("channel_pattern = ?", channel.Name).Delete(&TokenGrant{})
+		if result.Error != nil {
+			return result.Error
+		}
+		// scheduled and recurring messages are deleted by the cascade constraint
+		result = tx.Unscoped().Delete(&channel)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		return writeAuditLog(tx, actor, "channel_purge", name, fmt.Sprintf("id: %d", channel.ID))
+	}))
+}
+
+func (s *Store) DeleteTokenByName(name string) error {
+	result := s.db.Unscoped().Where("name = ?", name).Delete(&Token{})
 	if result.Error != nil {
 		return result.Error
 	}
 	if result.RowsAffected == 0 {
 		return gorm.ErrRecordNotFound
 	}
+	s.tokensChanged()
 	return nil
 }
 
+// RotateToken replaces the secret of the token, the previous secret stays valid for the grace period.
+// Tokens signing their requests get newHmacSecret as their hmac secret the same way, this is reported by the first return value.
+// The expiry of the token is changed only if updateExpiry is set, a nil expiresAt means the token never expires.
+func (s *Store) RotateToken(actor Actor, name string, newTokenHash []byte, newHmacSecret string, grace time.Duration, updateExpiry bool, expiresAt *time.Time) (bool, error) {
+	var hmacRotated bool
+	err := s.afterTokensChanged(s.db.Transaction(func(tx *gorm.DB) error {
+		var token Token
+		result := tx.Where("name = ?", name).First(&token)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		graceEnd := time.Now().Add(grace)
+		updates := map[string]interface{}{
+			"token_hash":                     newTokenHash,
+			"previous_token_hash":            token.TokenHash,
+			"previous_token_hash_expires_at": graceEnd,
+		}
+		hmacRotated = token.AuthScheme == AuthSchemeHmac
+		if hmacRotated {
+			updates["hmac_secret"] = newHmacSecret
+			updates["previous_hmac_secret"] = token.HmacSecret
+		}
+		if updateExpiry {
+			updates["expires_at"] = expiresAt
+			updates["expiry_warning_sent_at"] = nil
+		}
+
+		result = tx.Model(&token).Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		return writeAuditLog(tx, actor, "token_rotate", name, "previous secret valid until "+graceEnd.Format(time.RFC3339))
+	}))
+	return hmacRotated, err
+}
+
+// GetTokensToWarnAboutExpiry returns tokens with a creator, that will expire before the given time, and no warning was sent for yet
+func (s *Store) GetTokensToWarnAboutExpiry(before time.Time) ([]Token, error) {
+	var tokens []Token
+	result := s.db.Omit("token_hash", "previous_token_hash", "hmac_secret", "previous_hmac_secret").
+		Where("creator_id IS NOT NULL AND expiry_warning_sent_at IS NULL").
+		Where("expires_at > ? AND expires_at <= ?", time.Now(), before).
+		Find(&tokens)
+	return tokens, result.Error
+}
+
+func (s *Store) MarkTokenExpiryWarningSent(id uint) error {
+	return s.db.Model(&Token{}).Where("id = ?", id).Update("expiry_warning_sent_at", time.Now()).Error
+}
+
 func isPgError(err error, severity, code string) bool {
 	var pgErr *pgconn.PgError
 	if errors.As(err, &pgErr) {
@@ -123,23 +339,26 @@ func isPgError(err error, severity, code string) bool {
 }
 
 // ChangeSubscription adds or deletes a subscription, the first return value indicates if anything changed or not
-func ChangeSubscription(userId int64, channelId uint, subscribed bool) (bool, error) {
+func (s *Store) ChangeSubscription(userId int64, channelId uint, subscribed bool) (bool, error) {
 	var result *gorm.DB
 	if subscribed {
 
-		result = db.Exec("INSERT INTO subscriptions (user_id, channel_id) VALUES (?, ?)", userId, channelId)
+		result = s.db.Exec("INSERT INTO subscriptions (user_id, channel_id) VALUES (?, ?)", userId, channelId)
 
 		if result.Error != nil {
 			if isPgError(result.Error, "ERROR", "23505") { // duplicate key
 				return false, nil
 			}
+			if isPgError(result.Error, "ERROR", "23503") { // foreign key violation, the user does not exist
+				return false, gorm.ErrRecordNotFound
+			}
 			return false, result.Error
 		}
 		return true, nil
 
 	} else {
 
-		result = db.Exec("DELETE FROM subscriptions WHERE user_id = ? AND channel_id = ?", userId, channelId)
+		result = s.db.Exec("DELETE FROM subscriptions WHERE user_id = ? AND channel_id = ?", userId, channelId)
 
 		if result.Error != nil {
 			return false, result.Error
@@ -149,30 +368,36 @@ func ChangeSubscription(userId int64, channelId uint, subscribed bool) (bool, er
 	}
 }
 
-func GetAndUpdateTokenByHash(tokenHashBytes []byte) (*Token, error) {
+// loadToken loads a single token matching the query along with its grants, including its secrets
+func (s *Store) loadToken(ctx context.Context, query interface{}, args ...interface{}) (*Token, error) {
 	var token Token
-	var found bool
-	err := db.Transaction(func(tx *gorm.DB) error {
-		// fetch allowed ch as well
+	result := s.db.WithContext(ctx).Preload("Grants").Where(query, args...).First(&token)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &token, nil
+}
 
-		result := tx.Preload("AllowedChannels").Where("token_hash = ?", tokenHashBytes).First(&token)
-		if result.Error != nil {
-			return result.Error
+// LookupTokenByHash finds the token by its current secret, or its previous secret within the grace period.
+// Results are cached, the returned token must not be modified.
+func (s *Store) LookupTokenByHash(ctx context.Context, tokenHashBytes []byte) (*Token, error) {
+	return s.cachedTokenLookup("hash:"+hex.EncodeToString(tokenHashBytes), func() (*Token, time.Time, error) {
+		token, err := s.loadToken(ctx, "token_hash = ? OR (previous_token_hash = ? AND previous_token_hash_expires_at > ?)", tokenHashBytes, tokenHashBytes, time.Now())
+		if err != nil {
+			return nil, time.Time{}, err
 		}
-		if result.RowsAffected == 0 {
-			return nil
+		var validUntil time.Time
+		if !bytes.Equal(token.TokenHash, tokenHashBytes) {
+			validUntil = *token.PreviousTokenHashExpiresAt // found by the previous secret, which must not be cached beyond its grace period
 		}
-		found = true
+		return token, validUntil, nil
+	})
+}
 
-		result = tx.Model(&token).Update("last_used", time.Now())
-		return result.Error
+// LookupTokenByName finds the token by its name. Results are cached, the returned token must not be modified.
+func (s *Store) LookupTokenByName(ctx context.Context, name string) (*Token, error) {
+	return s.cachedTokenLookup("name:"+name, func() (*Token, time.Time, error) {
+		token, err := s.loadToken(ctx, "name = ?", name)
+		return token, time.Time{}, err
 	})
-	if err != nil {
-		return nil, err
-	}
-	if found {
-		return &token, nil
-	} else {
-		return nil, nil
-	}
 }
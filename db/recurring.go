@@ -0,0 +1,52 @@
+package db
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+func (s *Store) CreateRecurringMessage(recurring *RecurringMessage) (*RecurringMessage, error) {
+	result := s.db.Create(recurring)
+	if result.Error != nil {
+		if isPgError(result.Error, "ERROR", "23505") { // duplicate key
+			return nil, gorm.ErrDuplicatedKey
+		}
+		return nil, result.Error
+	}
+	return recurring, nil
+}
+
+func (s *Store) GetAllRecurringMessages() ([]RecurringMessage, error) {
+	var recurring []RecurringMessage
+	result := s.db.Preload("Channel").Order("name").Find(&recurring)
+	return recurring, result.Error
+}
+
+func (s *Store) DeleteRecurringMessageByName(name string) error {
+	// hard delete, so the name can be reused
+	result := s.db.Unscoped().Where("name = ?", name).Delete(&RecurringMessage{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// ClaimRecurringMessageRun marks the recurring message as ran at the given time.
+// Returns false if someone else updated it in the meantime, in which case it should not be sent.
+func (s *Store) ClaimRecurringMessageRun(recurring *RecurringMessage, now time.Time) (bool, error) {
+	query := s.db.Model(&RecurringMessage{}).Where("id = ?", recurring.ID)
+	if recurring.LastRunAt == nil {
+		query = query.Where("last_run_at IS NULL")
+	} else {
+		query = query.Where("last_run_at = ?", *recurring.LastRunAt)
+	}
+
+	result := query.Update("last_run_at", now)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
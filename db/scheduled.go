@@ -0,0 +1,71 @@
+package db
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+const scheduledBatchSize = 50
+
+func (s *Store) CreateScheduledNotification(scheduled *ScheduledNotification) (*ScheduledNotification, error) {
+	result := s.db.Create(scheduled)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return scheduled, nil
+}
+
+func (s *Store) GetScheduledNotificationsByToken(tokenId uint) ([]ScheduledNotification, error) {
+	var scheduled []ScheduledNotification
+	result := s.db.Preload("Channel").Where("token_id = ?", tokenId).Order("send_at").Find(&scheduled)
+	return scheduled, result.Error
+}
+
+func (s *Store) DeleteScheduledNotification(tokenId uint, id uint) error {
+	result := s.db.Unscoped().Where("token_id = ?", tokenId).Delete(&ScheduledNotification{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// ProcessDueScheduledNotifications calls deliver for each scheduled notification that is due.
+// The due notifications are claimed by removing them in a short transaction before delivering, so multiple instances
+// can run this concurrently without sending anything twice, and slow deliveries don't hold row locks.
+// Errors returned by deliver are passed to the onError function, the notification is not retried to prevent re-sending.
+func (s *Store) ProcessDueScheduledNotifications(now time.Time, deliver func(*ScheduledNotification) error, onError func(*ScheduledNotification, error)) (int, error) {
+	var due []ScheduledNotification
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Preload("Token.Grants").
+			Preload("Channel.Subscribers").
+			Where("send_at <= ?", now).
+			Order("send_at").
+			Limit(scheduledBatchSize).
+			Find(&due)
+		if result.Error != nil || len(due) == 0 {
+			return result.Error
+		}
+
+		ids := make([]uint, len(due))
+		for i := range due {
+			ids[i] = due[i].ID
+		}
+		return tx.Unscoped().Delete(&ScheduledNotification{}, ids).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range due {
+		err = deliver(&due[i])
+		if err != nil {
+			onError(&due[i], err)
+		}
+	}
+	return len(due), nil
+}
@@ -1,39 +1,104 @@
 package db
 
 import (
-	"database/sql"
-	"gitlab.com/MikeTTh/env"
+	"context"
+	"github.com/marcsello/marcsellocorp-bot/config"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	"time"
+	gormlogger "gorm.io/gorm/logger"
+	"sync"
 )
 
-var db *gorm.DB
+// Store is the persistent storage of the bot, backed by Postgres
+type Store struct {
+	db *gorm.DB
 
-func Connect() (err error) {
-	dsn := env.StringOrPanic("DATABASE_URL")
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{
+	tokenCache        map[string]cachedToken
+	tokenCacheMutex   sync.RWMutex
+	tokensChangedHook func()
+
+	pendingActivity      map[uint]tokenActivity
+	pendingUsage         map[usageKey]TokenUsage
+	pendingActivityMutex sync.Mutex
+
+	flusherStop chan struct{}
+	flusherDone chan struct{}
+}
+
+// Connect opens the database, migrates the schema and starts flushing the token activity in the background
+func Connect(cfg config.Database) (*Store, error) {
+	gormDB, err := gorm.Open(postgres.Open(cfg.URL), &gorm.Config{
 		SkipDefaultTransaction: true, // Epic performance improvement
+		Logger:                 slogLogger{level: gormlogger.Warn, slowThreshold: cfg.SlowQueryThreshold.D()},
 	})
 	if err != nil {
-		return
+		return nil, err
+	}
+
+	s := &Store{
+		db:              gormDB,
+		tokenCache:      map[string]cachedToken{},
+		pendingActivity: map[uint]tokenActivity{},
+		pendingUsage:    map[usageKey]TokenUsage{},
+		flusherStop:     make(chan struct{}),
+		flusherDone:     make(chan struct{}),
+	}
+
+	err = s.db.Use(metricsPlugin{})
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Use(tracingPlugin{})
+	if err != nil {
+		return nil, err
 	}
 
-	var sqlDB *sql.DB
-	sqlDB, err = db.DB()
+	sqlDB, err := s.db.DB()
 	if err != nil {
-		return
+		return nil, err
 	}
 
 	// hopefully this sets stuff globally
-	sqlDB.SetConnMaxLifetime(time.Minute * 15)
-	sqlDB.SetMaxIdleConns(5)
-	sqlDB.SetMaxOpenConns(10)
+	sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime.D())
+	sqlDB.SetMaxIdleConns(cfg.MaxIdleConns)
+	sqlDB.SetMaxOpenConns(cfg.MaxOpenConns)
+
+	err = s.db.AutoMigrate(&Channel{}, &User{}, &Token{}, &TokenGrant{}, &TokenUsage{}, &ScheduledNotification{}, &RecurringMessage{}, &Template{}, &AuditLogEntry{})
+	if err != nil {
+		return nil, err
+	}
 
-	err = db.AutoMigrate(&Channel{}, &User{}, &Token{})
+	err = s.migrateLegacyTokenCapabilities()
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	return
+	go s.flushTokenActivityPeriodically(cfg.ActivityFlushInterval.D(), s.flusherStop, s.flusherDone)
+
+	return s, nil
+}
+
+// Close writes the pending token activity, and closes the connection pool
+func (s *Store) Close() error {
+	close(s.flusherStop)
+	<-s.flusherDone
+
+	err := s.FlushTokenActivity()
+	if err != nil {
+		logger.Error("Failed to flush token activity", "error", err)
+	}
+
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+func (s *Store) Ping(ctx context.Context) error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
 }
@@ -0,0 +1,313 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/marcsello/marcsellocorp-bot/config"
+	"github.com/marcsello/marcsellocorp-bot/utils"
+	"gorm.io/gorm"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestStore connects to the Postgres database given in TEST_DATABASE_URL, the test is skipped if it is not set.
+// Every table is truncated before the test, so never point it to a database holding anything valuable.
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	cfg := config.Default().Database
+	cfg.URL = url
+	s, err := Connect(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = s.Close()
+	})
+
+	err = s.db.Exec("TRUNCATE channels, users, tokens, token_grants, token_usages, subscriptions, scheduled_notifications, recurring_messages, templates, audit_log_entries RESTART IDENTITY CASCADE").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestTokenLookupAndInvalidation(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	var hookCalls int
+	s.SetTokensChangedHook(func() {
+		hookCalls++
+	})
+
+	_, err := s.CreateChannel(&Channel{Name: "alerts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CreateToken(&Token{Name: "ci", TokenHash: utils.TokenHash("secret")}, []TokenGrant{{ChannelPattern: "alerts", Capabilities: "notify"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := s.LookupTokenByHash(ctx, utils.TokenHash("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Name != "ci" || !token.Can(CapNotify, "alerts") || token.Can(CapQuestion, "alerts") {
+		t.Fatalf("unexpected token: %+v", token)
+	}
+
+	_, err = s.LookupTokenByHash(ctx, utils.TokenHash("wrong"))
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("expected gorm.ErrRecordNotFound, got %v", err)
+	}
+
+	// the cached token must be dropped once the token is deleted
+	err = s.DeleteTokenByName("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hookCalls != 1 {
+		t.Fatalf("expected the hook to be called once, got %d", hookCalls)
+	}
+	_, err = s.LookupTokenByHash(ctx, utils.TokenHash("secret"))
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("deleted token still found: %v", err)
+	}
+}
+
+func TestRotateTokenGrace(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	_, err := s.CreateToken(&Token{Name: "ci", TokenHash: utils.TokenHash("old")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hmacRotated bool
+	hmacRotated, err = s.RotateToken(Actor{}, "ci", utils.TokenHash("new"), "hmac", time.Hour, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hmacRotated {
+		t.Fatal("hmac secret rotated for a bearer token")
+	}
+
+	for _, secret := range []string{"old", "new"} {
+		_, err = s.LookupTokenByHash(ctx, utils.TokenHash(secret))
+		if err != nil {
+			t.Fatalf("%s secret not accepted: %v", secret, err)
+		}
+	}
+
+	// without grace the old secret stops working right away
+	_, err = s.RotateToken(Actor{}, "ci", utils.TokenHash("newer"), "hmac", 0, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.LookupTokenByHash(ctx, utils.TokenHash("new"))
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("rotated secret still accepted: %v", err)
+	}
+}
+
+func TestRotateTokenHmacSecret(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	_, err := s.CreateToken(&Token{Name: "signer", TokenHash: utils.TokenHash("old")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetTokenAuthScheme(Actor{}, "signer", AuthSchemeHmac, "old-hmac")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hmacRotated bool
+	hmacRotated, err = s.RotateToken(Actor{}, "signer", utils.TokenHash("new"), "new-hmac", time.Hour, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hmacRotated {
+		t.Fatal("hmac secret not rotated")
+	}
+
+	var token *Token
+	token, err = s.LookupTokenByName(ctx, "signer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.HmacSecret != "new-hmac" || token.PreviousHmacSecret != "old-hmac" {
+		t.Fatalf("unexpected hmac secrets: %q, %q", token.HmacSecret, token.PreviousHmacSecret)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	active := true
+	err := s.SaveUser(Actor{}, &User{ID: 42, FirstName: "Test", Active: &active})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := s.CreateChannel(&Channel{Name: "alerts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []bool{true, false} {
+		changed, err := s.ChangeSubscription(42, ch.ID, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != want {
+			t.Fatalf("subscription %d: expected changed to be %t", i, want)
+		}
+	}
+
+	_, err = s.ChangeSubscription(43, ch.ID, true)
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("expected gorm.ErrRecordNotFound for unknown user, got %v", err)
+	}
+
+	ch, err = s.GetChannelByName(ctx, "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ch.Subscribers) != 1 || ch.Subscribers[0].ID != 42 {
+		t.Fatalf("unexpected subscribers: %+v", ch.Subscribers)
+	}
+}
+
+func TestTokenUsageFlush(t *testing.T) {
+	s := newTestStore(t)
+
+	token, err := s.CreateToken(&Token{Name: "ci", TokenHash: utils.TokenHash("secret")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	s.TouchToken(token.ID, "192.0.2.1")
+	s.QueueTokenUsage(token.ID, now, TokenUsage{Requests: 1, Notifications: 1})
+	s.QueueTokenUsage(token.ID, now, TokenUsage{Requests: 1, Errors: 1})
+
+	err = s.FlushTokenActivity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := s.GetTokenUsage(token.ID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 1 || usage[0].Requests != 2 || usage[0].Notifications != 1 || usage[0].Errors != 1 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+
+	token, err = s.GetTokenByName("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.LastUsed == nil || token.LastSourceIP != "192.0.2.1" {
+		t.Fatalf("activity not flushed: %+v", token)
+	}
+}
+
+func TestTokenUsageFlushRetry(t *testing.T) {
+	s := newTestStore(t)
+
+	token, err := s.CreateToken(&Token{Name: "ci", TokenHash: utils.TokenHash("secret")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	s.QueueTokenUsage(token.ID, now, TokenUsage{Requests: 1})
+
+	// make the flush fail
+	err = s.db.Exec("ALTER TABLE token_usages RENAME TO token_usages_moved").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.FlushTokenActivity()
+	if err == nil {
+		t.Fatal("flush succeeded without the table")
+	}
+	err = s.db.Exec("ALTER TABLE token_usages_moved RENAME TO token_usages").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.QueueTokenUsage(token.ID, now, TokenUsage{Requests: 1})
+	err = s.FlushTokenActivity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := s.GetTokenUsage(token.ID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 1 || usage[0].Requests != 2 {
+		t.Fatalf("failed batch not retried: %+v", usage)
+	}
+}
+
+func TestProcessDueScheduledNotifications(t *testing.T) {
+	s := newTestStore(t)
+
+	token, err := s.CreateToken(&Token{Name: "ci", TokenHash: utils.TokenHash("secret")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel, err := s.CreateChannel(&Channel{Name: "deploys", DefaultPriority: PriorityNormal})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, sendAt := range []time.Time{now.Add(-time.Minute), now.Add(time.Hour)} {
+		_, err = s.CreateScheduledNotification(&ScheduledNotification{SendAt: sendAt, Text: "hello", TokenID: token.ID, ChannelID: channel.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	processed, err := s.ProcessDueScheduledNotifications(now, func(scheduled *ScheduledNotification) error {
+		if scheduled.Token == nil || scheduled.Channel == nil {
+			t.Fatalf("associations not loaded: %+v", scheduled)
+		}
+		// claimed before delivering, so a slow delivery does not keep the row locked
+		var count int64
+		err := s.db.Model(&ScheduledNotification{}).Where("id = ?", scheduled.ID).Count(&count).Error
+		if err != nil || count != 0 {
+			t.Fatalf("notification not claimed before delivery: %d %v", count, err)
+		}
+		return errors.New("telegram is down")
+	}, func(*ScheduledNotification, error) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed != 1 {
+		t.Fatalf("expected 1 processed notification, got %d", processed)
+	}
+
+	remaining, err := s.GetScheduledNotificationsByToken(token.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 1 || remaining[0].SendAt.Before(now) {
+		t.Fatalf("unexpected remaining notifications: %+v", remaining)
+	}
+}
@@ -0,0 +1,43 @@
+package db
+
+import "gorm.io/gorm"
+
+func (s *Store) GetAllTemplates() ([]Template, error) {
+	var templates []Template
+	result := s.db.Order("name").Find(&templates)
+	return templates, result.Error
+}
+
+func (s *Store) GetTemplateByName(name string) (*Template, error) {
+	var template Template
+	result := s.db.Where("name = ?", name).First(&template)
+
+	if result.Error == nil && result.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	return &template, result.Error
+}
+
+func (s *Store) CreateTemplate(template *Template) (*Template, error) {
+	result := s.db.Create(template)
+	if result.Error != nil {
+		if isPgError(result.Error, "ERROR", "23505") { // duplicate key
+			return nil, gorm.ErrDuplicatedKey
+		}
+		return nil, result.Error
+	}
+	return template, nil
+}
+
+func (s *Store) DeleteTemplateByName(name string) error {
+	// hard delete, so the name can be reused
+	result := s.db.Unscoped().Where("name = ?", name).Delete(&Template{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"time"
+)
+
+// tokens are cached only for a short while, so changes made without invalidation (e.g. directly in the database) take effect eventually
+const tokenCacheTTL = time.Minute
+
+type cachedToken struct {
+	token     *Token
+	expiresAt time.Time
+}
+
+// cachedTokenLookup returns the cached token for the key, or loads and caches it. Not found tokens are not cached.
+// The load function may limit how long the token can be cached by returning a non-zero time.
+func (s *Store) cachedTokenLookup(key string, load func() (*Token, time.Time, error)) (*Token, error) {
+	now := time.Now()
+
+	s.tokenCacheMutex.RLock()
+	entry, ok := s.tokenCache[key]
+	s.tokenCacheMutex.RUnlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.token, nil
+	}
+
+	token, validUntil, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := now.Add(tokenCacheTTL)
+	if !validUntil.IsZero() && validUntil.Before(expiresAt) {
+		expiresAt = validUntil
+	}
+
+	s.tokenCacheMutex.Lock()
+	s.tokenCache[key] = cachedToken{token: token, expiresAt: expiresAt}
+	s.tokenCacheMutex.Unlock()
+	return token, nil
+}
+
+// InvalidateTokenCache drops every cached token, it should be called when tokens are changed by another instance
+func (s *Store) InvalidateTokenCache() {
+	s.tokenCacheMutex.Lock()
+	s.tokenCache = map[string]cachedToken{}
+	s.tokenCacheMutex.Unlock()
+}
+
+// SetTokensChangedHook sets a function to be called after tokens are changed by this instance, so other instances can be notified
+func (s *Store) SetTokensChangedHook(hook func()) {
+	s.tokensChangedHook = hook
+}
+
+func (s *Store) tokensChanged() {
+	s.InvalidateTokenCache()
+	if s.tokensChangedHook != nil {
+		s.tokensChangedHook()
+	}
+}
+
+// afterTokensChanged invalidates the token cache if the change succeeded, the error is passed through
+func (s *Store) afterTokensChanged(err error) error {
+	if err == nil {
+		s.tokensChanged()
+	}
+	return err
+}
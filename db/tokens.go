@@ -0,0 +1,180 @@
+package db
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
+	"time"
+)
+
+// checkGrantedChannelsExist makes sure that channels referenced by name in the grants exist, wildcards can not be checked
+func checkGrantedChannelsExist(tx *gorm.DB, grants []TokenGrant) error {
+	names := make([]string, 0, len(grants))
+	for _, grant := range grants {
+		if !grant.IsWildcard() {
+			names = append(names, grant.ChannelPattern)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	var count int64
+	result := tx.Model(&Channel{}).Where("name IN ?", names).Count(&count)
+	if result.Error != nil {
+		return result.Error
+	}
+	if count != int64(len(names)) {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func getTokenIdByName(tx *gorm.DB, name string) (uint, error) {
+	var token Token
+	result := tx.Select("id").Where("name = ?", name).First(&token)
+	return token.ID, result.Error
+}
+
+// SetTokenGrants creates or replaces the grants of the token for the given channel patterns
+func (s *Store) SetTokenGrants(actor Actor, tokenName string, grants []TokenGrant) error {
+	return s.afterTokensChanged(s.db.Transaction(func(tx *gorm.DB) error {
+		tokenId, err := getTokenIdByName(tx, tokenName)
+		if err != nil {
+			return err
+		}
+
+		err = checkGrantedChannelsExist(tx, grants)
+		if err != nil {
+			return err
+		}
+
+		details := make([]string, len(grants))
+		for i := range grants {
+			grants[i].TokenID = tokenId
+			details[i] = grants[i].ChannelPattern + ": " + grants[i].Capabilities
+		}
+
+		result := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "token_id"}, {Name: "channel_pattern"}},
+			DoUpdates: clause.AssignmentColumns([]string{"capabilities"}),
+		}).Create(&grants)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		return writeAuditLog(tx, actor, "token_grant", tokenName, strings.Join(details, "; "))
+	}))
+}
+
+// RevokeTokenGrants removes the grants of the token for the given channel patterns
+func (s *Store) RevokeTokenGrants(actor Actor, tokenName string, channelPatterns []string) error {
+	return s.afterTokensChanged(s.db.Transaction(func(tx *gorm.DB) error {
+		tokenId, err := getTokenIdByName(tx, tokenName)
+		if err != nil {
+			return err
+		}
+
+		result := tx.Where("token_id = ? AND channel_pattern IN ?", tokenId, channelPatterns).Delete(&TokenGrant{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		return writeAuditLog(tx, actor, "token_revoke", tokenName, "channels: "+strings.Join(channelPatterns, ","))
+	}))
+}
+
+func (s *Store) SetTokenGlobalCapabilities(actor Actor, tokenName string, caps []Capability) error {
+	return s.afterTokensChanged(s.db.Transaction(func(tx *gorm.DB) error {
+		capsStr := JoinCapabilities(caps)
+		result := tx.Model(&Token{}).Where("name = ?", tokenName).Update("global_capabilities", capsStr)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		return writeAuditLog(tx, actor, "token_caps", tokenName, "global: "+capsStr)
+	}))
+}
+
+// SetTokenAuthScheme changes how the token authenticates, the hmac secret is only stored for the hmac scheme.
+// Unlike rotation, the previous hmac secret is revoked immediately.
+func (s *Store) SetTokenAuthScheme(actor Actor, tokenName string, scheme string, hmacSecret string) error {
+	return s.afterTokensChanged(s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Token{}).Where("name = ?", tokenName).Updates(map[string]interface{}{
+			"auth_scheme":          scheme,
+			"hmac_secret":          hmacSecret,
+			"previous_hmac_secret": "",
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		return writeAuditLog(tx, actor, "token_auth", tokenName, "scheme: "+scheme)
+	}))
+}
+
+// SetTokenAllowedCIDRs restricts where the token can be used from, an empty list allows any source
+func (s *Store) SetTokenAllowedCIDRs(actor Actor, tokenName string, cidrs string) error {
+	return s.afterTokensChanged(s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Token{}).Where("name = ?", tokenName).Update("allowed_cidrs", cidrs)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		return writeAuditLog(tx, actor, "token_ips", tokenName, "allowed: "+cidrs)
+	}))
+}
+
+// SetTokenLimits changes the rate limit and daily quota of the token, zero means unlimited
+func (s *Store) SetTokenLimits(actor Actor, tokenName string, rateLimit, rateBurst, dailyQuota int) error {
+	return s.afterTokensChanged(s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Token{}).Where("name = ?", tokenName).Updates(map[string]interface{}{
+			"rate_limit":  rateLimit,
+			"rate_burst":  rateBurst,
+			"daily_quota": dailyQuota,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		return writeAuditLog(tx, actor, "token_limits", tokenName, fmt.Sprintf("rate: %d/min, burst: %d, daily: %d", rateLimit, rateBurst, dailyQuota))
+	}))
+}
+
+// SetTokenExpiry changes when the token expires without rotating it, nil means never
+func (s *Store) SetTokenExpiry(actor Actor, tokenName string, expiresAt *time.Time) error {
+	return s.afterTokensChanged(s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Token{}).Where("name = ?", tokenName).Updates(map[string]interface{}{
+			"expires_at":             expiresAt,
+			"expiry_warning_sent_at": nil,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		details := "never"
+		if expiresAt != nil {
+			details = expiresAt.Format(time.RFC3339)
+		}
+		return writeAuditLog(tx, actor, "token_expiry", tokenName, "expires: "+details)
+	}))
+}
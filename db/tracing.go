@@ -0,0 +1,78 @@
+package db
+
+import (
+	"github.com/marcsello/marcsellocorp-bot/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const tracingSpanKey = "tracing:span"
+
+// tracingPlugin creates a span for every query gorm issues, as a child of the span in the context of the statement
+type tracingPlugin struct{}
+
+func (tracingPlugin) Name() string {
+	return "tracing"
+}
+
+func (tracingPlugin) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+	for _, reg := range []struct {
+		operation string
+		before    func(name string, fn func(*gorm.DB)) error
+		after     func(name string, fn func(*gorm.DB)) error
+	}{
+		{"create", callbacks.Create().Before("gorm:create").Register, callbacks.Create().After("gorm:create").Register},
+		{"query", callbacks.Query().Before("gorm:query").Register, callbacks.Query().After("gorm:query").Register},
+		{"update", callbacks.Update().Before("gorm:update").Register, callbacks.Update().After("gorm:update").Register},
+		{"delete", callbacks.Delete().Before("gorm:delete").Register, callbacks.Delete().After("gorm:delete").Register},
+		{"row", callbacks.Row().Before("gorm:row").Register, callbacks.Row().After("gorm:row").Register},
+		{"raw", callbacks.Raw().Before("gorm:raw").Register, callbacks.Raw().After("gorm:raw").Register},
+	} {
+		err := reg.before("tracing:before_"+reg.operation, startQuerySpan(reg.operation))
+		if err != nil {
+			return err
+		}
+		err = reg.after("tracing:after_"+reg.operation, endQuerySpan)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startQuerySpan(operation string) func(tx *gorm.DB) {
+	return func(tx *gorm.DB) {
+		ctx := tx.Statement.Context
+		_, span := tracing.Start(ctx, "postgres."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemPostgreSQL,
+				semconv.DBOperation(operation),
+				attribute.String("db.sql.table", tx.Statement.Table),
+			),
+		)
+		tx.InstanceSet(tracingSpanKey, span)
+	}
+}
+
+func endQuerySpan(tx *gorm.DB) {
+	spanInt, ok := tx.InstanceGet(tracingSpanKey)
+	if !ok {
+		return
+	}
+	span, ok := spanInt.(trace.Span)
+	if !ok {
+		return
+	}
+
+	// the statement is only known after it has been built
+	span.SetAttributes(semconv.DBStatement(tx.Statement.SQL.String()))
+	err := tx.Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil // an empty result is not a failure of the query
+	}
+	tracing.End(span, err)
+}
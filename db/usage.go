@@ -0,0 +1,19 @@
+package db
+
+import (
+	"time"
+)
+
+// UsageDay truncates the time to the day the usage is accounted to
+func UsageDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// GetTokenUsage returns the daily usage of the token since the given day, oldest first. Days without usage are omitted.
+// Usage of the last few seconds may not be written yet.
+func (s *Store) GetTokenUsage(tokenId uint, since time.Time) ([]TokenUsage, error) {
+	var usage []TokenUsage
+	result := s.db.Where("token_id = ? AND day >= ?", tokenId, UsageDay(since)).Order("day").Find(&usage)
+	return usage, result.Error
+}
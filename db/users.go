@@ -0,0 +1,45 @@
+package db
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+)
+
+func (s *Store) GetAllUsers() ([]User, error) {
+	var users []User
+	result := s.db.Order("id").Find(&users)
+	return users, result.Error
+}
+
+// SaveUser creates the user, or replaces all of its data if it already exists
+func (s *Store) SaveUser(actor Actor, user *User) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Omit("Subscriptions").Save(user)
+		if result.Error != nil {
+			return result.Error
+		}
+		return writeAuditLog(tx, actor, "user_save", fmt.Sprintf("%d", user.ID), fmt.Sprintf("active: %t, admin: %t", user.IsActive(), user.IsAdmin()))
+	})
+}
+
+// DeleteUserById removes the user along with its subscriptions.
+// Users referenced as creators can not be deleted, gorm.ErrForeignKeyViolated is returned for them.
+func (s *Store) DeleteUserById(actor Actor, id int64) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Exec("DELETE FROM subscriptions WHERE user_id = ?", id)
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Delete(&User{}, id)
+		if result.Error != nil {
+			if isPgError(result.Error, "ERROR", "23503") { // foreign key violation
+				return gorm.ErrForeignKeyViolated
+			}
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return writeAuditLog(tx, actor, "user_delete", fmt.Sprintf("%d", id), "")
+	})
+}
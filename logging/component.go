@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Component returns a logger tagging every record with the name of the component.
+// It may be stored in a package level variable, records are passed to the default logger at the time of logging,
+// so it picks up the configuration done by Init.
+func Component(name string) *slog.Logger {
+	return slog.New(componentHandler{}).With("component", name)
+}
+
+// componentHandler forwards everything to the handler of the current default logger
+type componentHandler struct {
+	attrs []slog.Attr
+	group string
+}
+
+func (h componentHandler) handler() slog.Handler {
+	handler := slog.Default().Handler()
+	if len(h.attrs) > 0 {
+		handler = handler.WithAttrs(h.attrs)
+	}
+	if h.group != "" {
+		handler = handler.WithGroup(h.group)
+	}
+	return handler
+}
+
+func (h componentHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return slog.Default().Handler().Enabled(ctx, level)
+}
+
+func (h componentHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler().Handle(ctx, record)
+}
+
+func (h componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if h.group != "" {
+		// attributes added after a group belong to it, keeping track of that is not worth the trouble
+		return h.handler().WithAttrs(attrs)
+	}
+	return componentHandler{attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h componentHandler) WithGroup(name string) slog.Handler {
+	if h.group != "" {
+		return h.handler().WithGroup(name)
+	}
+	return componentHandler{attrs: h.attrs, group: name}
+}
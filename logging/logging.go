@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"github.com/marcsello/marcsellocorp-bot/config"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type contextKey int
+
+const requestIdKey contextKey = iota
+
+// Init sets up the default logger, the standard library logger (used by gin and telebot) is redirected to it as well
+func Init(cfg config.Log, debug bool) error {
+	var lvl slog.Level
+	if cfg.Level == "" {
+		lvl = slog.LevelInfo
+		if debug {
+			lvl = slog.LevelDebug
+		}
+	} else {
+		err := lvl.UnmarshalText([]byte(cfg.Level))
+		if err != nil {
+			return fmt.Errorf("invalid log level: %s", cfg.Level)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var out io.Writer = os.Stderr
+
+	var handler slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("invalid log format: %s, must be text or json", cfg.Format)
+	}
+
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	log.SetFlags(0) // slog adds the time already
+	return nil
+}
+
+// WithRequestID returns a context carrying the request ID, it is added to every record logged with that context
+func WithRequestID(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey, requestId)
+}
+
+// RequestID returns the request ID carried by the context, or an empty string
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIdKey).(string)
+	return id
+}
+
+// contextHandler adds the request ID and the trace from the context of the record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if spanCtx := trace.SpanContextFromContext(ctx); spanCtx.IsValid() {
+		record.AddAttrs(slog.String("trace_id", spanCtx.TraceID().String()), slog.String("span_id", spanCtx.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -1,58 +1,143 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/marcsello/marcsellocorp-bot/api"
+	"github.com/marcsello/marcsellocorp-bot/config"
 	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/logging"
 	"github.com/marcsello/marcsellocorp-bot/memdb"
+	"github.com/marcsello/marcsellocorp-bot/scheduler"
 	"github.com/marcsello/marcsellocorp-bot/telegram"
-	"gitlab.com/MikeTTh/env"
-	"log"
+	"github.com/marcsello/marcsellocorp-bot/tracing"
+	"github.com/marcsello/marcsellocorp-bot/version"
+	"log/slog"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 )
 
 func main() {
-	log.Println("Staring Marcsello Corp. Telegram Bot...")
-	debug := env.Bool("DEBUG", false)
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration:\n%s\n", err)
+		os.Exit(2)
+	}
 
-	log.Println("Connecting to DB...")
-	err := db.Connect()
+	// subcommands only access the databases, the bot does not have to be configured for them
+	if len(os.Args) > 1 {
+		err = cfg.ValidateStorage()
+	} else {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%s\n", err)
+		os.Exit(2)
+	}
+
+	err = logging.Init(cfg.Log, cfg.Debug)
 	if err != nil {
 		panic(err)
 	}
 
-	log.Println("Connecting to Redis...")
-	err = memdb.InitRedisConnection()
+	if len(os.Args) > 1 {
+		err = runCommand(cfg, os.Args[1:])
+		if err != nil {
+			slog.Error("Command failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	slog.Info("Staring Marcsello Corp. Telegram Bot...", "version", version.Version)
+
+	// everything is stopped gracefully when this is cancelled
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Init(ctx, cfg.Tracing)
+	if err != nil {
+		panic(err)
+	}
+
+	slog.Info("Connecting to DB...")
+	store, err := db.Connect(cfg.Database)
 	if err != nil {
 		panic(err)
 	}
 
-	log.Println("Init BOT...")
-	botRun, err := telegram.InitTelegramBot(debug)
+	slog.Info("Connecting to Redis...")
+	mem, err := memdb.Connect(cfg.Redis)
 	if err != nil {
 		panic(err)
 	}
 
-	log.Println("Init API...")
-	apiRun, err := api.InitApi(debug)
+	// keep the token caches of all instances consistent
+	store.SetTokensChangedHook(func() {
+		pubErr := mem.PublishTokenInvalidation(context.Background())
+		if pubErr != nil {
+			slog.Error("Failed to publish token invalidation", "error", pubErr)
+		}
+	})
+	go mem.SubscribeTokenInvalidation(ctx, store.InvalidateTokenCache)
+
+	slog.Info("Init BOT...")
+	bot, err := telegram.NewBot(cfg.Telegram, cfg.Tokens, store, mem, cfg.Debug)
+	if err != nil {
+		panic(err)
+	}
+
+	slog.Info("Init API...")
+	server, err := api.NewServer(cfg.API, cfg.Tokens, store, mem, mem, bot, cfg.Debug)
+	if err != nil {
+		panic(err)
+	}
+
+	slog.Info("Init Scheduler...")
+	sched, err := scheduler.NewScheduler(cfg.Scheduler, store, mem, bot)
 	if err != nil {
 		panic(err)
 	}
 
 	wg := sync.WaitGroup{}
-	wg.Add(2)
+	wg.Add(3)
+
+	go func() {
+		slog.Info("Staring API...")
+		server.Run(ctx)
+		wg.Done()
+	}()
 
 	go func() {
-		log.Println("Staring API...")
-		apiRun()
+		slog.Info("Staring BOT...")
+		bot.Run(ctx)
 		wg.Done()
 	}()
 
 	go func() {
-		log.Println("Staring BOT...")
-		botRun()
+		slog.Info("Staring Scheduler...")
+		sched.Run(ctx)
 		wg.Done()
 	}()
 
+	<-ctx.Done()
+	slog.Info("Shutting down...")
 	wg.Wait()
 
+	slog.Info("Closing connections...")
+	err = store.Close()
+	if err != nil {
+		slog.Error("Failed to close DB", "error", err)
+	}
+	err = mem.Close()
+	if err != nil {
+		slog.Error("Failed to close Redis", "error", err)
+	}
+	err = shutdownTracing(context.Background()) // flush the pending spans
+	if err != nil {
+		slog.Error("Failed to shut down tracing", "error", err)
+	}
+	slog.Info("Bye!")
 }
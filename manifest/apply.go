@@ -0,0 +1,339 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/utils"
+	"slices"
+	"strings"
+	"time"
+)
+
+const secretLength = 48
+
+// Store is the database the manifest is exported from and imported to, implemented by db.Store
+type Store interface {
+	GetAllUsers() ([]db.User, error)
+	GetUserById(ctx context.Context, id int64) (*db.User, error)
+	SaveUser(actor db.Actor, user *db.User) error
+	DeleteUserById(actor db.Actor, id int64) error
+
+	GetAllChannelsWithSubscribers() ([]db.Channel, error)
+	GetArchivedChannelsWithSubscribers() ([]db.Channel, error)
+	GetChannelByName(ctx context.Context, name string) (*db.Channel, error)
+	CreateChannel(channel *db.Channel) (*db.Channel, error)
+	UpdateChannel(name string, updates map[string]interface{}) error
+	ArchiveChannelByName(actor db.Actor, name string) error
+	RestoreChannelByName(actor db.Actor, name string) error
+	ChangeSubscription(userId int64, channelId uint, subscribed bool) (bool, error)
+
+	GetAllTokens() ([]db.Token, error)
+	CreateToken(token *db.Token, grants []db.TokenGrant) (*db.Token, error)
+	SetTokenGrants(actor db.Actor, tokenName string, grants []db.TokenGrant) error
+	RevokeTokenGrants(actor db.Actor, tokenName string, channelPatterns []string) error
+	SetTokenGlobalCapabilities(actor db.Actor, tokenName string, caps []db.Capability) error
+	SetTokenAuthScheme(actor db.Actor, tokenName string, scheme string, hmacSecret string) error
+	SetTokenAllowedCIDRs(actor db.Actor, tokenName string, cidrs string) error
+	SetTokenLimits(actor db.Actor, tokenName string, rateLimit, rateBurst, dailyQuota int) error
+	SetTokenExpiry(actor db.Actor, tokenName string, expiresAt *time.Time) error
+	DeleteTokenByName(name string) error
+
+	WriteAuditLog(actor db.Actor, action, subject, details string) error
+}
+
+// Options control how a manifest is imported
+type Options struct {
+	DryRun bool // only compute the changes
+	Prune  bool // remove objects and subscriptions not in the manifest, channels are archived
+}
+
+// Result describes an import, Secrets holds the secrets generated for new tokens (or for tokens switched to hmac) by token name
+type Result struct {
+	Changes []Change          `json:"changes"`
+	Applied int               `json:"applied"`
+	DryRun  bool              `json:"dry_run"`
+	Secrets map[string]string `json:"secrets,omitempty"`
+}
+
+// Import brings the database to the state described by the manifest.
+// Declared objects are updated to match the manifest exactly, including the grants of tokens.
+// Changes are applied one by one, if one fails the import stops, and the result tells how many were applied.
+func Import(store Store, m *Manifest, actor db.Actor, opts Options) (*Result, error) {
+	err := normalize(m)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+
+	var current *Manifest
+	current, err = Export(store)
+	if err != nil {
+		return nil, err
+	}
+	err = normalize(current)
+	if err != nil {
+		return nil, fmt.Errorf("current state is invalid: %w", err)
+	}
+
+	// archived channels are not exported, but they still hold their names
+	var archived []db.Channel
+	archived, err = store.GetArchivedChannelsWithSubscribers()
+	if err != nil {
+		return nil, err
+	}
+	archivedChannels := make(map[string]ChannelSpec, len(archived))
+	for _, c := range archived {
+		archivedChannels[c.Name] = channelToSpec(c)
+	}
+
+	var changes []Change
+	changes, err = plan(current, m, archivedChannels, opts.Prune)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+
+	result := &Result{
+		Changes: changes,
+		DryRun:  opts.DryRun,
+		Secrets: map[string]string{},
+	}
+	if opts.DryRun || len(changes) == 0 {
+		return result, nil
+	}
+
+	for _, change := range changes {
+		err = change.apply(store, actor, result.Secrets)
+		if err != nil {
+			err = fmt.Errorf("failed to %s: %w", change, err)
+			break
+		}
+		result.Applied++
+	}
+
+	auditErr := store.WriteAuditLog(actor, "manifest_import", "", fmt.Sprintf("%d of %d changes applied", result.Applied, len(changes)))
+	if err == nil {
+		err = auditErr
+	}
+	return result, err
+}
+
+func saveUser(spec UserSpec) func(Store, db.Actor, map[string]string) error {
+	return func(store Store, actor db.Actor, _ map[string]string) error {
+		user := db.User{ID: spec.ID}
+		existing, err := store.GetUserById(context.Background(), spec.ID)
+		if err == nil {
+			user = *existing // keep the fields not described by the manifest
+		}
+		user.FirstName = spec.FirstName
+		user.LastName = spec.LastName
+		user.Username = spec.Username
+		user.Active = &spec.Active
+		user.Admin = &spec.Admin
+		user.Subscriptions = nil
+		return store.SaveUser(actor, &user)
+	}
+}
+
+func deleteUser(id int64) func(Store, db.Actor, map[string]string) error {
+	return func(store Store, actor db.Actor, _ map[string]string) error {
+		return store.DeleteUserById(actor, id)
+	}
+}
+
+func createChannel(spec ChannelSpec) func(Store, db.Actor, map[string]string) error {
+	return func(store Store, actor db.Actor, _ map[string]string) error {
+		_, err := store.CreateChannel(&db.Channel{
+			Name:            spec.Name,
+			Description:     spec.Description,
+			Icon:            spec.Icon,
+			DefaultPriority: spec.DefaultPriority,
+			OwnerContact:    spec.OwnerContact,
+			RateLimit:       spec.RateLimit,
+			RateBurst:       spec.RateBurst,
+		})
+		if err != nil {
+			return err
+		}
+		return store.WriteAuditLog(actor, "channel_create", spec.Name, "manifest import")
+	}
+}
+
+func updateChannel(spec ChannelSpec, details string) func(Store, db.Actor, map[string]string) error {
+	return func(store Store, actor db.Actor, _ map[string]string) error {
+		err := store.UpdateChannel(spec.Name, map[string]interface{}{
+			"description":      spec.Description,
+			"icon":             spec.Icon,
+			"default_priority": spec.DefaultPriority,
+			"owner_contact":    spec.OwnerContact,
+			"rate_limit":       spec.RateLimit,
+			"rate_burst":       spec.RateBurst,
+		})
+		if err != nil {
+			return err
+		}
+		return store.WriteAuditLog(actor, "channel_update", spec.Name, details)
+	}
+}
+
+// restoreChannel restores an archived channel, and updates it to match the manifest
+func restoreChannel(spec ChannelSpec, details string) func(Store, db.Actor, map[string]string) error {
+	update := updateChannel(spec, details)
+	return func(store Store, actor db.Actor, secrets map[string]string) error {
+		err := store.RestoreChannelByName(actor, spec.Name)
+		if err != nil {
+			return err
+		}
+		if details == "" {
+			return nil
+		}
+		return update(store, actor, secrets)
+	}
+}
+
+func archiveChannel(name string) func(Store, db.Actor, map[string]string) error {
+	return func(store Store, actor db.Actor, _ map[string]string) error {
+		return store.ArchiveChannelByName(actor, name)
+	}
+}
+
+func changeSubscription(channelName string, userId int64, subscribed bool) func(Store, db.Actor, map[string]string) error {
+	return func(store Store, _ db.Actor, _ map[string]string) error {
+		channel, err := store.GetChannelByName(context.Background(), channelName)
+		if err != nil {
+			return err
+		}
+		_, err = store.ChangeSubscription(userId, channel.ID, subscribed)
+		return err
+	}
+}
+
+func specToGrants(spec TokenSpec) []db.TokenGrant {
+	grants := make([]db.TokenGrant, len(spec.Grants))
+	for i, g := range spec.Grants {
+		grants[i] = db.TokenGrant{
+			ChannelPattern: g.Channel,
+			Capabilities:   strings.Join(g.Capabilities, ","),
+		}
+	}
+	return grants
+}
+
+func createToken(spec TokenSpec) func(Store, db.Actor, map[string]string) error {
+	return func(store Store, _ db.Actor, secrets map[string]string) error {
+		secret, err := utils.GenerateRandomString(secretLength)
+		if err != nil {
+			return err
+		}
+
+		token := db.Token{
+			Name:               spec.Name,
+			TokenHash:          utils.TokenHash(secret),
+			AuthScheme:         spec.AuthScheme,
+			ExpiresAt:          spec.ExpiresAt,
+			GlobalCapabilities: strings.Join(spec.GlobalCapabilities, ","),
+			AllowedCIDRs:       strings.Join(spec.AllowedCIDRs, ","),
+			RateLimit:          spec.RateLimit,
+			RateBurst:          spec.RateBurst,
+			DailyQuota:         spec.DailyQuota,
+		}
+		if spec.AuthScheme == db.AuthSchemeHmac {
+			// the bearer secret is useless for these, only the signing secret is reported
+			token.HmacSecret, err = utils.GenerateRandomString(secretLength)
+			if err != nil {
+				return err
+			}
+			secret = token.HmacSecret
+		}
+
+		_, err = store.CreateToken(&token, specToGrants(spec))
+		if err != nil {
+			return err
+		}
+		secrets[spec.Name] = secret
+		return nil
+	}
+}
+
+func updateToken(current, spec TokenSpec) func(Store, db.Actor, map[string]string) error {
+	changed := changedFields(tokenFields(current), tokenFields(spec))
+	return func(store Store, actor db.Actor, secrets map[string]string) error {
+		var err error
+
+		if slices.Contains(changed, "grants") {
+			var revoked []string
+			for _, g := range current.Grants {
+				if !slices.ContainsFunc(spec.Grants, func(dg GrantSpec) bool { return dg.Channel == g.Channel }) {
+					revoked = append(revoked, g.Channel)
+				}
+			}
+			if len(revoked) > 0 {
+				err = store.RevokeTokenGrants(actor, spec.Name, revoked)
+				if err != nil {
+					return err
+				}
+			}
+			if len(spec.Grants) > 0 {
+				err = store.SetTokenGrants(actor, spec.Name, specToGrants(spec))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if slices.Contains(changed, "global_capabilities") {
+			caps := make([]db.Capability, len(spec.GlobalCapabilities))
+			for i, c := range spec.GlobalCapabilities {
+				caps[i] = db.Capability(c)
+			}
+			err = store.SetTokenGlobalCapabilities(actor, spec.Name, caps)
+			if err != nil {
+				return err
+			}
+		}
+
+		if slices.Contains(changed, "auth_scheme") {
+			var hmacSecret string
+			if spec.AuthScheme == db.AuthSchemeHmac {
+				hmacSecret, err = utils.GenerateRandomString(secretLength)
+				if err != nil {
+					return err
+				}
+			}
+			err = store.SetTokenAuthScheme(actor, spec.Name, spec.AuthScheme, hmacSecret)
+			if err != nil {
+				return err
+			}
+			if hmacSecret != "" {
+				secrets[spec.Name] = hmacSecret
+			}
+		}
+
+		if slices.Contains(changed, "allowed_cidrs") {
+			err = store.SetTokenAllowedCIDRs(actor, spec.Name, strings.Join(spec.AllowedCIDRs, ","))
+			if err != nil {
+				return err
+			}
+		}
+
+		if slices.Contains(changed, "limits") {
+			err = store.SetTokenLimits(actor, spec.Name, spec.RateLimit, spec.RateBurst, spec.DailyQuota)
+			if err != nil {
+				return err
+			}
+		}
+
+		if slices.Contains(changed, "expires_at") {
+			err = store.SetTokenExpiry(actor, spec.Name, spec.ExpiresAt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func deleteToken(name string) func(Store, db.Actor, map[string]string) error {
+	return func(store Store, _ db.Actor, _ map[string]string) error {
+		return store.DeleteTokenByName(name)
+	}
+}
@@ -0,0 +1,103 @@
+package manifest
+
+import (
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"slices"
+	"strings"
+)
+
+// Export describes the current state of the database as a manifest
+func Export(store Store) (*Manifest, error) {
+	users, err := store.GetAllUsers()
+	if err != nil {
+		return nil, err
+	}
+	var channels []db.Channel
+	channels, err = store.GetAllChannelsWithSubscribers()
+	if err != nil {
+		return nil, err
+	}
+	var tokens []db.Token
+	tokens, err = store.GetAllTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{
+		Users:    make([]UserSpec, len(users)),
+		Channels: make([]ChannelSpec, len(channels)),
+		Tokens:   make([]TokenSpec, len(tokens)),
+	}
+	for i, u := range users {
+		m.Users[i] = userToSpec(u)
+	}
+	for i, c := range channels {
+		m.Channels[i] = channelToSpec(c)
+	}
+	for i, t := range tokens {
+		m.Tokens[i] = tokenToSpec(t)
+	}
+	slices.SortFunc(m.Tokens, func(a, b TokenSpec) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return m, nil
+}
+
+func userToSpec(u db.User) UserSpec {
+	return UserSpec{
+		ID:        u.ID,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Username:  u.Username,
+		Active:    u.IsActive(),
+		Admin:     u.IsAdmin(),
+	}
+}
+
+func channelToSpec(c db.Channel) ChannelSpec {
+	spec := ChannelSpec{
+		Name:            c.Name,
+		Description:     c.Description,
+		Icon:            c.Icon,
+		DefaultPriority: c.DefaultPriority,
+		OwnerContact:    c.OwnerContact,
+		RateLimit:       c.RateLimit,
+		RateBurst:       c.RateBurst,
+	}
+	for _, sub := range c.Subscribers {
+		spec.Subscribers = append(spec.Subscribers, sub.ID)
+	}
+	slices.Sort(spec.Subscribers)
+	return spec
+}
+
+func tokenToSpec(t db.Token) TokenSpec {
+	spec := TokenSpec{
+		Name:               t.Name,
+		GlobalCapabilities: splitList(t.GlobalCapabilities),
+		AuthScheme:         t.AuthScheme,
+		AllowedCIDRs:       splitList(t.AllowedCIDRs),
+		RateLimit:          t.RateLimit,
+		RateBurst:          t.RateBurst,
+		DailyQuota:         t.DailyQuota,
+		ExpiresAt:          t.ExpiresAt,
+	}
+	for _, g := range t.Grants {
+		spec.Grants = append(spec.Grants, GrantSpec{
+			Channel:      g.ChannelPattern,
+			Capabilities: splitList(g.Capabilities),
+		})
+	}
+	slices.SortFunc(spec.Grants, func(a, b GrantSpec) int {
+		return strings.Compare(a.Channel, b.Channel)
+	})
+	return spec
+}
+
+// splitList splits a comma separated list stored in the database, an empty string is an empty list
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,86 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"time"
+)
+
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+// ErrInvalid is returned if the manifest is malformed, or can not be applied to the current state
+var ErrInvalid = errors.New("invalid manifest")
+
+// Manifest describes the desired state of channels, users, subscriptions and tokens. Secrets are never included.
+type Manifest struct {
+	Users    []UserSpec    `json:"users" yaml:"users"`
+	Channels []ChannelSpec `json:"channels" yaml:"channels"`
+	Tokens   []TokenSpec   `json:"tokens" yaml:"tokens"`
+}
+
+type UserSpec struct {
+	ID        int64  `json:"id" yaml:"id"`
+	FirstName string `json:"first_name" yaml:"first_name"`
+	LastName  string `json:"last_name,omitempty" yaml:"last_name,omitempty"`
+	Username  string `json:"username,omitempty" yaml:"username,omitempty"`
+	Active    bool   `json:"active" yaml:"active"`
+	Admin     bool   `json:"admin" yaml:"admin"`
+}
+
+type ChannelSpec struct {
+	Name            string  `json:"name" yaml:"name"`
+	Description     string  `json:"description,omitempty" yaml:"description,omitempty"`
+	Icon            string  `json:"icon,omitempty" yaml:"icon,omitempty"`
+	DefaultPriority string  `json:"default_priority,omitempty" yaml:"default_priority,omitempty"` // normal if empty
+	OwnerContact    string  `json:"owner_contact,omitempty" yaml:"owner_contact,omitempty"`
+	RateLimit       int     `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+	RateBurst       int     `json:"rate_burst,omitempty" yaml:"rate_burst,omitempty"`
+	Subscribers     []int64 `json:"subscribers,omitempty" yaml:"subscribers,omitempty"` // user ids
+}
+
+type GrantSpec struct {
+	Channel      string   `json:"channel" yaml:"channel"` // channel name or pattern
+	Capabilities []string `json:"capabilities" yaml:"capabilities"`
+}
+
+type TokenSpec struct {
+	Name               string      `json:"name" yaml:"name"`
+	Grants             []GrantSpec `json:"grants,omitempty" yaml:"grants,omitempty"`
+	GlobalCapabilities []string    `json:"global_capabilities,omitempty" yaml:"global_capabilities,omitempty"`
+	AuthScheme         string      `json:"auth_scheme,omitempty" yaml:"auth_scheme,omitempty"` // bearer if empty
+	AllowedCIDRs       []string    `json:"allowed_cidrs,omitempty" yaml:"allowed_cidrs,omitempty"`
+	RateLimit          int         `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+	RateBurst          int         `json:"rate_burst,omitempty" yaml:"rate_burst,omitempty"`
+	DailyQuota         int         `json:"daily_quota,omitempty" yaml:"daily_quota,omitempty"`
+	ExpiresAt          *time.Time  `json:"expires_at,omitempty" yaml:"expires_at,omitempty"` // never expires if nil
+}
+
+// Parse reads a manifest in YAML or JSON format (JSON is valid YAML), unknown fields are rejected
+func Parse(data []byte) (*Manifest, error) {
+	var m Manifest
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(&m)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+	return &m, nil
+}
+
+// Encode writes the manifest in the given format
+func Encode(m *Manifest, format string) ([]byte, error) {
+	switch format {
+	case FormatYAML:
+		return yaml.Marshal(m)
+	case FormatJSON:
+		return json.MarshalIndent(m, "", "  ")
+	default:
+		return nil, fmt.Errorf("unknown format: %s", format)
+	}
+}
@@ -0,0 +1,196 @@
+package manifest
+
+import (
+	"fmt"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionDelete  = "delete"
+	ActionRestore = "restore"
+)
+
+// Change is a single step needed to bring the database to the state described by the manifest
+type Change struct {
+	Action  string `json:"action"`
+	Kind    string `json:"kind"` // user, channel, subscription or token
+	Name    string `json:"name"`
+	Details string `json:"details,omitempty"`
+
+	apply func(store Store, actor db.Actor, secrets map[string]string) error
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("%s %s %s", c.Action, c.Kind, c.Name)
+	if c.Details != "" {
+		s += " (" + c.Details + ")"
+	}
+	return s
+}
+
+// plan computes the changes needed to get from the current to the desired state, both must be normalized.
+// Desired channels that are archived are restored instead of created, as their names are still taken.
+// Objects missing from the desired state (and subscriptions not listed) are only removed if prune is set.
+func plan(current, desired *Manifest, archivedChannels map[string]ChannelSpec, prune bool) ([]Change, error) {
+	var changes []Change
+
+	currentUsers := map[int64]UserSpec{}
+	for _, u := range current.Users {
+		currentUsers[u.ID] = u
+	}
+	desiredUsers := map[int64]bool{}
+	for _, u := range desired.Users {
+		desiredUsers[u.ID] = true
+		cur, exists := currentUsers[u.ID]
+		if !exists {
+			changes = append(changes, Change{Action: ActionCreate, Kind: "user", Name: fmt.Sprint(u.ID), apply: saveUser(u)})
+		} else if diff := diffFields(userFields(cur), userFields(u)); diff != "" {
+			changes = append(changes, Change{Action: ActionUpdate, Kind: "user", Name: fmt.Sprint(u.ID), Details: diff, apply: saveUser(u)})
+		}
+	}
+
+	currentChannels := map[string]ChannelSpec{}
+	for _, c := range current.Channels {
+		currentChannels[c.Name] = c
+	}
+	desiredChannels := map[string]bool{}
+	var subscriptionChanges []Change
+	var unsubscriptionChanges []Change
+	for _, c := range desired.Channels {
+		desiredChannels[c.Name] = true
+		cur, exists := currentChannels[c.Name]
+		if archivedCur, archived := archivedChannels[c.Name]; !exists && archived {
+			cur = archivedCur // the subscriptions are kept while archived
+			diff := diffFields(channelFields(cur), channelFields(c))
+			changes = append(changes, Change{Action: ActionRestore, Kind: "channel", Name: c.Name, Details: diff, apply: restoreChannel(c, diff)})
+		} else if !exists {
+			changes = append(changes, Change{Action: ActionCreate, Kind: "channel", Name: c.Name, apply: createChannel(c)})
+		} else if diff := diffFields(channelFields(cur), channelFields(c)); diff != "" {
+			changes = append(changes, Change{Action: ActionUpdate, Kind: "channel", Name: c.Name, Details: diff, apply: updateChannel(c, diff)})
+		}
+
+		for _, userId := range c.Subscribers {
+			if !desiredUsers[userId] {
+				if _, ok := currentUsers[userId]; !ok {
+					return nil, fmt.Errorf("channel %s: unknown subscriber: %d", c.Name, userId)
+				}
+			}
+			if !slices.Contains(cur.Subscribers, userId) {
+				subscriptionChanges = append(subscriptionChanges, Change{Action: ActionCreate, Kind: "subscription", Name: fmt.Sprintf("%s/%d", c.Name, userId), apply: changeSubscription(c.Name, userId, true)})
+			}
+		}
+		if prune {
+			for _, userId := range cur.Subscribers {
+				if !slices.Contains(c.Subscribers, userId) {
+					unsubscriptionChanges = append(unsubscriptionChanges, Change{Action: ActionDelete, Kind: "subscription", Name: fmt.Sprintf("%s/%d", c.Name, userId), apply: changeSubscription(c.Name, userId, false)})
+				}
+			}
+		}
+	}
+	changes = append(changes, subscriptionChanges...)
+
+	currentTokens := map[string]TokenSpec{}
+	for _, t := range current.Tokens {
+		currentTokens[t.Name] = t
+	}
+	desiredTokens := map[string]bool{}
+	for _, t := range desired.Tokens {
+		desiredTokens[t.Name] = true
+		cur, exists := currentTokens[t.Name]
+		if !exists {
+			changes = append(changes, Change{Action: ActionCreate, Kind: "token", Name: t.Name, apply: createToken(t)})
+		} else if diff := diffFields(tokenFields(cur), tokenFields(t)); diff != "" {
+			changes = append(changes, Change{Action: ActionUpdate, Kind: "token", Name: t.Name, Details: diff, apply: updateToken(cur, t)})
+		}
+	}
+
+	if !prune {
+		return changes, nil
+	}
+
+	for _, t := range current.Tokens {
+		if !desiredTokens[t.Name] {
+			changes = append(changes, Change{Action: ActionDelete, Kind: "token", Name: t.Name, apply: deleteToken(t.Name)})
+		}
+	}
+	changes = append(changes, unsubscriptionChanges...)
+	for _, c := range current.Channels {
+		if !desiredChannels[c.Name] {
+			changes = append(changes, Change{Action: ActionDelete, Kind: "channel", Name: c.Name, Details: "archived", apply: archiveChannel(c.Name)})
+		}
+	}
+	for _, u := range current.Users {
+		if !desiredUsers[u.ID] {
+			changes = append(changes, Change{Action: ActionDelete, Kind: "user", Name: fmt.Sprint(u.ID), apply: deleteUser(u.ID)})
+		}
+	}
+
+	return changes, nil
+}
+
+// field is a named, comparable representation of a single property of an object
+type field struct {
+	name  string
+	value string
+}
+
+// changedFields lists the names of fields that differ, the fields must be in the same order
+func changedFields(current, desired []field) []string {
+	var names []string
+	for i := range desired {
+		if current[i].value != desired[i].value {
+			names = append(names, desired[i].name)
+		}
+	}
+	return names
+}
+
+// diffFields describes the fields that differ, empty if none
+func diffFields(current, desired []field) string {
+	return strings.Join(changedFields(current, desired), ", ")
+}
+
+func userFields(u UserSpec) []field {
+	return []field{
+		{"first_name", u.FirstName},
+		{"last_name", u.LastName},
+		{"username", u.Username},
+		{"active", fmt.Sprint(u.Active)},
+		{"admin", fmt.Sprint(u.Admin)},
+	}
+}
+
+func channelFields(c ChannelSpec) []field {
+	return []field{
+		{"description", c.Description},
+		{"icon", c.Icon},
+		{"default_priority", c.DefaultPriority},
+		{"owner_contact", c.OwnerContact},
+		{"rate_limit", fmt.Sprint(c.RateLimit)},
+		{"rate_burst", fmt.Sprint(c.RateBurst)},
+	}
+}
+
+func tokenFields(t TokenSpec) []field {
+	grants := make([]string, len(t.Grants))
+	for i, g := range t.Grants {
+		grants[i] = g.Channel + ":" + strings.Join(g.Capabilities, ",")
+	}
+	expiresAt := ""
+	if t.ExpiresAt != nil {
+		expiresAt = t.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return []field{
+		{"grants", strings.Join(grants, ";")},
+		{"global_capabilities", strings.Join(t.GlobalCapabilities, ",")},
+		{"auth_scheme", t.AuthScheme},
+		{"allowed_cidrs", strings.Join(t.AllowedCIDRs, ",")},
+		{"limits", fmt.Sprintf("%d/%d/%d", t.RateLimit, t.RateBurst, t.DailyQuota)},
+		{"expires_at", expiresAt},
+	}
+}
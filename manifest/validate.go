@@ -0,0 +1,159 @@
+package manifest
+
+import (
+	"fmt"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/utils"
+	"slices"
+	"strings"
+)
+
+// normalize validates the manifest, fills in the defaults and brings lists to a canonical order, so manifests can be compared
+func normalize(m *Manifest) error {
+	userIds := map[int64]bool{}
+	for i := range m.Users {
+		u := &m.Users[i]
+		if userIds[u.ID] {
+			return fmt.Errorf("duplicate user: %d", u.ID)
+		}
+		userIds[u.ID] = true
+
+		if u.FirstName == "" {
+			return fmt.Errorf("user %d: first_name is required", u.ID)
+		}
+		if len(u.FirstName) > 64 || len(u.LastName) > 64 || len(u.Username) > 32 {
+			return fmt.Errorf("user %d: name too long", u.ID)
+		}
+	}
+	slices.SortFunc(m.Users, func(a, b UserSpec) int {
+		return compareInt64(a.ID, b.ID)
+	})
+
+	channelNames := map[string]bool{}
+	for i := range m.Channels {
+		c := &m.Channels[i]
+		if !utils.IsValidChannelName(c.Name) {
+			return fmt.Errorf("invalid channel name: %s", c.Name)
+		}
+		if channelNames[c.Name] {
+			return fmt.Errorf("duplicate channel: %s", c.Name)
+		}
+		channelNames[c.Name] = true
+
+		if c.DefaultPriority == "" {
+			c.DefaultPriority = db.PriorityNormal
+		}
+		if !slices.Contains(db.ValidPriorities, c.DefaultPriority) {
+			return fmt.Errorf("channel %s: invalid priority: %s", c.Name, c.DefaultPriority)
+		}
+		if len(c.Description) > 256 || len(c.Icon) > 16 || len(c.OwnerContact) > 128 {
+			return fmt.Errorf("channel %s: value too long", c.Name)
+		}
+		if c.Icon != "" && !utils.IsSingleEmoji(c.Icon) {
+			return fmt.Errorf("channel %s: icon must be a single emoji", c.Name)
+		}
+		if c.RateLimit < 0 || c.RateBurst < 0 {
+			return fmt.Errorf("channel %s: limits must not be negative", c.Name)
+		}
+
+		slices.Sort(c.Subscribers)
+		if len(slices.Compact(slices.Clone(c.Subscribers))) != len(c.Subscribers) {
+			return fmt.Errorf("channel %s: duplicate subscriber", c.Name)
+		}
+	}
+	slices.SortFunc(m.Channels, func(a, b ChannelSpec) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	tokenNames := map[string]bool{}
+	for i := range m.Tokens {
+		t := &m.Tokens[i]
+		if !utils.IsValidTokenName(t.Name) {
+			return fmt.Errorf("invalid token name: %s", t.Name)
+		}
+		if tokenNames[t.Name] {
+			return fmt.Errorf("duplicate token: %s", t.Name)
+		}
+		tokenNames[t.Name] = true
+
+		patterns := map[string]bool{}
+		for j := range t.Grants {
+			g := &t.Grants[j]
+			if !utils.IsValidChannelPattern(g.Channel) {
+				return fmt.Errorf("token %s: invalid channel name or pattern: %s", t.Name, g.Channel)
+			}
+			if patterns[g.Channel] {
+				return fmt.Errorf("token %s: duplicate grant: %s", t.Name, g.Channel)
+			}
+			patterns[g.Channel] = true
+
+			var err error
+			g.Capabilities, err = normalizeCapabilities(g.Capabilities, db.ChannelCapabilities)
+			if err != nil {
+				return fmt.Errorf("token %s: %w", t.Name, err)
+			}
+			if len(g.Capabilities) == 0 {
+				return fmt.Errorf("token %s: no capabilities granted on %s", t.Name, g.Channel)
+			}
+		}
+		slices.SortFunc(t.Grants, func(a, b GrantSpec) int {
+			return strings.Compare(a.Channel, b.Channel)
+		})
+
+		var err error
+		t.GlobalCapabilities, err = normalizeCapabilities(t.GlobalCapabilities, db.GlobalCapabilities)
+		if err != nil {
+			return fmt.Errorf("token %s: %w", t.Name, err)
+		}
+		if len(t.Grants) == 0 && len(t.GlobalCapabilities) == 0 {
+			return fmt.Errorf("token %s: no capabilities", t.Name)
+		}
+
+		if t.AuthScheme == "" {
+			t.AuthScheme = db.AuthSchemeBearer
+		}
+		if !slices.Contains(db.ValidAuthSchemes, t.AuthScheme) {
+			return fmt.Errorf("token %s: invalid auth scheme: %s", t.Name, t.AuthScheme)
+		}
+
+		prefixes, err := utils.ParseCIDRList(strings.Join(t.AllowedCIDRs, ","))
+		if err != nil {
+			return fmt.Errorf("token %s: %w", t.Name, err)
+		}
+		t.AllowedCIDRs = splitList(utils.JoinCIDRList(prefixes))
+
+		if t.RateLimit < 0 || t.RateBurst < 0 || t.DailyQuota < 0 {
+			return fmt.Errorf("token %s: limits must not be negative", t.Name)
+		}
+	}
+	slices.SortFunc(m.Tokens, func(a, b TokenSpec) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return nil
+}
+
+// normalizeCapabilities validates the capabilities, and orders them the same way as the valid ones
+func normalizeCapabilities(names []string, valid []db.Capability) ([]string, error) {
+	caps, err := db.ParseCapabilities(names, valid)
+	if err != nil {
+		return nil, err
+	}
+	var normalized []string
+	for _, c := range valid {
+		if slices.Contains(caps, c) {
+			normalized = append(normalized, string(c))
+		}
+	}
+	return normalized, nil
+}
+
+func compareInt64(a, b int64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
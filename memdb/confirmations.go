@@ -0,0 +1,39 @@
+package memdb
+
+import (
+	"context"
+	"errors"
+	"github.com/marcsello/marcsellocorp-bot/utils"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+const (
+	confirmationKeyPrefix = "CNF_"
+	confirmationExpire    = 5 * time.Minute
+	confirmationCodeLen   = 6
+)
+
+// BeginConfirmation creates a short-lived code that must be presented to ConfirmAction to confirm the action
+func (c *Client) BeginConfirmation(ctx context.Context, action string) (string, error) {
+	code, err := utils.GenerateRandomString(confirmationCodeLen)
+	if err != nil {
+		return "", err
+	}
+
+	result := c.redisClient.Set(ctx, confirmationKeyPrefix+action, code, confirmationExpire)
+	return code, result.Err()
+}
+
+// ConfirmAction checks the code for the action, a code can be used only once
+func (c *Client) ConfirmAction(ctx context.Context, action, code string) (bool, error) {
+	result := c.redisClient.GetDel(ctx, confirmationKeyPrefix+action)
+	storedCode, err := result.Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return false, nil
+		}
+		return false, err
+	}
+	return storedCode == code, nil
+}
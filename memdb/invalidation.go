@@ -0,0 +1,33 @@
+package memdb
+
+import (
+	"context"
+)
+
+const tokenInvalidationChannel = "TOKEN_INVALIDATION"
+
+// PublishTokenInvalidation tells every instance that tokens were changed, and their cached copies must be dropped
+func (c *Client) PublishTokenInvalidation(ctx context.Context) error {
+	return c.redisClient.Publish(ctx, tokenInvalidationChannel, "").Err()
+}
+
+// SubscribeTokenInvalidation calls onInvalidate whenever any instance publishes a token invalidation, blocks until the context is done.
+// The subscription is re-established automatically if the connection is lost, onInvalidate is called then as well, as messages may have been missed.
+func (c *Client) SubscribeTokenInvalidation(ctx context.Context, onInvalidate func()) {
+	pubsub := c.redisClient.Subscribe(ctx, tokenInvalidationChannel)
+	defer pubsub.Close()
+
+	// subscription confirmations are delivered too, so reconnects also cause invalidation
+	ch := pubsub.ChannelWithSubscriptions()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+			onInvalidate()
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package memdb
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+const leaderKeyPrefix = "LEADER_"
+
+// acquire the lock if free, or extend it if we already hold it
+var leaderScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current == false then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+if current == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// TryLeadership attempts to become (or stay) the leader for the given role, returns true if this instance is the leader.
+// The leadership is lost if it is not renewed within ttl.
+func (c *Client) TryLeadership(ctx context.Context, role, instanceId string, ttl time.Duration) (bool, error) {
+	result, err := leaderScript.Run(ctx, c.redisClient, []string{leaderKeyPrefix + role}, instanceId, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return result == 1, nil
+}
@@ -0,0 +1,350 @@
+package memdb
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/marcsello/marcsellocorp-bot/config"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestClient connects to the Redis server given in TEST_REDIS_URL, or to an in-memory one if it is not set.
+// The database is flushed before the test.
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+
+	url := os.Getenv("TEST_REDIS_URL")
+	if url == "" {
+		url = "redis://" + miniredis.RunT(t).Addr()
+	}
+
+	c, err := Connect(config.Redis{
+		URL:                    url,
+		InflightQuestionExpire: config.Duration(time.Minute),
+		AnsweredQuestionExpire: config.Duration(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+
+	err = c.redisClient.FlushDB(context.Background()).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newTestQuestion creates a ready question with the options "yes" and "no"
+func newTestQuestion(t *testing.T, c *Client, sourceToken uint) string {
+	t.Helper()
+
+	tx, err := c.BeginNewQuestion(context.Background(), sourceToken, "deploys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.AddOption("yes", "Yes")
+	tx.AddOption("no", "")
+	tx.AddRelatedMessage(StoredMessage{MessageID: 1, ChatID: 42})
+	err = tx.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx.RandomID()
+}
+
+func TestQuestionLifecycle(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	id := newTestQuestion(t, c, 7)
+
+	q, err := c.GetQuestionData(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.Ready || q.IsAnswered() || q.SourceTokenID != 7 {
+		t.Fatalf("unexpected question: %+v", q)
+	}
+	if len(q.Options) != 2 || len(q.RelatedMessages) != 1 {
+		t.Fatalf("options or messages not stored: %+v", q)
+	}
+
+	_, err = c.AnswerQuestion(ctx, id, 42, "maybe")
+	if err == nil {
+		t.Fatal("invalid answer accepted")
+	}
+
+	q, err = c.AnswerQuestion(ctx, id, 42, "yes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.IsAnswered() || *q.AnswererID != 42 || *q.AnswerData != "yes" {
+		t.Fatalf("unexpected answer: %+v", q)
+	}
+
+	q, err = c.GetQuestionData(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.IsAnswered() {
+		t.Fatal("answer not stored")
+	}
+}
+
+func TestGetQuestionDataMissing(t *testing.T) {
+	c := newTestClient(t)
+
+	_, err := c.GetQuestionData(context.Background(), "nonexistent")
+	if !errors.Is(err, redis.Nil) {
+		t.Fatalf("expected redis.Nil, got %v", err)
+	}
+}
+
+func TestWaitForAnswer(t *testing.T) {
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id := newTestQuestion(t, c, 1)
+
+	type result struct {
+		q   *QuestionData
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		q, err := c.WaitForAnswer(ctx, id)
+		done <- result{q, err}
+	}()
+
+	// the waiter may subscribe after the answer is published, it must find the answer either way
+	time.Sleep(50 * time.Millisecond)
+	_, err := c.AnswerQuestion(ctx, id, 3, "no")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.q == nil || !r.q.IsAnswered() || *r.q.AnswerData != "no" {
+		t.Fatalf("unexpected answer: %+v", r.q)
+	}
+}
+
+func TestWaitForAnswerTimeout(t *testing.T) {
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	id := newTestQuestion(t, c, 1)
+
+	q, err := c.WaitForAnswer(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q != nil {
+		t.Fatalf("expected no answer, got %+v", q)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	id, err := c.StoreNotification(ctx, NotificationData{
+		RelatedMessages: []StoredMessage{{MessageID: 5, ChatID: 6}},
+		SourceTokenID:   2,
+		ChannelName:     "alerts",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := c.GetNotificationData(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.SourceTokenID != 2 || n.ChannelName != "alerts" || len(n.RelatedMessages) != 1 {
+		t.Fatalf("unexpected notification: %+v", n)
+	}
+
+	err = c.DeleteNotification(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.GetNotificationData(ctx, id)
+	if !errors.Is(err, redis.Nil) {
+		t.Fatalf("expected redis.Nil, got %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		wait, err := c.TakeTokenRateLimit(ctx, 1, 1, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != 0 {
+			t.Fatalf("message %d limited within the burst", i)
+		}
+	}
+
+	wait, err := c.TakeTokenRateLimit(ctx, 1, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= 0 || wait > time.Minute {
+		t.Fatalf("expected to wait up to a minute, got %s", wait)
+	}
+
+	// a refunded message can be sent right away
+	err = c.RefundTokenRateLimit(ctx, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait, err = c.TakeTokenRateLimit(ctx, 1, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait != 0 {
+		t.Fatalf("limited after a refund, wait %s", wait)
+	}
+
+	// the buckets of the channels are separate
+	wait, err = c.TakeChannelRateLimit(ctx, 1, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait != 0 {
+		t.Fatal("channel limited by the token bucket")
+	}
+}
+
+func TestDailyUsage(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	for want := int64(1); want <= 3; want++ {
+		used, err := c.CountDailyUsage(ctx, 1, "2024-01-01")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used != want {
+			t.Fatalf("expected %d, got %d", want, used)
+		}
+	}
+
+	err := c.RefundDailyUsage(ctx, 1, "2024-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	used, err := c.CountDailyUsage(ctx, 1, "2024-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != 3 {
+		t.Fatalf("refund not applied, got %d", used)
+	}
+
+	first, err := c.MarkQuotaAlertSent(ctx, 1, "2024-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := c.MarkQuotaAlertSent(ctx, 1, "2024-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first || again {
+		t.Fatalf("alert should be marked only once, got %t then %t", first, again)
+	}
+}
+
+func TestUseNonce(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	fresh, err := c.UseNonce(ctx, 1, "abc", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reused, err := c.UseNonce(ctx, 1, "abc", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := c.UseNonce(ctx, 2, "abc", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fresh || reused || !otherToken {
+		t.Fatalf("unexpected nonce results: %t %t %t", fresh, reused, otherToken)
+	}
+}
+
+func TestConfirmation(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	code, err := c.BeginConfirmation(ctx, "purge:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := c.ConfirmAction(ctx, "purge:test", "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("wrong code accepted")
+	}
+
+	// the code is used up by the failed attempt as well
+	ok, err = c.ConfirmAction(ctx, "purge:test", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("code accepted twice")
+	}
+}
+
+func TestTokenInvalidation(t *testing.T) {
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	invalidated := make(chan struct{}, 1)
+	go c.SubscribeTokenInvalidation(ctx, func() {
+		select {
+		case invalidated <- struct{}{}:
+		default:
+		}
+	})
+
+	// the subscription is established asynchronously, publish until it is received
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		err := c.PublishTokenInvalidation(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-invalidated:
+			return
+		case <-ctx.Done():
+			t.Fatal("invalidation not received")
+		case <-ticker.C:
+		}
+	}
+}
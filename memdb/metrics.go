@@ -0,0 +1,43 @@
+package memdb
+
+import (
+	"context"
+	"errors"
+	"github.com/marcsello/marcsellocorp-bot/metrics"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// metricsHook observes the latency of every command sent to Redis
+type metricsHook struct{}
+
+func (metricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (metricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		observeCommand(cmd.Name(), start, err)
+		return err
+	}
+}
+
+func (metricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		observeCommand("pipeline", start, err)
+		return err
+	}
+}
+
+func observeCommand(name string, start time.Time, err error) {
+	if errors.Is(err, redis.Nil) {
+		err = nil // a missing key is a valid result
+	}
+	metrics.RedisCommandDuration.WithLabelValues(name, metrics.SuccessLabel(err)).Observe(time.Since(start).Seconds())
+}
+
+var _ redis.Hook = metricsHook{}
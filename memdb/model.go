@@ -27,7 +27,9 @@ type QuestionData struct { // should be stored short-term only, the place for in
 	RelatedMessages []StoredMessage `json:"m"` // so they can all be deleted at once
 
 	SourceTokenID uint             `json:"s"`
+	ChannelName   string           `json:"c,omitempty"` // missing from questions created by older versions
 	Options       []QuestionOption `json:"o"`
+	CreatedAt     *time.Time       `json:"at,omitempty"` // missing from questions created by older versions
 
 	Ready bool `json:"r"`
 }
@@ -35,3 +37,10 @@ type QuestionData struct { // should be stored short-term only, the place for in
 func (q QuestionData) IsAnswered() bool {
 	return q.AnswerData != nil && q.AnsweredAt != nil && q.AnswererID != nil && q.Ready
 }
+
+type NotificationData struct { // kept only as long as Telegram allows editing/deleting the messages
+	RelatedMessages []StoredMessage `json:"m"` // so they can all be edited or deleted at once
+
+	SourceTokenID uint   `json:"s"`
+	ChannelName   string `json:"c"`
+}
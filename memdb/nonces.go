@@ -0,0 +1,15 @@
+package memdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const nonceKeyPrefix = "NONCE_"
+
+// UseNonce records a nonce used by a token, returns false if it was already used within ttl
+func (c *Client) UseNonce(ctx context.Context, tokenId uint, nonce string, ttl time.Duration) (bool, error) {
+	key := fmt.Sprintf("%s%d_%s", nonceKeyPrefix, tokenId, nonce)
+	return c.redisClient.SetNX(ctx, key, 1, ttl).Result()
+}
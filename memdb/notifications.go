@@ -0,0 +1,69 @@
+package memdb
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/marcsello/marcsellocorp-bot/utils"
+	"time"
+)
+
+const (
+	notificationDataKeyPrefix = "NTF_"
+	notificationExpire        = 48 * time.Hour // Telegram does not allow deleting messages older than this anyway
+)
+
+func notificationIdToKey(randomId string) string {
+	return notificationDataKeyPrefix + randomId
+}
+
+// StoreNotification saves the data of a sent notification under a new random id, and returns that id
+func (c *Client) StoreNotification(ctx context.Context, data NotificationData) (string, error) {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	var newId string
+	for {
+		newId, err = utils.GenerateRandomString(32)
+		if err != nil {
+			return "", err
+		}
+		result := c.redisClient.SetNX(ctx, notificationIdToKey(newId), dataBytes, notificationExpire)
+		var val bool
+		val, err = result.Result()
+		if err != nil {
+			return "", err
+		}
+		if val {
+			return newId, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err() // context cancelled probably
+		}
+	}
+}
+
+func (c *Client) GetNotificationData(ctx context.Context, randomId string) (*NotificationData, error) {
+	result := c.redisClient.Get(ctx, notificationIdToKey(randomId))
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	dataBytes, err := result.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var data NotificationData
+	err = json.Unmarshal(dataBytes, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
+
+func (c *Client) DeleteNotification(ctx context.Context, randomId string) error {
+	return c.redisClient.Del(ctx, notificationIdToKey(randomId)).Err()
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"github.com/marcsello/marcsellocorp-bot/utils"
 	"github.com/redis/go-redis/v9"
-	"log"
 	"sync"
 	"time"
 )
@@ -14,11 +13,10 @@ import (
 const (
 	questionDataKeyPrefix = "QST_"
 	questionAnswerChannel = "ANSWERED_CHAN"
-	inflightExpire        = 300 * time.Second // un-closed entries will automatically disappear
-	answeredExpire        = 2 * time.Hour     // store data about answered questions for this long
 )
 
 type NewQuestionTx struct {
+	client    *Client
 	randomId  string
 	data      QuestionData
 	dataMutex sync.Mutex
@@ -45,7 +43,7 @@ func (q *NewQuestionTx) Close() error {
 	if err != nil {
 		return err
 	}
-	result := redisClient.Set(q.ctx, q.key(), dataBytes, 0)
+	result := q.client.redisClient.Set(q.ctx, q.key(), dataBytes, 0)
 	return result.Err()
 }
 
@@ -72,15 +70,18 @@ func (q *NewQuestionTx) RandomID() string {
 	return q.randomId
 }
 
-func BeginNewQuestion(ctx context.Context, sourceToken uint) (NewQuestionTx, error) {
+func (c *Client) BeginNewQuestion(ctx context.Context, sourceToken uint, channelName string) (NewQuestionTx, error) {
 	var err error
+	now := time.Now()
 	data := QuestionData{
 		AnsweredAt:      nil,
 		AnswererID:      nil,
 		AnswerData:      nil,
 		RelatedMessages: make([]StoredMessage, 0),
 		SourceTokenID:   sourceToken,
+		ChannelName:     channelName,
 		Ready:           false, // <- messages are being sent out
+		CreatedAt:       &now,
 	}
 
 	var dataBytes []byte
@@ -96,7 +97,7 @@ func BeginNewQuestion(ctx context.Context, sourceToken uint) (NewQuestionTx, err
 			return NewQuestionTx{}, err
 		}
 		newKey := randomIdToKey(newId)
-		result := redisClient.SetNX(ctx, newKey, dataBytes, inflightExpire)
+		result := c.redisClient.SetNX(ctx, newKey, dataBytes, c.inflightExpire)
 		var val bool
 		val, err = result.Result()
 		if err != nil {
@@ -111,6 +112,7 @@ func BeginNewQuestion(ctx context.Context, sourceToken uint) (NewQuestionTx, err
 	}
 
 	return NewQuestionTx{
+		client:    c,
 		randomId:  newId,
 		data:      data,
 		dataMutex: sync.Mutex{},
@@ -138,9 +140,9 @@ func parseDataFromResult(result *redis.StringCmd) (QuestionData, error) {
 	return data, err
 }
 
-func GetQuestionData(ctx context.Context, randomId string) (*QuestionData, error) {
+func (c *Client) GetQuestionData(ctx context.Context, randomId string) (*QuestionData, error) {
 	key := randomIdToKey(randomId)
-	getResult := redisClient.Get(ctx, key)
+	getResult := c.redisClient.Get(ctx, key)
 
 	var err error
 	var data QuestionData
@@ -152,20 +154,20 @@ func GetQuestionData(ctx context.Context, randomId string) (*QuestionData, error
 	return &data, nil
 }
 
-func WaitForAnswer(ctx context.Context, randomId string) (*QuestionData, error) {
+func (c *Client) WaitForAnswer(ctx context.Context, randomId string) (*QuestionData, error) {
 	// first create the subscription
-	psClient := redisClient.Subscribe(ctx, questionAnswerChannel)
+	psClient := c.redisClient.Subscribe(ctx, questionAnswerChannel)
 	psChan := psClient.Channel()
 
 	defer func() {
 		err := psClient.Close()
 		if err != nil {
-			log.Println("Failed to close channel")
+			logger.WarnContext(ctx, "Failed to close subscription", "error", err)
 		}
 	}()
 
 	// then check if maybe the question already answered (prevent race condition by doing this AFTER subscription)
-	data, err := GetQuestionData(ctx, randomId)
+	data, err := c.GetQuestionData(ctx, randomId)
 	if err != nil {
 		return nil, err
 	}
@@ -179,7 +181,7 @@ func WaitForAnswer(ctx context.Context, randomId string) (*QuestionData, error)
 		case msg := <-psChan:
 			if msg.Payload == randomId {
 				// the question we are watching for has been answered
-				data, err = GetQuestionData(ctx, randomId)
+				data, err = c.GetQuestionData(ctx, randomId)
 				if !data.IsAnswered() {
 					return nil, fmt.Errorf("bogus message")
 				}
@@ -194,9 +196,9 @@ func WaitForAnswer(ctx context.Context, randomId string) (*QuestionData, error)
 
 }
 
-func AnswerQuestion(ctx context.Context, randomId string, answererID int64, answerData string) (*QuestionData, error) {
+func (c *Client) AnswerQuestion(ctx context.Context, randomId string, answererID int64, answerData string) (*QuestionData, error) {
 	key := randomIdToKey(randomId)
-	getResult := redisClient.Get(ctx, key)
+	getResult := c.redisClient.Get(ctx, key)
 
 	var dataBytes []byte
 	var err error
@@ -237,10 +239,10 @@ func AnswerQuestion(ctx context.Context, randomId string, answererID int64, answ
 		return nil, err
 	}
 
-	setResult := redisClient.Set(ctx, key, dataBytes, answeredExpire)
+	setResult := c.redisClient.Set(ctx, key, dataBytes, c.answeredExpire)
 	if setResult.Err() != nil {
 		return nil, setResult.Err()
 	}
-	publishResult := redisClient.Publish(ctx, questionAnswerChannel, randomId)
+	publishResult := c.redisClient.Publish(ctx, questionAnswerChannel, randomId)
 	return &data, publishResult.Err()
 }
@@ -0,0 +1,124 @@
+package memdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+const (
+	rateLimitKeyPrefix  = "RL_"
+	quotaKeyPrefix      = "QUOTA_"
+	quotaAlertKeyPrefix = "QALERT_"
+	quotaTTL            = 48 * time.Hour // long enough to outlive the day it belongs to
+)
+
+// token bucket, refilled continuously by the rate (tokens per millisecond) up to the burst size.
+// Returns 0 if a token was taken, or the milliseconds to wait until one becomes available.
+// The clock of the redis server is used, so the replicas don't have to agree on the time.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) / rate)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate) + 1000)
+return wait
+`)
+
+// puts back a single token taken from the bucket, up to the burst size.
+// An expired bucket is full anyway, so it is not recreated.
+var tokenBucketRefundScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local tokens = tonumber(redis.call('HGET', KEYS[1], 'tokens'))
+if tokens == nil then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(math.min(burst, tokens + 1)))
+return 0
+`)
+
+// takeRateLimit takes a single token from the bucket, returns how long to wait if it was empty
+func (c *Client) takeRateLimit(ctx context.Context, key string, perMinute, burst int) (time.Duration, error) {
+	if burst < 1 {
+		burst = 1
+	}
+	rate := float64(perMinute) / float64(time.Minute.Milliseconds())
+	wait, err := tokenBucketScript.Run(ctx, c.redisClient, []string{rateLimitKeyPrefix + key}, rate, burst).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+// refundRateLimit puts back a token taken from the bucket, for requests rejected by another limit
+func (c *Client) refundRateLimit(ctx context.Context, key string, burst int) error {
+	if burst < 1 {
+		burst = 1
+	}
+	return tokenBucketRefundScript.Run(ctx, c.redisClient, []string{rateLimitKeyPrefix + key}, burst).Err()
+}
+
+// TakeTokenRateLimit takes a message from the rate limit of the token, returns how long to wait if the limit is exceeded
+func (c *Client) TakeTokenRateLimit(ctx context.Context, tokenId uint, perMinute, burst int) (time.Duration, error) {
+	return c.takeRateLimit(ctx, fmt.Sprintf("T_%d", tokenId), perMinute, burst)
+}
+
+// TakeChannelRateLimit takes a message from the rate limit of the channel, returns how long to wait if the limit is exceeded
+func (c *Client) TakeChannelRateLimit(ctx context.Context, channelId uint, perMinute, burst int) (time.Duration, error) {
+	return c.takeRateLimit(ctx, fmt.Sprintf("C_%d", channelId), perMinute, burst)
+}
+
+// RefundTokenRateLimit gives back a message taken from the rate limit of the token
+func (c *Client) RefundTokenRateLimit(ctx context.Context, tokenId uint, burst int) error {
+	return c.refundRateLimit(ctx, fmt.Sprintf("T_%d", tokenId), burst)
+}
+
+// RefundChannelRateLimit gives back a message taken from the rate limit of the channel
+func (c *Client) RefundChannelRateLimit(ctx context.Context, channelId uint, burst int) error {
+	return c.refundRateLimit(ctx, fmt.Sprintf("C_%d", channelId), burst)
+}
+
+// CountDailyUsage increments the usage counter of the token for the day, and returns the new value
+func (c *Client) CountDailyUsage(ctx context.Context, tokenId uint, day string) (int64, error) {
+	key := fmt.Sprintf("%s%d_%s", quotaKeyPrefix, tokenId, day)
+	pipe := c.redisClient.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, quotaTTL)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// RefundDailyUsage decrements the usage counter of the token for the day, for requests that were rejected after being counted
+func (c *Client) RefundDailyUsage(ctx context.Context, tokenId uint, day string) error {
+	key := fmt.Sprintf("%s%d_%s", quotaKeyPrefix, tokenId, day)
+	return c.redisClient.Decr(ctx, key).Err()
+}
+
+// MarkQuotaAlertSent returns true only for the first call on the given day, so the alert is sent only once
+func (c *Client) MarkQuotaAlertSent(ctx context.Context, tokenId uint, day string) (bool, error) {
+	key := fmt.Sprintf("%s%d_%s", quotaAlertKeyPrefix, tokenId, day)
+	return c.redisClient.SetNX(ctx, key, 1, quotaTTL).Result()
+}
@@ -1,18 +1,44 @@
 package memdb
 
 import (
+	"context"
+	"github.com/marcsello/marcsellocorp-bot/config"
+	"github.com/marcsello/marcsellocorp-bot/logging"
 	"github.com/redis/go-redis/v9"
-	"gitlab.com/MikeTTh/env"
+	"time"
 )
 
-var redisClient *redis.Client
+// Client holds the short-lived state of the bot in Redis: questions, notifications, rate limits and coordination between instances
+type Client struct {
+	redisClient *redis.Client
 
-func InitRedisConnection() error {
-	redisClientOptions, err := redis.ParseURL(env.String("REDIS_URL", "redis://localhost:6379/0"))
+	inflightExpire time.Duration // un-closed entries will automatically disappear
+	answeredExpire time.Duration // store data about answered questions for this long
+}
+
+var logger = logging.Component("memdb")
+
+// Connect creates a client for the configured Redis server. The connection is established lazily, on the first command.
+func Connect(cfg config.Redis) (*Client, error) {
+	redisClientOptions, err := redis.ParseURL(cfg.URL)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	c := &Client{
+		redisClient:    redis.NewClient(redisClientOptions),
+		inflightExpire: cfg.InflightQuestionExpire.D(),
+		answeredExpire: cfg.AnsweredQuestionExpire.D(),
 	}
+	c.redisClient.AddHook(metricsHook{})
+	c.redisClient.AddHook(tracingHook{})
+	return c, nil
+}
+
+func (c *Client) Close() error {
+	return c.redisClient.Close()
+}
 
-	redisClient = redis.NewClient(redisClientOptions)
-	return nil
+func (c *Client) Ping(ctx context.Context) error {
+	return c.redisClient.Ping(ctx).Err()
 }
@@ -0,0 +1,51 @@
+package memdb
+
+import (
+	"context"
+	"errors"
+	"github.com/marcsello/marcsellocorp-bot/tracing"
+	"github.com/redis/go-redis/v9"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingHook creates a span for every command sent to Redis
+type tracingHook struct{}
+
+func (tracingHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (tracingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ctx, span := startCommandSpan(ctx, cmd.Name())
+		err := next(ctx, cmd)
+		endCommandSpan(span, err)
+		return err
+	}
+}
+
+func (tracingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		ctx, span := startCommandSpan(ctx, "pipeline")
+		err := next(ctx, cmds)
+		endCommandSpan(span, err)
+		return err
+	}
+}
+
+func startCommandSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "redis."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemRedis, semconv.DBOperation(name)),
+	)
+}
+
+func endCommandSpan(span trace.Span, err error) {
+	if errors.Is(err, redis.Nil) {
+		err = nil // a missing key is a valid result
+	}
+	tracing.End(span, err)
+}
+
+var _ redis.Hook = tracingHook{}
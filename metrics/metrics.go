@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const namespace = "marcsellocorp_bot"
+
+var (
+	ApiRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "requests_total",
+		Help:      "API requests by route, status code and token name.",
+	}, []string{"method", "route", "status", "token"})
+
+	ApiRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "request_duration_seconds",
+		Help:      "API request handling time, long-polls included.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"method", "route"})
+
+	ActiveLongPolls = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "active_long_polls",
+		Help:      "Clients currently waiting for the answer of a question.",
+	})
+
+	TelegramSends = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "telegram",
+		Name:      "sends_total",
+		Help:      "Messages sent, edited or deleted through the Bot API by outcome.",
+	}, []string{"kind", "outcome"})
+
+	Questions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "questions",
+		Name:      "total",
+		Help:      "Questions by lifecycle event: created, failed, answered or late_answer (a button pressed after the question expired).",
+	}, []string{"event"})
+
+	QuestionTimeToAnswer = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "questions",
+		Name:      "time_to_answer_seconds",
+		Help:      "Time between creating a question and the first answer.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 4 * 3600, 12 * 3600, 24 * 3600},
+	})
+
+	RedisCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "redis",
+		Name:      "command_duration_seconds",
+		Help:      "Redis command latency, pipelines are observed as a single command.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command", "success"})
+
+	PostgresQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "postgres",
+		Name:      "query_duration_seconds",
+		Help:      "Postgres query latency by gorm operation.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation", "success"})
+)
+
+// Question lifecycle events
+const (
+	QuestionCreated    = "created"
+	QuestionFailed     = "failed" // could not be delivered to every subscriber
+	QuestionAnswered   = "answered"
+	QuestionLateAnswer = "late_answer" // a button was pressed after the question expired, unanswered expiries are not counted
+)
+
+// Telegram send outcomes
+const (
+	OutcomeSuccess     = "success"
+	OutcomeBlocked     = "blocked" // the user blocked the bot or deleted their account
+	OutcomeRateLimited = "rate_limited"
+	OutcomeError       = "error"
+)
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+func SuccessLabel(err error) string {
+	if err != nil {
+		return "false"
+	}
+	return "true"
+}
@@ -0,0 +1,5 @@
+package scheduler
+
+import "github.com/marcsello/marcsellocorp-bot/logging"
+
+var logger = logging.Component("scheduler")
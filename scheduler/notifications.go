@@ -0,0 +1,41 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/telegram"
+	"time"
+)
+
+func (s *Scheduler) deliverScheduledNotification(scheduled *db.ScheduledNotification) error {
+	token := scheduled.Token
+	if token == nil {
+		return fmt.Errorf("token is gone")
+	}
+	if scheduled.Channel == nil {
+		return fmt.Errorf("channel is gone")
+	}
+
+	// the token may have lost access to the channel since the notification was scheduled
+	if !token.Can(db.CapNotify, scheduled.Channel.Name) {
+		return fmt.Errorf("channel not found or no permission")
+	}
+
+	msg := telegram.FormatMessage(token.Name, scheduled.Channel.Name, scheduled.Text)
+	_, err := s.messenger.SendToSubscribers(context.Background(), scheduled.Channel, msg)
+	if err != nil {
+		return err
+	}
+
+	s.store.QueueTokenUsage(token.ID, time.Now(), db.TokenUsage{Notifications: 1})
+
+	logger.Info("Scheduled notification delivered", "token", token.Name, "channel", scheduled.Channel.Name)
+	return nil
+}
+
+func (s *Scheduler) processScheduledNotifications(now time.Time) (int, error) {
+	return s.store.ProcessDueScheduledNotifications(now, s.deliverScheduledNotification, func(scheduled *db.ScheduledNotification, err error) {
+		logger.Error("Failed to deliver scheduled notification", "id", scheduled.ID, "error", err)
+	})
+}
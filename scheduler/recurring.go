@@ -0,0 +1,102 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/memdb"
+	"github.com/marcsello/marcsellocorp-bot/telegram"
+	"github.com/robfig/cron/v3"
+	"strconv"
+	"time"
+)
+
+const recurringSourceName = "schedule"
+
+// isDue tells if the recurring message should have been run since its last run
+func isDue(recurring *db.RecurringMessage, now time.Time) (bool, error) {
+	schedule, err := cron.ParseStandard(recurring.CronExpr)
+	if err != nil {
+		return false, err
+	}
+
+	since := recurring.CreatedAt
+	if recurring.LastRunAt != nil {
+		since = *recurring.LastRunAt
+	}
+
+	return !schedule.Next(since).After(now), nil
+}
+
+func (s *Scheduler) runRecurringMessage(recurring *db.RecurringMessage) error {
+	if recurring.Channel == nil {
+		return fmt.Errorf("channel is gone")
+	}
+
+	// fill subscribers basically
+	channel, err := s.store.GetChannelById(recurring.ChannelID)
+	if err != nil {
+		return err
+	}
+
+	msg := telegram.FormatMessage(recurringSourceName+":"+recurring.Name, channel.Name, recurring.Text)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.tickInterval)
+	defer cancel()
+
+	if !recurring.IsQuestion() {
+		_, err = s.messenger.SendToSubscribers(ctx, channel, msg)
+		return err
+	}
+
+	labels := recurring.OptionLabels()
+	options := make([]memdb.QuestionOption, len(labels))
+	for i, label := range labels {
+		options[i] = memdb.QuestionOption{Data: strconv.Itoa(i + 1), Label: label}
+	}
+
+	_, err = s.messenger.SendQuestion(ctx, 0, channel, msg, options) // not owned by any token
+	return err
+}
+
+func (s *Scheduler) processRecurringMessages(now time.Time) (int, error) {
+	recurringMessages, err := s.store.GetAllRecurringMessages()
+	if err != nil {
+		return 0, err
+	}
+
+	var processed int
+	for i := range recurringMessages {
+		recurring := &recurringMessages[i]
+
+		var due bool
+		due, err = isDue(recurring, now)
+		if err != nil {
+			logger.Error("Invalid cron expression", "name", recurring.Name, "error", err)
+			continue
+		}
+		if !due {
+			continue
+		}
+
+		// claim it first, so it is never sent twice, even if the leader changes in the meantime
+		var claimed bool
+		claimed, err = s.store.ClaimRecurringMessageRun(recurring, now)
+		if err != nil {
+			return processed, err
+		}
+		if !claimed {
+			continue
+		}
+
+		err = s.runRecurringMessage(recurring)
+		if err != nil {
+			logger.Error("Failed to run recurring message", "name", recurring.Name, "error", err)
+			continue
+		}
+		processed++
+		logger.Info("Recurring message sent", "name", recurring.Name)
+	}
+
+	return processed, nil
+}
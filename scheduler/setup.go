@@ -0,0 +1,121 @@
+package scheduler
+
+import (
+	"context"
+	"github.com/marcsello/marcsellocorp-bot/config"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/memdb"
+	"github.com/marcsello/marcsellocorp-bot/utils"
+	"time"
+)
+
+const (
+	leaderRole       = "scheduler"
+	leaderTTLTicks   = 3 // leadership is lost after missing a few ticks
+	instanceIdLength = 16
+)
+
+// Store is the database of scheduled and recurring messages, implemented by db.Store
+type Store interface {
+	ProcessDueScheduledNotifications(now time.Time, deliver func(*db.ScheduledNotification) error, onError func(*db.ScheduledNotification, error)) (int, error)
+	QueueTokenUsage(tokenId uint, at time.Time, delta db.TokenUsage)
+
+	GetAllRecurringMessages() ([]db.RecurringMessage, error)
+	ClaimRecurringMessageRun(recurring *db.RecurringMessage, now time.Time) (bool, error)
+	GetChannelById(id uint) (*db.Channel, error)
+
+	GetTokensToWarnAboutExpiry(before time.Time) ([]db.Token, error)
+	MarkTokenExpiryWarningSent(id uint) error
+}
+
+// Leader elects the single instance doing the work that must not be duplicated, implemented by memdb.Client
+type Leader interface {
+	TryLeadership(ctx context.Context, role, instanceId string, ttl time.Duration) (bool, error)
+}
+
+// Messenger delivers the messages, implemented by telegram.Bot
+type Messenger interface {
+	SendToSubscribers(ctx context.Context, channel *db.Channel, msg string, opts ...interface{}) ([]memdb.StoredMessage, error)
+	SendQuestion(ctx context.Context, sourceTokenId uint, channel *db.Channel, msg string, options []memdb.QuestionOption) (string, error)
+	SendToUser(ctx context.Context, userId int64, msg string) error
+}
+
+// Scheduler sends the scheduled and recurring messages, and warns about expiring tokens
+type Scheduler struct {
+	store     Store
+	leader    Leader
+	messenger Messenger
+
+	instanceId   string
+	tickInterval time.Duration
+}
+
+func NewScheduler(cfg config.Scheduler, store Store, leader Leader, messenger Messenger) (*Scheduler, error) {
+	instanceId, err := utils.GenerateRandomString(instanceIdLength)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Scheduler{
+		store:        store,
+		leader:       leader,
+		messenger:    messenger,
+		instanceId:   instanceId,
+		tickInterval: cfg.TickInterval.D(),
+	}, nil
+}
+
+// Run ticks until the context is cancelled, a tick in progress is always finished
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.tick(now)
+		}
+	}
+}
+
+func (s *Scheduler) tick(now time.Time) {
+	// scheduled notifications are locked row-by-row, so every instance may process them
+	processed, err := s.processScheduledNotifications(now)
+	if err != nil {
+		logger.Error("Failed to process scheduled notifications", "error", err)
+	}
+	if processed > 0 {
+		logger.Info("Processed scheduled notifications", "count", processed)
+	}
+
+	// everything else is only done by the leader
+	ctx, cancel := context.WithTimeout(context.Background(), s.tickInterval)
+	defer cancel()
+	var leader bool
+	leader, err = s.leader.TryLeadership(ctx, leaderRole, s.instanceId, leaderTTLTicks*s.tickInterval)
+	if err != nil {
+		logger.Error("Failed to run leader election", "error", err)
+		return
+	}
+	if !leader {
+		return
+	}
+
+	processed, err = s.processRecurringMessages(now)
+	if err != nil {
+		logger.Error("Failed to process recurring messages", "error", err)
+	}
+	if processed > 0 {
+		logger.Info("Processed recurring messages", "count", processed)
+	}
+
+	processed, err = s.warnAboutExpiringTokens(now)
+	if err != nil {
+		logger.Error("Failed to warn about expiring tokens", "error", err)
+	}
+	if processed > 0 {
+		logger.Info("Warned about expiring tokens", "count", processed)
+	}
+}
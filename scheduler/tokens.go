@@ -0,0 +1,36 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const expiryWarningBefore = 3 * 24 * time.Hour
+
+// warnAboutExpiringTokens notifies the creators of tokens that are about to expire, each token is warned about only once
+func (s *Scheduler) warnAboutExpiringTokens(now time.Time) (int, error) {
+	tokens, err := s.store.GetTokensToWarnAboutExpiry(now.Add(expiryWarningBefore))
+	if err != nil {
+		return 0, err
+	}
+
+	var warned int
+	for _, token := range tokens {
+		// rotating without a validity keeps the expiry, so the command to extend it is given in full
+		msg := fmt.Sprintf("Your token %s expires at %s!\nUse /rotatetoken %s 90d to get a new secret valid for 90 days (or any other validity, like 12h or never).",
+			token.Name, token.ExpiresAt.Format("2006-01-02 15:04:05"), token.Name)
+		err = s.messenger.SendToUser(context.Background(), *token.CreatorID, msg)
+		if err != nil {
+			logger.Error("Failed to warn about token expiry", "token", token.Name, "error", err)
+			continue
+		}
+
+		err = s.store.MarkTokenExpiryWarningSent(token.ID)
+		if err != nil {
+			return warned, err
+		}
+		warned++
+	}
+	return warned, nil
+}
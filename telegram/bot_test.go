@@ -0,0 +1,403 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/marcsello/marcsellocorp-bot/config"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/memdb"
+	"github.com/marcsello/marcsellocorp-bot/telegram/telegramtest"
+	"gopkg.in/telebot.v3"
+	"gorm.io/gorm"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeStore embeds the interface, so calling a method not implemented by it panics
+type fakeStore struct {
+	Store
+
+	users    map[int64]*db.User
+	channels []db.Channel
+	blocked  chan struct{} // GetUserById signals here when it starts waiting for blockAt
+	blockAt  chan struct{} // GetUserById waits for this to be closed if set
+}
+
+func (f *fakeStore) GetUserById(_ context.Context, id int64) (*db.User, error) {
+	if f.blockAt != nil {
+		f.blocked <- struct{}{}
+		<-f.blockAt
+	}
+	user, ok := f.users[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return user, nil
+}
+
+func (f *fakeStore) GetAllChannels() ([]db.Channel, error) {
+	return f.channels, nil
+}
+
+func (f *fakeStore) TouchChannel(context.Context, uint) error {
+	return nil
+}
+
+type testBot struct {
+	bot       *Bot
+	fake      *telegramtest.Server
+	store     *fakeStore
+	questions *memdb.Client
+
+	stop    context.CancelFunc
+	stopped chan struct{} // closed when Run returns
+}
+
+// newTestBot runs the bot against a fake Telegram server, with questions stored in an in-memory Redis
+func newTestBot(t *testing.T) *testBot {
+	t.Helper()
+	return newTestBotWithConfig(t, func(cfg *config.Telegram) {}, nil)
+}
+
+// newTestBotWithConfig is like newTestBot, prepare is called before the bot is started if set
+func newTestBotWithConfig(t *testing.T, configure func(cfg *config.Telegram), prepare func(b *Bot)) *testBot {
+	t.Helper()
+
+	tb := &testBot{
+		fake:  telegramtest.NewServer("123:test"),
+		store: &fakeStore{users: map[int64]*db.User{}},
+	}
+	hs := httptest.NewServer(tb.fake)
+	t.Cleanup(hs.Close)
+
+	var err error
+	tb.questions, err = memdb.Connect(config.Redis{
+		URL:                    "redis://" + miniredis.RunT(t).Addr(),
+		InflightQuestionExpire: config.Duration(time.Minute),
+		AnsweredQuestionExpire: config.Duration(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = tb.questions.Close()
+	})
+
+	cfg := config.Default()
+	cfg.Telegram.Token = "123:test"
+	cfg.Telegram.APIURL = hs.URL
+	cfg.Telegram.UpdatesMode = config.UpdatesModePolling
+	cfg.Telegram.PollingTimeout = config.Duration(time.Second)
+	configure(&cfg.Telegram)
+
+	tb.bot, err = NewBot(cfg.Telegram, cfg.Tokens, tb.store, tb.questions, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prepare != nil {
+		prepare(tb.bot)
+	}
+
+	var ctx context.Context
+	ctx, tb.stop = context.WithCancel(context.Background())
+	tb.stopped = make(chan struct{})
+	go func() {
+		tb.bot.Run(ctx)
+		close(tb.stopped)
+	}()
+	t.Cleanup(func() {
+		tb.stop()
+		<-tb.stopped
+	})
+
+	if cfg.Telegram.UpdatesMode == config.UpdatesModePolling {
+		// updates are processed only once the bot is running
+		deadline := time.Now().Add(5 * time.Second)
+		for tb.fake.Polls() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("bot not polling")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	return tb
+}
+
+func (tb *testBot) addUser(id int64, username string) *db.User {
+	active := true
+	user := &db.User{ID: id, FirstName: "User", Username: username, Active: &active}
+	tb.store.users[id] = user
+	return user
+}
+
+// waitForMessages waits until the chat has the expected number of messages, and returns them
+func (tb *testBot) waitForMessages(t *testing.T, chatID int64, count int) []telebot.Message {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		messages := tb.fake.Messages(chatID)
+		if len(messages) >= count {
+			return messages
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d messages in chat %d, got %d", count, chatID, len(messages))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQuestionAnsweredWithButton(t *testing.T) {
+	tb := newTestBot(t)
+	ctx := context.Background()
+	alice := tb.addUser(42, "alice")
+	bob := tb.addUser(43, "")
+
+	channel := &db.Channel{Name: "deploys", Subscribers: []*db.User{alice, bob}}
+	questionID, err := tb.bot.SendQuestion(ctx, 7, channel, "Deploy?", []memdb.QuestionOption{{Data: "y", Label: "Yes"}, {Data: "n"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	question := tb.waitForMessages(t, 42, 1)[0]
+	if question.Text != "Deploy?" || question.ReplyMarkup == nil || len(question.ReplyMarkup.InlineKeyboard) != 2 {
+		t.Fatalf("unexpected question: %+v", question)
+	}
+
+	callbackID, err := tb.fake.Click(telebot.User{ID: 42, Username: "alice"}, 42, question.ID, "Yes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every subscriber is told who answered, and the buttons are removed
+	for _, chatID := range []int64{42, 43} {
+		messages := tb.waitForMessages(t, chatID, 2)
+		if messages[0].ReplyMarkup != nil {
+			t.Fatalf("buttons not removed in chat %d", chatID)
+		}
+		if messages[1].Text != "Answered by @alice:\n\nYes" || messages[1].ReplyTo == nil || messages[1].ReplyTo.ID != messages[0].ID {
+			t.Fatalf("unexpected reply in chat %d: %+v", chatID, messages[1])
+		}
+	}
+
+	data, err := tb.questions.GetQuestionData(ctx, questionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !data.IsAnswered() || *data.AnswererID != 42 || *data.AnswerData != "y" {
+		t.Fatalf("answer not stored: %+v", data)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, answered := tb.fake.CallbackAnswer(callbackID)
+		if answered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("callback not answered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCommandFromUnknownUser(t *testing.T) {
+	tb := newTestBot(t)
+
+	_, err := tb.fake.SendText(telebot.User{ID: 99, FirstName: "Stranger"}, "/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply := tb.waitForMessages(t, 99, 2)[1]
+	if reply.Text != insufficentPermissionMessage {
+		t.Fatalf("unexpected reply: %q", reply.Text)
+	}
+}
+
+func TestListChannels(t *testing.T) {
+	tb := newTestBot(t)
+	tb.addUser(42, "alice")
+	tb.store.channels = []db.Channel{{Name: "deploys", Description: "Deployment approvals"}}
+
+	_, err := tb.fake.SendText(telebot.User{ID: 42, Username: "alice"}, "/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply := tb.waitForMessages(t, 42, 2)[1]
+	if !strings.Contains(reply.Text, "- deploys - Deployment approvals") {
+		t.Fatalf("unexpected reply: %q", reply.Text)
+	}
+}
+
+func TestEditChannelIconMustBeEmoji(t *testing.T) {
+	tb := newTestBot(t)
+	admin := true
+	tb.addUser(42, "alice").Admin = &admin
+
+	// the fake store panics if the channel is written
+	_, err := tb.fake.SendText(telebot.User{ID: 42, Username: "alice"}, "/editchan deploys icon ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply := tb.waitForMessages(t, 42, 2)[1]
+	if reply.Text != "The icon must be a single emoji!" {
+		t.Fatalf("unexpected reply: %q", reply.Text)
+	}
+}
+
+func TestStopInWebhookMode(t *testing.T) {
+	tb := newTestBotWithConfig(t, func(cfg *config.Telegram) {
+		cfg.UpdatesMode = config.UpdatesModeWebhook
+		cfg.Webhook.PublicURL = "https://bot.example.com/"
+		cfg.Webhook.Bind = "127.0.0.1:0"
+	}, nil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for tb.fake.WebhookURL() == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("webhook not set")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tb.stop()
+	select {
+	case <-tb.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("bot not stopped")
+	}
+}
+
+func TestStopCancelsLongPoll(t *testing.T) {
+	tb := newTestBotWithConfig(t, func(cfg *config.Telegram) {
+		cfg.PollingTimeout = config.Duration(time.Hour)
+	}, nil)
+	tb.addUser(42, "alice")
+
+	// the poller is waiting for updates once this is handled
+	_, err := tb.fake.SendText(telebot.User{ID: 42, Username: "alice"}, "/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb.waitForMessages(t, 42, 2)
+
+	tb.stop()
+	select {
+	case <-tb.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("bot not stopped")
+	}
+}
+
+func TestStopWaitsForHandlers(t *testing.T) {
+	tb := newTestBot(t)
+	tb.addUser(42, "alice")
+	tb.store.blocked = make(chan struct{})
+	tb.store.blockAt = make(chan struct{})
+
+	_, err := tb.fake.SendText(telebot.User{ID: 42, Username: "alice"}, "/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-tb.store.blocked // the handler has no way to reply until it is unblocked
+
+	tb.stop()
+	select {
+	case <-tb.stopped:
+		t.Fatal("stopped while a handler was running")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(tb.store.blockAt)
+	select {
+	case <-tb.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("bot not stopped")
+	}
+	tb.waitForMessages(t, 42, 2)
+}
+
+// failingMessenger fails to close questions, everything else is done by the wrapped messenger
+type failingMessenger struct {
+	Messenger
+}
+
+func (f *failingMessenger) CloseQuestion(context.Context, []memdb.StoredMessage, string) error {
+	return errors.New("telegram is down")
+}
+
+func TestCallbackAnsweredWhenClosingFails(t *testing.T) {
+	tb := newTestBotWithConfig(t, func(cfg *config.Telegram) {}, func(b *Bot) {
+		b.messenger = &failingMessenger{Messenger: b}
+	})
+	alice := tb.addUser(42, "alice")
+
+	channel := &db.Channel{Name: "deploys", Subscribers: []*db.User{alice}}
+	questionID, err := tb.bot.SendQuestion(context.Background(), 7, channel, "Deploy?", []memdb.QuestionOption{{Data: "y", Label: "Yes"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	question := tb.waitForMessages(t, 42, 1)[0]
+
+	callbackID, err := tb.fake.Click(telebot.User{ID: 42, Username: "alice"}, 42, question.ID, "Yes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, answered := tb.fake.CallbackAnswer(callbackID)
+		if answered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("callback not answered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the answer is stored, even though the messages could not be updated
+	data, err := tb.questions.GetQuestionData(context.Background(), questionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !data.IsAnswered() || len(tb.fake.Messages(42)) != 1 || tb.fake.Messages(42)[0].ReplyMarkup == nil {
+		t.Fatalf("unexpected state: %+v %+v", data, tb.fake.Messages(42))
+	}
+}
+
+func TestDeleteMessagesAlreadyDeleted(t *testing.T) {
+	tb := newTestBot(t)
+	alice := tb.addUser(42, "alice")
+	bob := tb.addUser(43, "bob")
+	carol := tb.addUser(44, "carol")
+
+	channel := &db.Channel{Name: "deploys", Subscribers: []*db.User{alice, bob, carol}}
+	sent, err := tb.bot.SendToSubscribers(context.Background(), channel, "Deploying")
+	if err != nil || len(sent) != 3 {
+		t.Fatalf("sending failed: %d %v", len(sent), err)
+	}
+
+	// the message of bob is deleted already, that does not stop deleting the rest
+	err = tb.bot.DeleteMessages(context.Background(), sent[1:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tb.bot.DeleteMessages(context.Background(), []memdb.StoredMessage{sent[1], sent[0], sent[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chatID := range []int64{42, 43, 44} {
+		if len(tb.fake.Messages(chatID)) != 0 {
+			t.Fatalf("message not deleted in chat %d", chatID)
+		}
+	}
+}
@@ -1,19 +1,23 @@
 package telegram
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/marcsello/marcsellocorp-bot/common"
 	"github.com/marcsello/marcsellocorp-bot/db"
 	"github.com/marcsello/marcsellocorp-bot/memdb"
+	"github.com/marcsello/marcsellocorp-bot/metrics"
 	"github.com/marcsello/marcsellocorp-bot/utils"
+	"github.com/redis/go-redis/v9"
+	"github.com/robfig/cron/v3"
 	"gopkg.in/telebot.v3"
 	"gorm.io/gorm"
-	"log"
+	"html"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func cmdStart(ctx telebot.Context) error {
@@ -31,11 +35,11 @@ func cmdId(ctx telebot.Context) error {
 	return ctx.Reply(text, telebot.ModeDefault)
 }
 
-func cmdWhoami(ctx telebot.Context) error {
+func (b *Bot) cmdWhoami(ctx telebot.Context) error {
 
 	var err error
 	var user *db.User
-	user, err = db.GetUserById(ctx.Sender().ID)
+	user, err = b.store.GetUserById(updateContext(ctx), ctx.Sender().ID)
 	if err != nil {
 		if !errors.Is(err, gorm.ErrRecordNotFound) {
 			return err
@@ -55,7 +59,7 @@ func cmdWhoami(ctx telebot.Context) error {
 	}
 }
 
-func subscriptionChanging(ctx telebot.Context, state bool) error {
+func (b *Bot) subscriptionChanging(ctx telebot.Context, state bool) error {
 
 	if len(ctx.Args()) != 1 {
 		return ctx.Reply("wrong arguments: /whatever <Channel ID>", telebot.ModeDefault)
@@ -63,7 +67,7 @@ func subscriptionChanging(ctx telebot.Context, state bool) error {
 
 	chName := ctx.Args()[0]
 
-	ch, err := db.GetChannelByName(chName)
+	ch, err := b.store.GetChannelByName(updateContext(ctx), chName)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return ctx.Reply("channel not found", telebot.ModeDefault)
@@ -72,7 +76,7 @@ func subscriptionChanging(ctx telebot.Context, state bool) error {
 	}
 
 	var changed bool
-	changed, err = db.ChangeSubscription(ctx.Chat().ID, ch.ID, state)
+	changed, err = b.store.ChangeSubscription(ctx.Chat().ID, ch.ID, state)
 	if err != nil {
 		return err
 	}
@@ -96,21 +100,21 @@ func subscriptionChanging(ctx telebot.Context, state bool) error {
 
 }
 
-func cmdSubscribe(ctx telebot.Context) error {
-	return subscriptionChanging(ctx, true)
+func (b *Bot) cmdSubscribe(ctx telebot.Context) error {
+	return b.subscriptionChanging(ctx, true)
 }
 
-func cmdUnsubscribe(ctx telebot.Context) error {
-	return subscriptionChanging(ctx, false)
+func (b *Bot) cmdUnsubscribe(ctx telebot.Context) error {
+	return b.subscriptionChanging(ctx, false)
 }
 
-func cmdList(ctx telebot.Context) error {
+func (b *Bot) cmdList(ctx telebot.Context) error {
 	user := getUserFromContext(ctx)
 	if user == nil {
 		return fmt.Errorf("could not get user")
 	}
 
-	channels, err := db.GetAllChannels()
+	channels, err := b.store.GetAllChannels()
 	if err != nil {
 		return err
 	}
@@ -126,114 +130,873 @@ func cmdList(ctx telebot.Context) error {
 			}
 		}
 
-		msg += fmt.Sprintf(" %s %s\n", prefix, ch.Name)
+		msg += fmt.Sprintf(" %s %s", prefix, ch.DisplayName())
+		if ch.Description != "" {
+			msg += " - " + ch.Description
+		}
+		msg += "\n"
+	}
+
+	msg += "\nUse /info <Channel name> for details."
+
+	return ctx.Reply(msg, telebot.ModeDefault)
+
+}
+
+func (b *Bot) cmdInfo(ctx telebot.Context) error {
+	if len(ctx.Args()) != 1 {
+		return ctx.Reply("Usage: /info <Channel name>", telebot.ModeDefault)
+	}
+
+	chName := strings.TrimSpace(ctx.Args()[0])
+
+	if !utils.IsValidChannelName(chName) {
+		return ctx.Reply("Invalid channel name!", telebot.ModeDefault)
+	}
+
+	ch, tokens, err := b.store.GetChannelInfoByName(chName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Channel not found!", telebot.ModeDefault)
+		}
+		return err
+	}
+
+	description := "<i>No description</i>"
+	if ch.Description != "" {
+		description = html.EscapeString(ch.Description)
+	}
+
+	ownerContact := "<i>Unknown</i>"
+	if ch.OwnerContact != "" {
+		ownerContact = html.EscapeString(ch.OwnerContact)
+	}
+
+	creator := "<i>Unknown</i>"
+	if ch.Creator != nil {
+		creator = html.EscapeString(ch.Creator.Greet())
+	}
+
+	lastActivityStr := "Never"
+	if ch.LastActivity != nil {
+		lastActivityStr = ch.LastActivity.Format("2006-01-02 15:04:05")
+	}
+
+	var allowedTokensStr string
+	if len(tokens) > 0 {
+		allowedTokensStr = "\n"
+		for _, token := range tokens {
+			allowedTokensStr += "    - " + token.Name + "\n"
+		}
+	} else {
+		allowedTokensStr = " <i>NONE!</i>\n"
+	}
+
+	msg := fmt.Sprintf("<b>%s</b>\n%s\n\n<b>owner contact</b>: %s\n<b>default priority</b>: %s\n<b>created</b>: %s by %s\n<b>subscribers</b>: %d\n<b>last activity</b>: %s\n<b>rate limit</b>: %s\n<b>allowed tokens</b>:%s",
+		html.EscapeString(ch.DisplayName()),
+		description,
+		ownerContact,
+		ch.DefaultPriority,
+		ch.CreatedAt.Format("2006-01-02 15:04:05"),
+		creator,
+		len(ch.Subscribers),
+		lastActivityStr,
+		formatLimit(ch.RateLimit, "/min", ch.RateBurst),
+		allowedTokensStr,
+	)
+
+	return ctx.Reply(msg, telebot.ModeHTML)
+}
+
+func (b *Bot) cmdMakeChannel(ctx telebot.Context) error {
+	user := getUserFromContext(ctx)
+	if user == nil {
+		return fmt.Errorf("could not get user")
+	}
+
+	if len(ctx.Args()) != 1 {
+		return ctx.Reply("Usage: /mkchan <Channel name>", telebot.ModeDefault)
+	}
+
+	chName := strings.TrimSpace(ctx.Args()[0])
+
+	if !utils.IsValidChannelName(chName) {
+		return ctx.Reply("Invalid channel name!", telebot.ModeDefault)
+	}
+
+	newChan := db.Channel{
+		Name:    chName,
+		Creator: user,
+	}
+	_, err := b.store.CreateChannel(&newChan)
+
+	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return ctx.Reply("Channel name already used by a current or archived channel!\nArchived channels can be restored with /restorechan, or purged with /purgechan to reuse their name.", telebot.ModeDefault)
+		}
+		return err
+	}
+
+	logger.InfoContext(updateContext(ctx), "Channel created", "sender", ctx.Sender().ID, "channel", chName)
+	return ctx.Reply("Channel created!", telebot.ModeDefault)
+
+}
+
+func (b *Bot) cmdEditChannel(ctx telebot.Context) error {
+	// field names accepted from the user mapped to column names
+	fields := map[string]string{
+		"description": "description",
+		"icon":        "icon",
+		"priority":    "default_priority",
+		"contact":     "owner_contact",
+	}
+	// maximum lengths, as declared in the model
+	maxLengths := map[string]int{
+		"description": 256,
+		"icon":        16,
+		"contact":     128,
+	}
+
+	args, value, ok := splitPayload(ctx.Message().Payload, 2)
+	if !ok || value == "" {
+		return ctx.Reply("Usage: /editchan <Channel name> <description|icon|priority|contact> <Value>\nUse - as value to clear a field.\nValid priorities: "+strings.Join(db.ValidPriorities, ", "), telebot.ModeDefault)
+	}
+
+	chName := args[0]
+	if !utils.IsValidChannelName(chName) {
+		return ctx.Reply("Invalid channel name!", telebot.ModeDefault)
+	}
+
+	field := args[1]
+	column, ok := fields[field]
+	if !ok {
+		return ctx.Reply("Invalid field: "+field+"!", telebot.ModeDefault)
+	}
+
+	if value == "-" {
+		value = ""
+	}
+
+	if field == "priority" {
+		if value == "" {
+			value = db.PriorityNormal
+		}
+		if !slices.Contains(db.ValidPriorities, value) {
+			return ctx.Reply("Invalid priority: "+value+"!", telebot.ModeDefault)
+		}
+	} else if len(value) > maxLengths[field] {
+		return ctx.Reply(fmt.Sprintf("Value too long, maximum is %d bytes!", maxLengths[field]), telebot.ModeDefault)
+	} else if field == "icon" && value != "" && !utils.IsSingleEmoji(value) {
+		return ctx.Reply("The icon must be a single emoji!", telebot.ModeDefault)
+	}
+
+	err := b.store.UpdateChannelMetadata(chName, column, value)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Channel not found!", telebot.ModeDefault)
+		}
+		return err
+	}
+
+	logger.InfoContext(updateContext(ctx), "Channel edited", "sender", ctx.Sender().ID, "channel", chName, "field", field)
+	return ctx.Reply("Channel "+chName+" updated!", telebot.ModeDefault)
+}
+
+func (b *Bot) cmdRenameChannel(ctx telebot.Context) error {
+	if len(ctx.Args()) != 2 {
+		return ctx.Reply("Usage: /renamechan <Channel name> <New channel name>", telebot.ModeDefault)
+	}
+
+	chName := strings.TrimSpace(ctx.Args()[0])
+	newChName := strings.TrimSpace(ctx.Args()[1])
+
+	if !utils.IsValidChannelName(chName) || !utils.IsValidChannelName(newChName) {
+		return ctx.Reply("Invalid channel name!", telebot.ModeDefault)
+	}
+
+	err := b.store.RenameChannel(db.UserActor(ctx.Sender().ID), chName, newChName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Channel not found!")
+		}
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return ctx.Reply("Channel name already used by a current or archived channel!", telebot.ModeDefault)
+		}
+		return err
+	}
+
+	logger.InfoContext(updateContext(ctx), "Channel renamed", "sender", ctx.Sender().ID, "channel", chName, "new_name", newChName)
+	return ctx.Reply("Channel "+chName+" renamed to "+newChName+"!", telebot.ModeDefault)
+}
+
+func (b *Bot) cmdArchiveChannel(ctx telebot.Context) error {
+	if len(ctx.Args()) != 1 {
+		return ctx.Reply("Usage: /archivechan <Channel name>", telebot.ModeDefault)
+	}
+
+	chName := strings.TrimSpace(ctx.Args()[0])
+
+	if !utils.IsValidChannelName(chName) {
+		return ctx.Reply("Invalid channel name!", telebot.ModeDefault)
+	}
+
+	err := b.store.ArchiveChannelByName(db.UserActor(ctx.Sender().ID), chName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Channel not found!")
+		}
+		return err
+	}
+
+	logger.InfoContext(updateContext(ctx), "Channel archived", "sender", ctx.Sender().ID, "channel", chName)
+	return ctx.Reply("Channel "+chName+" archived!\nIt can be restored with /restorechan", telebot.ModeDefault)
+}
+
+func (b *Bot) cmdRestoreChannel(ctx telebot.Context) error {
+	if len(ctx.Args()) != 1 {
+		return ctx.Reply("Usage: /restorechan <Channel name>", telebot.ModeDefault)
+	}
+
+	chName := strings.TrimSpace(ctx.Args()[0])
+
+	if !utils.IsValidChannelName(chName) {
+		return ctx.Reply("Invalid channel name!", telebot.ModeDefault)
+	}
+
+	err := b.store.RestoreChannelByName(db.UserActor(ctx.Sender().ID), chName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Archived channel not found!")
+		}
+		return err
+	}
+
+	logger.InfoContext(updateContext(ctx), "Channel restored", "sender", ctx.Sender().ID, "channel", chName)
+	return ctx.Reply("Channel "+chName+" restored!", telebot.ModeDefault)
+}
+
+func (b *Bot) cmdSetChannelLimits(ctx telebot.Context) error {
+	if len(ctx.Args()) != 3 {
+		return ctx.Reply("Usage: /setchanlimits <Channel name> <Messages per minute> <Burst>\nUse 0 for unlimited.", telebot.ModeDefault)
+	}
+
+	chName := strings.TrimSpace(ctx.Args()[0])
+
+	if !utils.IsValidChannelName(chName) {
+		return ctx.Reply("Invalid channel name!", telebot.ModeDefault)
+	}
+
+	limits, err := parseLimits(ctx.Args()[1:])
+	if err != nil {
+		return ctx.Reply(err.Error(), telebot.ModeDefault)
+	}
+
+	err = b.store.SetChannelLimits(db.UserActor(ctx.Sender().ID), chName, limits[0], limits[1])
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Channel not found!")
+		}
+		return err
+	}
+
+	logger.InfoContext(updateContext(ctx), "Channel limits changed", "sender", ctx.Sender().ID, "channel", chName)
+	return ctx.Reply("Rate limit of "+chName+" set to "+formatLimit(limits[0], "/min", limits[1]), telebot.ModeDefault)
+}
+
+func (b *Bot) cmdPurgeChannel(ctx telebot.Context) error {
+	if len(ctx.Args()) != 1 && len(ctx.Args()) != 2 {
+		return ctx.Reply("Usage: /purgechan <Channel name> [Confirmation code]", telebot.ModeDefault)
+	}
+
+	chName := strings.TrimSpace(ctx.Args()[0])
+
+	if !utils.IsValidChannelName(chName) {
+		return ctx.Reply("Invalid channel name!", telebot.ModeDefault)
+	}
+
+	// confirmation codes are bound to the admin and the channel
+	action := fmt.Sprintf("purgechan_%d_%s", ctx.Sender().ID, chName)
+
+	if len(ctx.Args()) == 1 {
+		code, err := b.questions.BeginConfirmation(updateContext(ctx), action)
+		if err != nil {
+			return err
+		}
+		msg := fmt.Sprintf("<b>This permanently deletes the archived channel %s along with its subscriptions and token grants!</b>\nTo confirm, send within 5 minutes:\n<pre>/purgechan %s %s</pre>", chName, chName, html.EscapeString(code))
+		return ctx.Reply(msg, telebot.ModeHTML)
+	}
+
+	confirmed, err := b.questions.ConfirmAction(updateContext(ctx), action, strings.TrimSpace(ctx.Args()[1]))
+	if err != nil {
+		return err
+	}
+	if !confirmed {
+		return ctx.Reply("Invalid or expired confirmation code!", telebot.ModeDefault)
+	}
+
+	err = b.store.PurgeChannelByName(db.UserActor(ctx.Sender().ID), chName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Archived channel not found! Channels must be archived before purging.")
+		}
+		return err
+	}
+
+	logger.InfoContext(updateContext(ctx), "Channel purged", "sender", ctx.Sender().ID, "channel", chName)
+	return ctx.Reply("Channel "+chName+" purged!", telebot.ModeDefault)
+}
+
+func (b *Bot) cmdAuditLog(ctx telebot.Context) error {
+	const defaultLimit = 20
+	const maxLimit = 100
+
+	limit := defaultLimit
+	if len(ctx.Args()) == 1 {
+		var err error
+		limit, err = strconv.Atoi(ctx.Args()[0])
+		if err != nil || limit < 1 || limit > maxLimit {
+			return ctx.Reply(fmt.Sprintf("Usage: /auditlog [Number of entries, max %d]", maxLimit), telebot.ModeDefault)
+		}
+	}
+
+	entries, err := b.store.GetLatestAuditLogEntries(limit)
+	if err != nil {
+		return err
+	}
+
+	msg := "Latest audit log entries:\n"
+	for _, entry := range entries {
+		actor := "<i>system</i>"
+		if entry.Actor != nil {
+			actor = html.EscapeString(entry.Actor.Greet())
+		} else if entry.ActorID != nil {
+			actor = strconv.FormatInt(*entry.ActorID, 10)
+		} else if entry.ActorTokenID != nil {
+			actor = fmt.Sprintf("token #%d", *entry.ActorTokenID)
+		}
+
+		msg += fmt.Sprintf("- %s <b>%s</b> %s by %s", entry.CreatedAt.Format("2006-01-02 15:04:05"), entry.Action, html.EscapeString(entry.Subject), actor)
+		if entry.Details != "" {
+			msg += " (" + html.EscapeString(entry.Details) + ")"
+		}
+		msg += "\n"
+	}
+
+	return ctx.Reply(msg, telebot.ModeHTML)
+}
+
+func (b *Bot) cmdListTokens(ctx telebot.Context) error {
+
+	tokens, err := b.store.GetAllTokens()
+	if err != nil {
+		return err
+	}
+
+	msg := "Currently active tokens:\n"
+	for _, token := range tokens {
+
+		var grantsStr string
+		if len(token.Grants) > 0 {
+			grantsStr = "\n"
+			for _, grant := range token.Grants {
+				grantsStr += "    - " + grant.ChannelPattern + ": " + strings.ReplaceAll(grant.Capabilities, ",", ", ") + "\n"
+			}
+		} else {
+			grantsStr = " <i>NONE!</i>\n"
+		}
+
+		globalCapsStr := "<i>NONE</i>"
+		if token.GlobalCapabilities != "" {
+			globalCapsStr = strings.ReplaceAll(token.GlobalCapabilities, ",", ", ")
+		}
+
+		lastUsedStr := "Never"
+		if token.LastUsed != nil {
+			lastUsedStr = token.LastUsed.Format("2006-01-02 15:04:05")
+			if token.LastSourceIP != "" {
+				lastUsedStr += " from " + token.LastSourceIP
+			}
+		}
+
+		allowedFromStr := "Anywhere"
+		if token.AllowedCIDRs != "" {
+			allowedFromStr = strings.ReplaceAll(token.AllowedCIDRs, ",", ", ")
+		}
+
+		expiresStr := "Never"
+		if token.ExpiresAt != nil {
+			expiresStr = token.ExpiresAt.Format("2006-01-02 15:04:05")
+			if token.IsExpired() {
+				expiresStr += " <i>EXPIRED!</i>"
+			}
+		}
+
+		msg += fmt.Sprintf("- %s\n  <b>created</b>: %s\n  <b>last used</b>: %s\n  <b>expires</b>: %s\n  <b>auth</b>: %s\n  <b>allowed from</b>: %s\n  <b>rate limit</b>: %s\n  <b>daily quota</b>: %s\n  <b>grants</b>:%s  <b>global capabilities</b>: %s\n\n",
+			token.Name,
+			token.CreatedAt.Format("2006-01-02 15:04:05"),
+			lastUsedStr,
+			expiresStr,
+			token.AuthScheme,
+			allowedFromStr,
+			formatLimit(token.RateLimit, "/min", token.RateBurst),
+			formatLimit(token.DailyQuota, "", 0),
+			grantsStr,
+			globalCapsStr,
+		)
+	}
+
+	return ctx.Reply(msg, telebot.ModeHTML)
+}
+
+func capabilitiesHelp() string {
+	return "Channel capabilities: " + db.JoinCapabilities(db.ChannelCapabilities) + "\nGlobal capabilities: " + db.JoinCapabilities(db.GlobalCapabilities)
+}
+
+// parseCapabilities validates a comma separated list of capabilities, "-" means none. The returned error can be shown to the user
+func parseCapabilities(arg string, valid []db.Capability) ([]db.Capability, error) {
+	if arg == "-" {
+		return nil, nil
+	}
+	caps, err := db.ParseCapabilities(strings.Split(arg, ","), valid)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid capabilities, %w!", err)
+	}
+	return caps, nil
+}
+
+// parseChannelPatterns validates a comma separated list of channel names or patterns, "-" means none. The returned error can be shown to the user
+func parseChannelPatterns(arg string) ([]string, error) {
+	if arg == "-" {
+		return nil, nil
+	}
+	patterns := strings.Split(arg, ",")
+	for _, p := range patterns {
+		if !utils.IsValidChannelPattern(p) {
+			return nil, fmt.Errorf("Invalid channel name or pattern: %s!", p)
+		}
+	}
+	return patterns, nil
+}
+
+func makeGrants(patterns []string, caps []db.Capability) []db.TokenGrant {
+	grants := make([]db.TokenGrant, len(patterns))
+	for i, p := range patterns {
+		grants[i] = db.TokenGrant{
+			ChannelPattern: p,
+			Capabilities:   db.JoinCapabilities(caps),
+		}
+	}
+	return grants
+}
+
+func (b *Bot) cmdMakeToken(ctx telebot.Context) error {
+	if len(ctx.Args()) != 3 && len(ctx.Args()) != 4 {
+		return ctx.Reply("Usage: /mktoken <Token name> <Allowed channels or patterns like build*, comma separated, or -> <Capabilities comma separated> [Validity, like 90d or 12h]\n"+capabilitiesHelp(), telebot.ModeDefault)
+	}
+
+	tName := strings.TrimSpace(ctx.Args()[0])
+
+	if !utils.IsValidTokenName(tName) {
+		return ctx.Reply("Invalid token name!", telebot.ModeDefault)
+	}
+
+	patterns, err := parseChannelPatterns(ctx.Args()[1])
+	if err != nil {
+		return ctx.Reply(err.Error(), telebot.ModeDefault)
+	}
+
+	var caps []db.Capability
+	caps, err = parseCapabilities(ctx.Args()[2], db.AllCapabilities)
+	if err != nil {
+		return ctx.Reply(err.Error(), telebot.ModeDefault)
+	}
+
+	var channelCaps, globalCaps []db.Capability
+	for _, c := range caps {
+		if slices.Contains(db.GlobalCapabilities, c) {
+			globalCaps = append(globalCaps, c)
+		} else {
+			channelCaps = append(channelCaps, c)
+		}
+	}
+	if len(patterns) > 0 && len(channelCaps) == 0 {
+		return ctx.Reply("Please set at least one channel capability!", telebot.ModeDefault)
+	}
+	if len(patterns) == 0 && len(globalCaps) == 0 {
+		return ctx.Reply("Please set at least one capability!", telebot.ModeDefault)
+	}
+
+	var expiresAt *time.Time
+	if len(ctx.Args()) == 4 {
+		expiresAt, err = parseValidity(ctx.Args()[3])
+		if err != nil {
+			return ctx.Reply("Invalid validity: "+err.Error(), telebot.ModeDefault)
+		}
+	}
+
+	var newTokenStr string
+	newTokenStr, err = utils.GenerateRandomString(48)
+	if err != nil {
+		return err
+	}
+
+	creatorId := ctx.Sender().ID
+	newToken := db.Token{
+		Name:               tName,
+		LastUsed:           nil,
+		TokenHash:          utils.TokenHash(newTokenStr),
+		ExpiresAt:          expiresAt,
+		CreatorID:          &creatorId,
+		GlobalCapabilities: db.JoinCapabilities(globalCaps),
+	}
+
+	_, err = b.store.CreateToken(&newToken, makeGrants(patterns, channelCaps))
+	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return ctx.Reply("This name is already in use!", telebot.ModeDefault)
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Channel not found!", telebot.ModeDefault)
+		}
+		return err
+	}
+	message := fmt.Sprintf("<b>New token created!</b>\n<b>Name</b>: %s\n<b>Token</b>: <pre>%s</pre>\n\n<i>Keep this token a secret, delete this message if possible!</i>", tName, newTokenStr)
+
+	logger.InfoContext(updateContext(ctx), "Token created", "sender", ctx.Sender().ID, "token", tName)
+	return ctx.Reply(message, telebot.ModeHTML)
+}
+
+func (b *Bot) cmdRotateToken(ctx telebot.Context) error {
+	if len(ctx.Args()) != 1 && len(ctx.Args()) != 2 {
+		return ctx.Reply("Usage: /rotatetoken <Token name> [New validity, like 90d or 12h, or never]\nThe expiry is not changed if the validity is omitted.", telebot.ModeDefault)
+	}
+
+	tName := strings.TrimSpace(ctx.Args()[0])
+
+	if !utils.IsValidTokenName(tName) {
+		return ctx.Reply("Invalid token name!", telebot.ModeDefault)
+	}
+
+	var expiresAt *time.Time
+	updateExpiry := len(ctx.Args()) == 2
+	if updateExpiry {
+		var err error
+		expiresAt, err = parseValidity(ctx.Args()[1])
+		if err != nil {
+			return ctx.Reply("Invalid validity: "+err.Error(), telebot.ModeDefault)
+		}
+	}
+
+	newTokenStr, err := utils.GenerateRandomString(48)
+	if err != nil {
+		return err
+	}
+	var newHmacSecret string
+	newHmacSecret, err = utils.GenerateRandomString(48)
+	if err != nil {
+		return err
+	}
+
+	var hmacRotated bool
+	hmacRotated, err = b.store.RotateToken(db.UserActor(ctx.Sender().ID), tName, utils.TokenHash(newTokenStr), newHmacSecret, b.rotationGrace, updateExpiry, expiresAt)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Token not found: " + tName + "!")
+		}
+		return err
+	}
+
+	secrets := fmt.Sprintf("<b>Token</b>: <pre>%s</pre>", newTokenStr)
+	if hmacRotated {
+		secrets += fmt.Sprintf("\n<b>HMAC secret</b>: <pre>%s</pre>", newHmacSecret)
+	}
+	message := fmt.Sprintf("<b>Token rotated!</b>\n<b>Name</b>: %s\n%s\n\nThe previous secrets remain valid for %s.\n\n<i>Keep these secrets, delete this message if possible!</i>", tName, secrets, b.rotationGrace)
+
+	logger.InfoContext(updateContext(ctx), "Token rotated", "sender", ctx.Sender().ID, "token", tName)
+	return ctx.Reply(message, telebot.ModeHTML)
+}
+
+func (b *Bot) cmdGrantToken(ctx telebot.Context) error {
+	if len(ctx.Args()) != 3 {
+		return ctx.Reply("Usage: /granttoken <Token name> <Channels or patterns like build*, comma separated> <Capabilities comma separated>\nExisting grants for the same channels or patterns are replaced.\n"+capabilitiesHelp(), telebot.ModeDefault)
+	}
+
+	tName := strings.TrimSpace(ctx.Args()[0])
+
+	if !utils.IsValidTokenName(tName) {
+		return ctx.Reply("Invalid token name!", telebot.ModeDefault)
+	}
+
+	patterns, err := parseChannelPatterns(ctx.Args()[1])
+	if err != nil {
+		return ctx.Reply(err.Error(), telebot.ModeDefault)
+	}
+	if len(patterns) == 0 {
+		return ctx.Reply("Please set at least one channel!", telebot.ModeDefault)
+	}
+
+	var caps []db.Capability
+	caps, err = parseCapabilities(ctx.Args()[2], db.ChannelCapabilities)
+	if err != nil {
+		return ctx.Reply(err.Error(), telebot.ModeDefault)
+	}
+	if len(caps) == 0 {
+		return ctx.Reply("Please set at least one capability! Use /revoketoken to remove grants.", telebot.ModeDefault)
+	}
+
+	err = b.store.SetTokenGrants(db.UserActor(ctx.Sender().ID), tName, makeGrants(patterns, caps))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Token or channel not found!", telebot.ModeDefault)
+		}
+		return err
 	}
 
-	return ctx.Reply(msg, telebot.ModeDefault)
+	logger.InfoContext(updateContext(ctx), "Token grants changed", "sender", ctx.Sender().ID, "token", tName)
+	return ctx.Reply("Channels granted to "+tName, telebot.ModeDefault)
+}
+
+func (b *Bot) cmdRevokeToken(ctx telebot.Context) error {
+	if len(ctx.Args()) != 2 {
+		return ctx.Reply("Usage: /revoketoken <Token name> <Channels or patterns comma separated>\nOnly grants with exactly matching channel or pattern are removed.", telebot.ModeDefault)
+	}
+
+	tName := strings.TrimSpace(ctx.Args()[0])
+
+	if !utils.IsValidTokenName(tName) {
+		return ctx.Reply("Invalid token name!", telebot.ModeDefault)
+	}
+
+	patterns, err := parseChannelPatterns(ctx.Args()[1])
+	if err != nil {
+		return ctx.Reply(err.Error(), telebot.ModeDefault)
+	}
+	if len(patterns) == 0 {
+		return ctx.Reply("Please set at least one channel!", telebot.ModeDefault)
+	}
+
+	err = b.store.RevokeTokenGrants(db.UserActor(ctx.Sender().ID), tName, patterns)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Token or grant not found!", telebot.ModeDefault)
+		}
+		return err
+	}
 
+	logger.InfoContext(updateContext(ctx), "Token grants revoked", "sender", ctx.Sender().ID, "token", tName)
+	return ctx.Reply("Channels revoked from "+tName, telebot.ModeDefault)
 }
 
-func cmdMakeChannel(ctx telebot.Context) error {
-	user := getUserFromContext(ctx)
-	if user == nil {
-		return fmt.Errorf("could not get user")
+func (b *Bot) cmdSetTokenCaps(ctx telebot.Context) error {
+	if len(ctx.Args()) != 2 {
+		return ctx.Reply("Usage: /settokencaps <Token name> <Global capabilities comma separated, or ->\nCapabilities not listed are removed, use /granttoken for channel capabilities.\n"+capabilitiesHelp(), telebot.ModeDefault)
 	}
 
-	if len(ctx.Args()) != 1 {
-		return ctx.Reply("Usage: /mkchan <Channel name>", telebot.ModeDefault)
+	tName := strings.TrimSpace(ctx.Args()[0])
+
+	if !utils.IsValidTokenName(tName) {
+		return ctx.Reply("Invalid token name!", telebot.ModeDefault)
 	}
 
-	chName := strings.TrimSpace(ctx.Args()[0])
+	caps, err := parseCapabilities(ctx.Args()[1], db.GlobalCapabilities)
+	if err != nil {
+		return ctx.Reply(err.Error(), telebot.ModeDefault)
+	}
 
-	if !utils.IsValidChannelName(chName) {
-		return ctx.Reply("Invalid channel name!", telebot.ModeDefault)
+	err = b.store.SetTokenGlobalCapabilities(db.UserActor(ctx.Sender().ID), tName, caps)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Token not found: " + tName + "!")
+		}
+		return err
 	}
 
-	newChan := db.Channel{
-		Name:    chName,
-		Creator: user,
+	logger.InfoContext(updateContext(ctx), "Token capabilities changed", "sender", ctx.Sender().ID, "token", tName)
+	return ctx.Reply("Capabilities of "+tName+" updated!", telebot.ModeDefault)
+}
+
+func (b *Bot) cmdSetTokenIPs(ctx telebot.Context) error {
+	if len(ctx.Args()) != 2 {
+		return ctx.Reply("Usage: /settokenips <Token name> <Addresses or CIDRs comma separated, or - to allow anywhere>", telebot.ModeDefault)
+	}
+
+	tName := strings.TrimSpace(ctx.Args()[0])
+
+	if !utils.IsValidTokenName(tName) {
+		return ctx.Reply("Invalid token name!", telebot.ModeDefault)
+	}
+
+	var cidrs string
+	if arg := strings.TrimSpace(ctx.Args()[1]); arg != "-" {
+		prefixes, err := utils.ParseCIDRList(arg)
+		if err != nil {
+			return ctx.Reply(err.Error(), telebot.ModeDefault)
+		}
+		cidrs = utils.JoinCIDRList(prefixes)
 	}
-	_, err := db.CreateChannel(&newChan)
 
+	err := b.store.SetTokenAllowedCIDRs(db.UserActor(ctx.Sender().ID), tName, cidrs)
 	if err != nil {
-		if errors.Is(err, gorm.ErrDuplicatedKey) {
-			return ctx.Reply("Channel name already used by current or past channels!\nChannels may not be re-created for security reasons.", telebot.ModeDefault)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Token not found: " + tName + "!")
 		}
 		return err
 	}
 
-	log.Println("BOT: Channel created: ", ctx.Sender().ID, " -- c:", chName)
-	return ctx.Reply("Channel created!", telebot.ModeDefault)
+	logger.InfoContext(updateContext(ctx), "Token allowed sources changed", "sender", ctx.Sender().ID, "token", tName, "cidrs", cidrs)
+	if cidrs == "" {
+		return ctx.Reply("Token "+tName+" can be used from anywhere!", telebot.ModeDefault)
+	}
+	return ctx.Reply("Token "+tName+" can only be used from: "+strings.ReplaceAll(cidrs, ",", ", "), telebot.ModeDefault)
+}
+
+func (b *Bot) cmdSetTokenLimits(ctx telebot.Context) error {
+	if len(ctx.Args()) != 4 {
+		return ctx.Reply("Usage: /settokenlimits <Token name> <Messages per minute> <Burst> <Daily quota>\nUse 0 for unlimited, the daily quota resets at midnight UTC.", telebot.ModeDefault)
+	}
+
+	tName := strings.TrimSpace(ctx.Args()[0])
+
+	if !utils.IsValidTokenName(tName) {
+		return ctx.Reply("Invalid token name!", telebot.ModeDefault)
+	}
+
+	limits, err := parseLimits(ctx.Args()[1:])
+	if err != nil {
+		return ctx.Reply(err.Error(), telebot.ModeDefault)
+	}
 
+	err = b.store.SetTokenLimits(db.UserActor(ctx.Sender().ID), tName, limits[0], limits[1], limits[2])
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Token not found: " + tName + "!")
+		}
+		return err
+	}
+
+	logger.InfoContext(updateContext(ctx), "Token limits changed", "sender", ctx.Sender().ID, "token", tName)
+	return ctx.Reply(fmt.Sprintf("Limits of %s updated!\nRate limit: %s\nDaily quota: %s", tName, formatLimit(limits[0], "/min", limits[1]), formatLimit(limits[2], "", 0)), telebot.ModeDefault)
 }
 
-func cmdRemoveChannel(ctx telebot.Context) error {
-	if len(ctx.Args()) != 1 {
-		return ctx.Reply("Usage: /rmchan <Channel name>", telebot.ModeDefault)
+func (b *Bot) cmdSetTokenAuth(ctx telebot.Context) error {
+	if len(ctx.Args()) != 2 {
+		return ctx.Reply("Usage: /settokenauth <Token name> <"+strings.Join(db.ValidAuthSchemes, "|")+">\nSetting hmac generates a new signing secret, even if it was already set.", telebot.ModeDefault)
 	}
 
-	chName := strings.TrimSpace(ctx.Args()[0])
+	tName := strings.TrimSpace(ctx.Args()[0])
 
-	if !utils.IsValidChannelName(chName) {
-		return ctx.Reply("Invalid channel name!", telebot.ModeDefault)
+	if !utils.IsValidTokenName(tName) {
+		return ctx.Reply("Invalid token name!", telebot.ModeDefault)
+	}
+
+	scheme := strings.TrimSpace(ctx.Args()[1])
+	if !slices.Contains(db.ValidAuthSchemes, scheme) {
+		return ctx.Reply("Invalid auth scheme: "+scheme+"!", telebot.ModeDefault)
 	}
 
-	err := db.DeleteChannelByName(chName)
+	var secret string
+	if scheme == db.AuthSchemeHmac {
+		var err error
+		secret, err = utils.GenerateRandomString(48)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := b.store.SetTokenAuthScheme(db.UserActor(ctx.Sender().ID), tName, scheme, secret)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return ctx.Reply("Channel not found!")
+			return ctx.Reply("Token not found: " + tName + "!")
 		}
 		return err
 	}
 
-	log.Println("BOT: Channel deleted: ", ctx.Sender().ID, " -- c:", chName)
-	return ctx.Reply("Channel "+chName+" deleted!", telebot.ModeDefault)
+	logger.InfoContext(updateContext(ctx), "Token auth scheme changed", "sender", ctx.Sender().ID, "token", tName, "scheme", scheme)
+
+	if scheme != db.AuthSchemeHmac {
+		return ctx.Reply("Token "+tName+" now uses "+scheme+" authentication!", telebot.ModeDefault)
+	}
+
+	message := fmt.Sprintf("<b>Token %s now requires signed requests!</b>\n<b>Signing secret</b>: <pre>%s</pre>\n\n"+
+		"Send <code>Authorization: HMAC-SHA256 %s:&lt;unix timestamp&gt;:&lt;random nonce&gt;:&lt;hex signature&gt;</code>, "+
+		"where the signature is the HMAC-SHA256 of the method, path with query, timestamp, nonce and hex SHA256 of the body, joined by newlines.\n\n"+
+		"<i>Keep this secret, delete this message if possible!</i>", tName, secret, tName)
+	return ctx.Reply(message, telebot.ModeHTML)
 }
 
-func cmdListTokens(ctx telebot.Context) error {
+func (b *Bot) cmdTokenInfo(ctx telebot.Context) error {
+	if len(ctx.Args()) != 1 {
+		return ctx.Reply("Usage: /tokeninfo <Token name>", telebot.ModeDefault)
+	}
+
+	tName := strings.TrimSpace(ctx.Args()[0])
+
+	if !utils.IsValidTokenName(tName) {
+		return ctx.Reply("Invalid token name!", telebot.ModeDefault)
+	}
 
-	tokens, err := db.GetAllTokens()
+	token, err := b.store.GetTokenByName(tName)
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Token not found: " + tName + "!")
+		}
 		return err
 	}
 
-	msg := "Currently active tokens:\n"
-	for _, token := range tokens {
+	now := time.Now()
+	var usage []db.TokenUsage
+	usage, err = b.store.GetTokenUsage(token.ID, now.AddDate(0, 0, -29))
+	if err != nil {
+		return err
+	}
 
-		var allowedChannelsStr string
-		if len(token.AllowedChannels) > 0 {
-			allowedChannelsStr = "\n"
-			for _, ch := range token.AllowedChannels {
-				allowedChannelsStr += "    - " + ch.Name + "\n"
-			}
-		} else {
-			allowedChannelsStr = " <i>NONE!</i>\n"
+	// summarize the usage for the periods, usage is ordered by day
+	today := db.UsageDay(now)
+	weekStart := today.AddDate(0, 0, -6)
+	var todayUsage, weekUsage, monthUsage db.TokenUsage
+	for _, u := range usage {
+		monthUsage.Add(u)
+		if !u.Day.Before(weekStart) {
+			weekUsage.Add(u)
+		}
+		if u.Day.Equal(today) {
+			todayUsage.Add(u)
 		}
+	}
 
-		lastUsedStr := "Never"
-		if token.LastUsed != nil {
-			lastUsedStr = token.LastUsed.Format("2006-01-02 15:04:05")
+	lastUsedStr := "Never"
+	if token.LastUsed != nil {
+		lastUsedStr = token.LastUsed.Format("2006-01-02 15:04:05")
+		if token.LastSourceIP != "" {
+			lastUsedStr += " from " + token.LastSourceIP
 		}
+	}
 
-		msg += fmt.Sprintf("- %s\n  <b>created</b>: %s\n  <b>last used</b>: %s\n  <b>allowed channels</b>:%s  <b>capNotify</b>: %s\n  <b>capQuestion</b>: %s\n\n",
-			token.Name,
-			token.CreatedAt.Format("2006-01-02 15:04:05"),
-			lastUsedStr,
-			allowedChannelsStr,
-			utils.BoolToEmoji(token.CapNotify),
-			utils.BoolToEmoji(token.CapQuestion),
-		)
+	lastActiveDayStr := "<i>No activity in the last 30 days</i>"
+	if len(usage) > 0 {
+		lastActiveDayStr = usage[len(usage)-1].Day.Format(time.DateOnly)
+	}
+
+	formatUsage := func(u db.TokenUsage) string {
+		return fmt.Sprintf("%d requests, %d notifications, %d questions, %d errors", u.Requests, u.Notifications, u.Questions, u.Errors)
 	}
 
+	msg := fmt.Sprintf("<b>%s</b>\n<b>created</b>: %s\n<b>last used</b>: %s\n<b>last active day</b>: %s\n\n<b>today</b>: %s\n<b>last 7 days</b>: %s\n<b>last 30 days</b>: %s",
+		token.Name,
+		token.CreatedAt.Format("2006-01-02 15:04:05"),
+		lastUsedStr,
+		lastActiveDayStr,
+		formatUsage(todayUsage),
+		formatUsage(weekUsage),
+		formatUsage(monthUsage),
+	)
+
 	return ctx.Reply(msg, telebot.ModeHTML)
 }
 
-func cmdMakeToken(ctx telebot.Context) error {
-	const capQuestion = "question"
-	const capNotify = "notify"
-	validCaps := []string{capQuestion, capNotify}
-	if len(ctx.Args()) != 3 {
-		return ctx.Reply("Usage: /mktoken <Token name> <Allowed channels comma separated> <Capabilities comma separated>\nValid capabilities: "+strings.Join(validCaps, ", "), telebot.ModeDefault)
+func (b *Bot) cmdRemoveToken(ctx telebot.Context) error {
+	if len(ctx.Args()) != 1 {
+		return ctx.Reply("Usage: /rmtoken <Token name>", telebot.ModeDefault)
 	}
 
 	tName := strings.TrimSpace(ctx.Args()[0])
@@ -242,77 +1005,228 @@ func cmdMakeToken(ctx telebot.Context) error {
 		return ctx.Reply("Invalid token name!", telebot.ModeDefault)
 	}
 
-	channels := strings.Split(ctx.Args()[1], ",")
-	for _, ch := range channels {
-		if !utils.IsValidChannelName(ch) {
-			return ctx.Reply("Invalid channel name: "+ch+"!", telebot.ModeDefault)
+	err := b.store.DeleteTokenByName(tName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Token not found: " + tName + "!")
 		}
+		return err
 	}
 
-	caps := strings.SplitN(ctx.Args()[2], ",", len(validCaps)+1)
-	for _, c := range caps {
-		if !slices.Contains(validCaps, c) {
-			return ctx.Reply("Invalid capability: "+c+"!", telebot.ModeDefault)
-		}
+	logger.InfoContext(updateContext(ctx), "Token deleted", "sender", ctx.Sender().ID, "token", tName)
+	return ctx.Reply("Token "+tName+" deleted!", telebot.ModeDefault)
+
+}
+
+func (b *Bot) cmdSchedule(ctx telebot.Context) error {
+	user := getUserFromContext(ctx)
+	if user == nil {
+		return fmt.Errorf("could not get user")
 	}
-	if len(caps) == 0 {
-		return ctx.Reply("Please set at least one capability!", telebot.ModeDefault)
+
+	const kindMessage = "message"
+	const kindQuestionPrefix = "question:"
+	args, text, ok := splitPayload(ctx.Message().Payload, 8)
+	if !ok || text == "" {
+		return ctx.Reply("Usage: /schedule <Name> <Channel name> <Minute> <Hour> <Day of month> <Month> <Day of week> <"+kindMessage+"|"+kindQuestionPrefix+"Option1,Option2,...> <Text>\nThe schedule is evaluated in server time.", telebot.ModeDefault)
 	}
 
-	newTokenStr, err := utils.GenerateRandomString(48)
+	sName := args[0]
+	if !utils.IsValidTokenName(sName) {
+		return ctx.Reply("Invalid schedule name!", telebot.ModeDefault)
+	}
+
+	chName := args[1]
+	if !utils.IsValidChannelName(chName) {
+		return ctx.Reply("Invalid channel name!", telebot.ModeDefault)
+	}
+
+	cronExpr := strings.Join(args[2:7], " ")
+	_, err := cron.ParseStandard(cronExpr)
 	if err != nil {
-		return err
+		return ctx.Reply("Invalid schedule: "+err.Error(), telebot.ModeDefault)
 	}
 
-	newToken := db.Token{
-		Name:        tName,
-		LastUsed:    nil,
-		TokenHash:   utils.TokenHash(newTokenStr),
-		CapNotify:   slices.Contains(caps, capNotify),
-		CapQuestion: slices.Contains(caps, capQuestion),
+	var options string
+	kind := args[7]
+	if strings.HasPrefix(kind, kindQuestionPrefix) {
+		options = strings.TrimPrefix(kind, kindQuestionPrefix)
+		for _, op := range strings.Split(options, ",") {
+			if op == "" {
+				return ctx.Reply("Options may not be empty!", telebot.ModeDefault)
+			}
+		}
+	} else if kind != kindMessage {
+		return ctx.Reply("Invalid message kind: "+kind+"!", telebot.ModeDefault)
+	}
+
+	var ch *db.Channel
+	ch, err = b.store.GetChannelByName(updateContext(ctx), chName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Reply("Channel not found!", telebot.ModeDefault)
+		}
+		return err
 	}
 
-	_, err = db.CreateToken(&newToken, channels)
+	newRecurring := db.RecurringMessage{
+		Name:     sName,
+		CronExpr: cronExpr,
+		Text:     text,
+		Options:  options,
+		Channel:  ch,
+		Creator:  user,
+	}
+	_, err = b.store.CreateRecurringMessage(&newRecurring)
 	if err != nil {
 		if errors.Is(err, gorm.ErrDuplicatedKey) {
 			return ctx.Reply("This name is already in use!", telebot.ModeDefault)
 		}
+		return err
+	}
+
+	logger.InfoContext(updateContext(ctx), "Recurring message scheduled", "sender", ctx.Sender().ID, "schedule", sName, "channel", chName)
+	return ctx.Reply("Scheduled!", telebot.ModeDefault)
+}
+
+func (b *Bot) cmdListSchedules(ctx telebot.Context) error {
+
+	recurringMessages, err := b.store.GetAllRecurringMessages()
+	if err != nil {
+		return err
+	}
+
+	msg := "Currently scheduled messages:\n"
+	for _, recurring := range recurringMessages {
+
+		chName := "<i>DELETED!</i>"
+		if recurring.Channel != nil {
+			chName = html.EscapeString(recurring.Channel.Name)
+		}
+
+		kind := "message"
+		if recurring.IsQuestion() {
+			kind = "question (" + html.EscapeString(strings.Join(recurring.OptionLabels(), ", ")) + ")"
+		}
+
+		lastRunStr := "Never"
+		if recurring.LastRunAt != nil {
+			lastRunStr = recurring.LastRunAt.Format("2006-01-02 15:04:05")
+		}
+
+		msg += fmt.Sprintf("- %s\n  <b>channel</b>: %s\n  <b>schedule</b>: <code>%s</code>\n  <b>kind</b>: %s\n  <b>last run</b>: %s\n  <b>text</b>: %s\n\n",
+			recurring.Name,
+			chName,
+			html.EscapeString(recurring.CronExpr),
+			kind,
+			lastRunStr,
+			html.EscapeString(recurring.Text),
+		)
+	}
+
+	return ctx.Reply(msg, telebot.ModeHTML)
+}
+
+func (b *Bot) cmdUnschedule(ctx telebot.Context) error {
+	if len(ctx.Args()) != 1 {
+		return ctx.Reply("Usage: /unschedule <Name>", telebot.ModeDefault)
+	}
+
+	sName := strings.TrimSpace(ctx.Args()[0])
+
+	if !utils.IsValidTokenName(sName) {
+		return ctx.Reply("Invalid schedule name!", telebot.ModeDefault)
+	}
+
+	err := b.store.DeleteRecurringMessageByName(sName)
+	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return ctx.Reply("Channel not found!", telebot.ModeDefault)
+			return ctx.Reply("Schedule not found: " + sName + "!")
 		}
 		return err
 	}
-	message := fmt.Sprintf("<b>New token created!</b>\n<b>Name</b>: %s\n<b>Token</b>: <pre>%s</pre>\n\n<i>Keep this token a secret, delete this message if possible!</i>", tName, newTokenStr)
 
-	log.Println("BOT: Token created: ", ctx.Sender().ID, " -- t:", tName)
-	return ctx.Reply(message, telebot.ModeHTML)
+	logger.InfoContext(updateContext(ctx), "Recurring message unscheduled", "sender", ctx.Sender().ID, "schedule", sName)
+	return ctx.Reply("Schedule "+sName+" deleted!", telebot.ModeDefault)
+}
+
+func (b *Bot) cmdListTemplates(ctx telebot.Context) error {
+
+	templates, err := b.store.GetAllTemplates()
+	if err != nil {
+		return err
+	}
+
+	msg := "Available templates:\n"
+	for _, template := range templates {
+		msg += fmt.Sprintf("- %s\n<pre>%s</pre>\n\n", template.Name, html.EscapeString(template.Body))
+	}
+
+	return ctx.Reply(msg, telebot.ModeHTML)
+}
+
+func (b *Bot) cmdMakeTemplate(ctx telebot.Context) error {
+	user := getUserFromContext(ctx)
+	if user == nil {
+		return fmt.Errorf("could not get user")
+	}
+
+	args, body, ok := splitPayload(ctx.Message().Payload, 1)
+	if !ok || body == "" {
+		return ctx.Reply("Usage: /mktemplate <Template name> <Template body>\nThe body is a Go text/template, variables are referenced like {{.name}}", telebot.ModeDefault)
+	}
+
+	name := args[0]
+	if !utils.IsValidTokenName(name) {
+		return ctx.Reply("Invalid template name!", telebot.ModeDefault)
+	}
+
+	err := utils.ValidateTemplate(body)
+	if err != nil {
+		return ctx.Reply("Invalid template: "+err.Error(), telebot.ModeDefault)
+	}
+
+	newTemplate := db.Template{
+		Name:    name,
+		Body:    body,
+		Creator: user,
+	}
+	_, err = b.store.CreateTemplate(&newTemplate)
+	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return ctx.Reply("This name is already in use!", telebot.ModeDefault)
+		}
+		return err
+	}
+
+	logger.InfoContext(updateContext(ctx), "Template created", "sender", ctx.Sender().ID, "template", name)
+	return ctx.Reply("Template created!", telebot.ModeDefault)
 }
 
-func cmdRemoveToken(ctx telebot.Context) error {
+func (b *Bot) cmdRemoveTemplate(ctx telebot.Context) error {
 	if len(ctx.Args()) != 1 {
-		return ctx.Reply("Usage: /rmtoken <Token name>", telebot.ModeDefault)
+		return ctx.Reply("Usage: /rmtemplate <Template name>", telebot.ModeDefault)
 	}
 
-	tName := strings.TrimSpace(ctx.Args()[0])
+	name := strings.TrimSpace(ctx.Args()[0])
 
-	if !utils.IsValidTokenName(tName) {
-		return ctx.Reply("Invalid token name!", telebot.ModeDefault)
+	if !utils.IsValidTokenName(name) {
+		return ctx.Reply("Invalid template name!", telebot.ModeDefault)
 	}
 
-	err := db.DeleteTokenByName(tName)
+	err := b.store.DeleteTemplateByName(name)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return ctx.Reply("Token not found: " + tName + "!")
+			return ctx.Reply("Template not found: " + name + "!")
 		}
 		return err
 	}
 
-	log.Println("BOT: Token deleted: ", ctx.Sender().ID, " -- t:", tName)
-	return ctx.Reply("Token "+tName+" deleted!", telebot.ModeDefault)
-
+	logger.InfoContext(updateContext(ctx), "Template deleted", "sender", ctx.Sender().ID, "template", name)
+	return ctx.Reply("Template "+name+" deleted!", telebot.ModeDefault)
 }
 
-func handleCallback(ctx telebot.Context) error {
+func (b *Bot) handleCallback(ctx telebot.Context) error {
 	q := ctx.Callback()
 
 	parts := strings.SplitN(strings.TrimSpace(q.Data), "|", 2)
@@ -324,7 +1238,8 @@ func handleCallback(ctx telebot.Context) error {
 	unique := strings.TrimSpace(parts[0])
 	data := strings.TrimSpace(parts[1])
 
-	log.Println("BOT: New callback: ", ctx.Sender().ID, " -- u: ", unique, " -- d: ", data)
+	updCtx := updateContext(ctx)
+	logger.InfoContext(updCtx, "New callback", "sender", ctx.Sender().ID, "unique", unique, "data", data)
 
 	if unique != common.CallbackIDQuestion {
 		return nil
@@ -337,10 +1252,17 @@ func handleCallback(ctx telebot.Context) error {
 	}
 
 	var questionData *memdb.QuestionData
-	questionData, err = memdb.AnswerQuestion(context.TODO(), cd.RandomID, ctx.Sender().ID, cd.Data)
+	questionData, err = b.questions.AnswerQuestion(updCtx, cd.RandomID, ctx.Sender().ID, cd.Data)
 	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			metrics.Questions.WithLabelValues(metrics.QuestionLateAnswer).Inc()
+		}
 		return err
 	}
+	metrics.Questions.WithLabelValues(metrics.QuestionAnswered).Inc()
+	if questionData.CreatedAt != nil {
+		metrics.QuestionTimeToAnswer.Observe(questionData.AnsweredAt.Sub(*questionData.CreatedAt).Seconds())
+	}
 
 	// Update sent messages
 
@@ -365,41 +1287,60 @@ func handleCallback(ctx telebot.Context) error {
 
 	replyMsg := fmt.Sprintf("Answered by %s:\n\n%s", username, answerLabel)
 
-	for _, sMsg := range questionData.RelatedMessages {
-		var msg *telebot.Message
-		msg, err = telegramBot.EditReplyMarkup(sMsg, nil) // remove buttons
-		if err != nil {
-			return err
-		}
-		_, err = telegramBot.Reply(msg, replyMsg, telebot.ModeDefault)
-		if err != nil {
-			return err
-		}
+	err = b.messenger.CloseQuestion(updCtx, questionData.RelatedMessages, replyMsg)
+	// the answer is stored already, so the loading indicator on the button is stopped even if some messages could not be updated
+	respondErr := ctx.Respond()
+	if err != nil {
+		return err
 	}
-
-	return nil
+	return respondErr
 }
 
-func setupHandlers(bot *telebot.Bot) {
-	bot.Handle("/start", cmdStart)
-	bot.Handle("/id", cmdId)
-	bot.Handle("/whoami", cmdWhoami)
+func (b *Bot) setupHandlers() {
+	b.bot.Use(b.trackHandlersMiddleware)
+	b.bot.Use(updateContextMiddleware)
 
-	privateAuthOnly := bot.Group()
+	b.bot.Handle("/start", cmdStart)
+	b.bot.Handle("/id", cmdId)
+	b.bot.Handle("/whoami", b.cmdWhoami)
+
+	privateAuthOnly := b.bot.Group()
 	privateAuthOnly.Use(privateOnlyMiddleware)
-	privateAuthOnly.Use(knownSenderOnlyMiddleware)
-	privateAuthOnly.Handle("/subscribe", cmdSubscribe)
-	privateAuthOnly.Handle("/unsubscribe", cmdUnsubscribe)
-	privateAuthOnly.Handle("/list", cmdList)
-	adminOnly := bot.Group()
+	privateAuthOnly.Use(b.knownSenderOnlyMiddleware)
+	privateAuthOnly.Handle("/subscribe", b.cmdSubscribe)
+	privateAuthOnly.Handle("/unsubscribe", b.cmdUnsubscribe)
+	privateAuthOnly.Handle("/list", b.cmdList)
+	privateAuthOnly.Handle("/info", b.cmdInfo)
+	adminOnly := b.bot.Group()
 	adminOnly.Use(privateOnlyMiddleware)
-	adminOnly.Use(knownSenderOnlyMiddleware)
+	adminOnly.Use(b.knownSenderOnlyMiddleware)
 	adminOnly.Use(adminOnlyMiddleware)
-	adminOnly.Handle("/mkchan", cmdMakeChannel)
-	adminOnly.Handle("/rmchan", cmdRemoveChannel)
-	adminOnly.Handle("/tokens", cmdListTokens)
-	adminOnly.Handle("/mktoken", cmdMakeToken)
-	adminOnly.Handle("/rmtoken", cmdRemoveToken)
-
-	bot.Handle(telebot.OnCallback, handleCallback)
+	adminOnly.Handle("/mkchan", b.cmdMakeChannel)
+	adminOnly.Handle("/editchan", b.cmdEditChannel)
+	adminOnly.Handle("/renamechan", b.cmdRenameChannel)
+	adminOnly.Handle("/archivechan", b.cmdArchiveChannel)
+	adminOnly.Handle("/rmchan", b.cmdArchiveChannel) // kept for compatibility
+	adminOnly.Handle("/restorechan", b.cmdRestoreChannel)
+	adminOnly.Handle("/setchanlimits", b.cmdSetChannelLimits)
+	adminOnly.Handle("/purgechan", b.cmdPurgeChannel)
+	adminOnly.Handle("/auditlog", b.cmdAuditLog)
+	adminOnly.Handle("/tokens", b.cmdListTokens)
+	adminOnly.Handle("/tokeninfo", b.cmdTokenInfo)
+	adminOnly.Handle("/mktoken", b.cmdMakeToken)
+	adminOnly.Handle("/rotatetoken", b.cmdRotateToken)
+	adminOnly.Handle("/granttoken", b.cmdGrantToken)
+	adminOnly.Handle("/revoketoken", b.cmdRevokeToken)
+	adminOnly.Handle("/settokencaps", b.cmdSetTokenCaps)
+	adminOnly.Handle("/settokenauth", b.cmdSetTokenAuth)
+	adminOnly.Handle("/settokenips", b.cmdSetTokenIPs)
+	adminOnly.Handle("/settokenlimits", b.cmdSetTokenLimits)
+	adminOnly.Handle("/rmtoken", b.cmdRemoveToken)
+	adminOnly.Handle("/schedule", b.cmdSchedule)
+	adminOnly.Handle("/schedules", b.cmdListSchedules)
+	adminOnly.Handle("/unschedule", b.cmdUnschedule)
+	adminOnly.Handle("/templates", b.cmdListTemplates)
+	adminOnly.Handle("/mktemplate", b.cmdMakeTemplate)
+	adminOnly.Handle("/rmtemplate", b.cmdRemoveTemplate)
+
+	b.bot.Handle(telebot.OnCallback, b.handleCallback)
 }
@@ -0,0 +1,61 @@
+package telegram
+
+import (
+	"context"
+	"github.com/marcsello/marcsellocorp-bot/logging"
+	"github.com/marcsello/marcsellocorp-bot/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/telebot.v3"
+	"strconv"
+)
+
+const updateContextKey = "context"
+
+var logger = logging.Component("bot")
+
+// updateContextMiddleware starts a span for handling the update, and stores the context for updateContext
+func updateContextMiddleware(next telebot.HandlerFunc) telebot.HandlerFunc {
+	return func(ctx telebot.Context) error {
+		attrs := []attribute.KeyValue{attribute.Int("telegram.update_id", ctx.Update().ID)}
+		if ctx.Sender() != nil {
+			attrs = append(attrs, attribute.Int64("telegram.sender_id", ctx.Sender().ID))
+		}
+
+		updCtx, span := tracing.Start(newUpdateContext(ctx), "telegram.update",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attrs...),
+		)
+		ctx.Set(updateContextKey, updCtx)
+
+		err := next(ctx)
+		tracing.End(span, err)
+		return err
+	}
+}
+
+// updateContext returns a context carrying the ID of the update as request ID, so everything logged while handling it can be correlated
+func updateContext(ctx telebot.Context) context.Context {
+	if updCtx, ok := ctx.Get(updateContextKey).(context.Context); ok {
+		return updCtx
+	}
+	return newUpdateContext(ctx)
+}
+
+func newUpdateContext(ctx telebot.Context) context.Context {
+	return logging.WithRequestID(context.Background(), "upd-"+strconv.Itoa(ctx.Update().ID))
+}
+
+// handleError logs the errors returned by handlers, instead of the default handler of telebot, which uses the standard logger
+func handleError(err error, ctx telebot.Context) {
+	if ctx == nil {
+		logger.Error("Bot error", "error", err)
+		return
+	}
+
+	var sender int64
+	if ctx.Sender() != nil {
+		sender = ctx.Sender().ID
+	}
+	logger.ErrorContext(updateContext(ctx), "Handler failed", "sender", sender, "error", err)
+}
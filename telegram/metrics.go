@@ -0,0 +1,38 @@
+package telegram
+
+import (
+	"errors"
+	"github.com/marcsello/marcsellocorp-bot/metrics"
+	"gopkg.in/telebot.v3"
+)
+
+// Kinds of Bot API calls counted in the send metrics
+const (
+	sendKindMessage = "message"
+	sendKindEdit    = "edit"
+	sendKindDelete  = "delete"
+)
+
+func sendOutcome(err error) string {
+	if err == nil {
+		return metrics.OutcomeSuccess
+	}
+
+	var floodErr telebot.FloodError
+	if errors.As(err, &floodErr) {
+		return metrics.OutcomeRateLimited
+	}
+
+	if errors.Is(err, telebot.ErrBlockedByUser) ||
+		errors.Is(err, telebot.ErrUserIsDeactivated) ||
+		errors.Is(err, telebot.ErrNotStartedByUser) ||
+		errors.Is(err, telebot.ErrChatNotFound) {
+		return metrics.OutcomeBlocked
+	}
+
+	return metrics.OutcomeError
+}
+
+func observeSend(kind string, err error) {
+	metrics.TelegramSends.WithLabelValues(kind, sendOutcome(err)).Inc()
+}
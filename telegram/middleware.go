@@ -21,11 +21,11 @@ func privateOnlyMiddleware(next telebot.HandlerFunc) telebot.HandlerFunc {
 	}
 }
 
-func knownSenderOnlyMiddleware(next telebot.HandlerFunc) telebot.HandlerFunc {
+func (b *Bot) knownSenderOnlyMiddleware(next telebot.HandlerFunc) telebot.HandlerFunc {
 	return func(ctx telebot.Context) error {
 		var err error
 		var user *db.User
-		user, err = db.GetUserById(ctx.Sender().ID)
+		user, err = b.store.GetUserById(updateContext(ctx), ctx.Sender().ID)
 		if err != nil {
 			if !errors.Is(err, gorm.ErrRecordNotFound) {
 				return err
@@ -1,7 +1,193 @@
 package telegram
 
-import "gopkg.in/telebot.v3"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/marcsello/marcsellocorp-bot/common"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/memdb"
+	"github.com/marcsello/marcsellocorp-bot/metrics"
+	"gopkg.in/telebot.v3"
+)
 
-func GetBot() *telebot.Bot {
-	return telegramBot
+// Messenger is everything the bot delivers to Telegram. The API and the scheduler declare the subset they need,
+// the question callbacks go through the messenger of the Bot, so each of them can be tested with fakes.
+type Messenger interface {
+	Ping(ctx context.Context) error
+	SendToUser(ctx context.Context, userId int64, msg string) error
+	SendToSubscribers(ctx context.Context, channel *db.Channel, msg string, opts ...interface{}) ([]memdb.StoredMessage, error)
+	SendQuestion(ctx context.Context, sourceTokenId uint, channel *db.Channel, msg string, options []memdb.QuestionOption) (string, error)
+	CloseQuestion(ctx context.Context, messages []memdb.StoredMessage, replyMsg string) error
+	EditMessages(ctx context.Context, messages []memdb.StoredMessage, msg string) error
+	DeleteMessages(ctx context.Context, messages []memdb.StoredMessage) error
+}
+
+var _ Messenger = (*Bot)(nil)
+
+// Ping checks if the Telegram Bot API is reachable and accepts our token
+func (b *Bot) Ping(ctx context.Context) error {
+	result := make(chan error, 1)
+	go func() {
+		_, err := b.bot.Raw("getMe", nil)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FormatMessage compiles the text of a message delivered to the subscribers of a channel
+func FormatMessage(sourceName, channelName, text string) string {
+	return fmt.Sprintf("[%s -> %s]\n\n%s", sourceName, channelName, text)
+}
+
+// SendToUser sends a private message to a single user
+func (b *Bot) SendToUser(ctx context.Context, userId int64, msg string) error {
+	span := startSend(ctx, "sendMessage", userId)
+	_, err := b.bot.Send(&telebot.User{ID: userId}, msg, telebot.ModeDefault)
+	finishSend(span, sendKindMessage, err)
+	return err
+}
+
+// SendToSubscribers sends the same message to every subscriber of the channel, the channel must have its subscribers loaded
+func (b *Bot) SendToSubscribers(ctx context.Context, channel *db.Channel, msg string, opts ...interface{}) ([]memdb.StoredMessage, error) {
+	opts = append([]interface{}{telebot.ModeDefault}, opts...)
+
+	if channel.DefaultPriority == db.PriorityLow {
+		opts = append(opts, telebot.Silent)
+	}
+
+	sentMessages := make([]memdb.StoredMessage, 0, len(channel.Subscribers))
+	for _, sub := range channel.Subscribers {
+		span := startSend(ctx, "sendMessage", sub.ID)
+		m, err := b.bot.Send(&telebot.User{ID: sub.ID}, msg, opts...)
+		finishSend(span, sendKindMessage, err)
+		if err != nil {
+			return sentMessages, err
+		}
+		sentMessages = append(sentMessages, memdb.StoredMessage{MessageID: m.ID, ChatID: m.Chat.ID}) // so they can be edited later
+	}
+
+	if len(sentMessages) > 0 {
+		err := b.store.TouchChannel(ctx, channel.ID)
+		if err != nil {
+			logger.WarnContext(ctx, "Failed to update channel activity", "channel", channel.Name, "error", err)
+		}
+	}
+	return sentMessages, nil
+}
+
+// SendQuestion sends a question with answer buttons to every subscriber of the channel, and returns the RandomID of the new question
+func (b *Bot) SendQuestion(ctx context.Context, sourceTokenId uint, channel *db.Channel, msg string, options []memdb.QuestionOption) (string, error) {
+	newQuestionTx, err := b.questions.BeginNewQuestion(ctx, sourceTokenId, channel.Name)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			metrics.Questions.WithLabelValues(metrics.QuestionFailed).Inc()
+		} else {
+			metrics.Questions.WithLabelValues(metrics.QuestionCreated).Inc()
+		}
+	}()
+
+	// compile message
+	markup := &telebot.ReplyMarkup{}
+	rows := make([]telebot.Row, len(options))
+	for i, op := range options {
+
+		newQuestionTx.AddOption(op.Data, op.Label) // store the original label in redis
+
+		label := op.Label
+		if label == "" {
+			label = op.Data
+		}
+
+		var btnData []byte
+		btnData, err = json.Marshal(common.CallbackData{
+			RandomID: newQuestionTx.RandomID(),
+			Data:     op.Data,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		rows[i] = markup.Row(markup.Data(label, common.CallbackIDQuestion, string(btnData)))
+	}
+	markup.Inline(rows...)
+
+	var sentMessages []memdb.StoredMessage
+	sentMessages, err = b.SendToSubscribers(ctx, channel, msg, markup)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range sentMessages {
+		newQuestionTx.AddRelatedMessage(m)
+	}
+
+	err = newQuestionTx.Close()
+	if err != nil {
+		return "", err
+	}
+
+	return newQuestionTx.RandomID(), nil
+}
+
+// CloseQuestion removes the answer buttons from the messages of an answered question, and replies to them
+func (b *Bot) CloseQuestion(ctx context.Context, messages []memdb.StoredMessage, replyMsg string) error {
+	for _, sMsg := range messages {
+		span := startSend(ctx, "editMessageReplyMarkup", sMsg.ChatID)
+		msg, err := b.bot.EditReplyMarkup(sMsg, nil) // remove buttons
+		finishSend(span, sendKindEdit, err)
+		if err != nil {
+			return err
+		}
+		span = startSend(ctx, "sendMessage", sMsg.ChatID)
+		_, err = b.bot.Reply(msg, replyMsg, telebot.ModeDefault)
+		finishSend(span, sendKindMessage, err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EditMessages changes the text of all previously sent messages
+func (b *Bot) EditMessages(ctx context.Context, messages []memdb.StoredMessage, msg string) error {
+	for _, sMsg := range messages {
+		span := startSend(ctx, "editMessageText", sMsg.ChatID)
+		_, err := b.bot.Edit(sMsg, msg, telebot.ModeDefault)
+		if errors.Is(err, telebot.ErrSameMessageContent) {
+			err = nil
+		}
+		finishSend(span, sendKindEdit, err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteMessages removes all previously sent messages, messages already deleted by the users are skipped.
+// A failure does not stop the deletion of the rest, the errors are joined.
+func (b *Bot) DeleteMessages(ctx context.Context, messages []memdb.StoredMessage) error {
+	var errs []error
+	for _, sMsg := range messages {
+		span := startSend(ctx, "deleteMessage", sMsg.ChatID)
+		err := b.bot.Delete(sMsg)
+		if errors.Is(err, telebot.ErrNotFoundToDelete) {
+			err = nil
+		}
+		finishSend(span, sendKindDelete, err)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
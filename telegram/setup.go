@@ -1,33 +1,265 @@
 package telegram
 
 import (
-	"gitlab.com/MikeTTh/env"
+	"context"
+	"fmt"
+	"github.com/marcsello/marcsellocorp-bot/config"
+	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/memdb"
 	"gopkg.in/telebot.v3"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
-var telegramBot *telebot.Bot
+// Store is the persistent storage used by the bot, implemented by db.Store
+type Store interface {
+	GetUserById(ctx context.Context, id int64) (*db.User, error)
+	ChangeSubscription(userId int64, channelId uint, subscribed bool) (bool, error)
+
+	GetAllChannels() ([]db.Channel, error)
+	GetChannelByName(ctx context.Context, name string) (*db.Channel, error)
+	GetChannelInfoByName(name string) (*db.Channel, []db.Token, error)
+	CreateChannel(channel *db.Channel) (*db.Channel, error)
+	UpdateChannelMetadata(name, field, value string) error
+	RenameChannel(actor db.Actor, oldName, newName string) error
+	SetChannelLimits(actor db.Actor, name string, rateLimit, rateBurst int) error
+	TouchChannel(ctx context.Context, id uint) error
+	ArchiveChannelByName(actor db.Actor, name string) error
+	RestoreChannelByName(actor db.Actor, name string) error
+	PurgeChannelByName(actor db.Actor, name string) error
+
+	GetAllTokens() ([]db.Token, error)
+	GetTokenByName(name string) (*db.Token, error)
+	CreateToken(token *db.Token, grants []db.TokenGrant) (*db.Token, error)
+	RotateToken(actor db.Actor, name string, newTokenHash []byte, newHmacSecret string, grace time.Duration, updateExpiry bool, expiresAt *time.Time) (bool, error)
+	SetTokenGrants(actor db.Actor, tokenName string, grants []db.TokenGrant) error
+	RevokeTokenGrants(actor db.Actor, tokenName string, channelPatterns []string) error
+	SetTokenGlobalCapabilities(actor db.Actor, tokenName string, caps []db.Capability) error
+	SetTokenAuthScheme(actor db.Actor, tokenName string, scheme string, hmacSecret string) error
+	SetTokenAllowedCIDRs(actor db.Actor, tokenName string, cidrs string) error
+	SetTokenLimits(actor db.Actor, tokenName string, rateLimit, rateBurst, dailyQuota int) error
+	DeleteTokenByName(name string) error
+	GetTokenUsage(tokenId uint, since time.Time) ([]db.TokenUsage, error)
+
+	GetAllTemplates() ([]db.Template, error)
+	CreateTemplate(template *db.Template) (*db.Template, error)
+	DeleteTemplateByName(name string) error
+	GetAllRecurringMessages() ([]db.RecurringMessage, error)
+	CreateRecurringMessage(recurring *db.RecurringMessage) (*db.RecurringMessage, error)
+	DeleteRecurringMessageByName(name string) error
+	GetLatestAuditLogEntries(limit int) ([]db.AuditLogEntry, error)
+}
+
+// QuestionStore keeps the state of questions and confirmations, implemented by memdb.Client
+type QuestionStore interface {
+	BeginNewQuestion(ctx context.Context, sourceToken uint, channelName string) (memdb.NewQuestionTx, error)
+	AnswerQuestion(ctx context.Context, randomId string, answererID int64, answerData string) (*memdb.QuestionData, error)
+	BeginConfirmation(ctx context.Context, action string) (string, error)
+	ConfirmAction(ctx context.Context, action, code string) (bool, error)
+}
+
+// Bot is the Telegram bot, it handles the commands of the users and delivers messages to them
+type Bot struct {
+	bot       *telebot.Bot
+	poller    telebot.Poller
+	store     Store
+	questions QuestionStore
+	messenger Messenger // the bot itself, unless replaced by a fake in tests
+
+	rotationGrace time.Duration // the previous secret of a rotated token remains valid for this long
+
+	stopped         context.Context // cancelled when the bot stops, so the pending long poll is cancelled
+	stop            context.CancelFunc
+	handlers        sync.WaitGroup // updates being handled, they are waited for on shutdown
+	shutdownTimeout time.Duration
+}
+
+func NewBot(cfg config.Telegram, tokens config.Tokens, store Store, questions QuestionStore, debug bool) (*Bot, error) {
+	b := &Bot{
+		store:           store,
+		questions:       questions,
+		rotationGrace:   tokens.RotationGrace.D(),
+		shutdownTimeout: cfg.ShutdownTimeout.D(),
+	}
+	b.messenger = b
+	b.stopped, b.stop = context.WithCancel(context.Background())
+
+	switch cfg.UpdatesMode {
+	case config.UpdatesModeWebhook:
+		b.poller = newWebhookPoller(cfg.Webhook)
+	case config.UpdatesModePolling:
+		b.poller = &telebot.LongPoller{
+			Timeout: cfg.PollingTimeout.D(),
+		}
+	default:
+		return nil, fmt.Errorf("invalid updates mode: %s", cfg.UpdatesMode)
+	}
 
-func InitTelegramBot(debug bool) (func(), error) {
 	var err error
-	telegramBot, err = telebot.NewBot(telebot.Settings{
-		Token: env.StringOrPanic("TELEGRAM_TOKEN"),
-		Poller: &telebot.Webhook{
-			Listen: env.String("WEBHOOK_BIND", ":8080"),
-			Endpoint: &telebot.WebhookEndpoint{
-				PublicURL: env.StringOrPanic("WEBHOOK_PUBLIC_URL"),
-			},
-		},
+	b.bot, err = telebot.NewBot(telebot.Settings{
+		Token:   cfg.Token,
+		URL:     cfg.APIURL, // telebot falls back to the official Bot API when empty
 		Verbose: debug,
+		OnError: handleError,
+		Client: &http.Client{
+			Timeout:   time.Minute, // the default of telebot
+			Transport: &longPollCancelTransport{next: http.DefaultTransport, stopped: b.stopped},
+		},
+		// the handlers are started in their own goroutines by trackHandlersMiddleware instead, so they can be waited for
+		Synchronous: true,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	setupHandlers(telegramBot)
+	if cfg.UpdatesMode == config.UpdatesModePolling {
+		// getUpdates is refused while a webhook is set, which may be left over from running in webhook mode
+		err = b.bot.RemoveWebhook()
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Using long polling, webhook removed")
+	}
+
+	b.setupHandlers()
+
+	return b, nil
+}
+
+// Run processes updates until the context is cancelled, then waits for the updates being handled.
+// Bot.Start and Bot.Stop of telebot are not used, as they write a field read by every API request without synchronization.
+func (b *Bot) Run(ctx context.Context) {
+	stop := make(chan struct{}, 1)
+	polled := make(chan struct{})
+	go func() {
+		b.poller.Poll(b.bot, b.bot.Updates, stop)
+		close(polled)
+	}()
+
+	for running := true; running; {
+		select {
+		case upd := <-b.bot.Updates:
+			b.bot.ProcessUpdate(upd)
+		case <-polled:
+			logger.Error("Stopped receiving updates") // e.g. the webhook could not be set
+			polled = nil
+		case <-ctx.Done():
+			running = false
+		}
+	}
+
+	deadline := time.After(b.shutdownTimeout)
+	if polled != nil {
+		signalStop(stop)
+	}
+	b.stop() // the pending long poll would hold up the shutdown
+	if polled != nil {
+		select {
+		case <-polled:
+		case <-deadline:
+			logger.Error("Timed out waiting for the poller to stop")
+		}
+	}
+
+	handlersDone := make(chan struct{})
+	go func() {
+		b.handlers.Wait()
+		close(handlersDone)
+	}()
+	select {
+	case <-handlersDone:
+	case <-deadline:
+		logger.Error("Timed out waiting for the handlers to finish")
+	}
+}
+
+// signalStop asks the poller to stop. The channel is signalled instead of closed, because the webhook poller of telebot
+// closes it by itself, also when it gives up because the webhook could not be set. Nothing is left to stop then.
+func signalStop(stop chan struct{}) {
+	defer func() {
+		_ = recover() // send on closed channel
+	}()
+	stop <- struct{}{}
+}
+
+// trackHandlersMiddleware runs the handler in a new goroutine, that is tracked so it can be waited for on shutdown.
+// The bot must be synchronous, so the goroutine is counted before the bot stops processing updates.
+func (b *Bot) trackHandlersMiddleware(next telebot.HandlerFunc) telebot.HandlerFunc {
+	return func(ctx telebot.Context) error {
+		b.handlers.Add(1)
+		go func() {
+			defer b.handlers.Done()
+			err := next(ctx)
+			if err != nil {
+				b.bot.OnError(err, ctx)
+			}
+		}()
+		return nil
+	}
+}
+
+// longPollCancelTransport cancels the pending getUpdates requests when the bot stops, other requests are left to finish,
+// so the handlers being waited for on shutdown can still reply.
+type longPollCancelTransport struct {
+	next    http.RoundTripper
+	stopped context.Context
+}
+
+func (t *longPollCancelTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Path, "/getUpdates") {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	stopCancelling := context.AfterFunc(t.stopped, cancel)
+	release := func() {
+		stopCancelling()
+		cancel()
+	}
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release} // the body is read after returning
+	return resp, nil
+}
+
+// releasingBody calls release when the body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// newWebhookPoller configures the webhook, Telegram is told where to send the updates when the bot is started.
+// The settings must be validated already.
+func newWebhookPoller(cfg config.Webhook) *telebot.Webhook {
+	webhook := &telebot.Webhook{
+		Listen: cfg.Bind,
+		Endpoint: &telebot.WebhookEndpoint{
+			PublicURL: cfg.PublicURL,
+			Cert:      cfg.PublicCert, // uploaded to Telegram, only needed for self-signed certificates
+		},
+		SecretToken: cfg.SecretToken, // Telegram sends this in every request, so forged updates can be rejected
+	}
 
-	runFunc := func() {
-		telegramBot.Start()
+	// serve the webhook over TLS, instead of relying on a reverse proxy
+	if cfg.TLSCert != "" {
+		webhook.TLS = &telebot.WebhookTLS{
+			Cert: cfg.TLSCert,
+			Key:  cfg.TLSKey,
+		}
 	}
 
-	return runFunc, nil
+	return webhook
 }
@@ -0,0 +1,71 @@
+package telegramtest
+
+import (
+	"encoding/json"
+	"gopkg.in/telebot.v3"
+	"net/http"
+	"strconv"
+)
+
+// The control endpoints let developers act as users when the fake server is run standalone:
+//
+//	GET  /fake/messages?chat_id=<id>                                            messages of a chat
+//	POST /fake/send   {"from": {"id": 42, "first_name": "Dev"}, "text": "/list"}  send a message to the bot
+//	POST /fake/click  {"from": {...}, "chat_id": 42, "message_id": 3, "button": "Yes"}  press an inline button
+
+type sendRequest struct {
+	From telebot.User `json:"from"`
+	Text string       `json:"text"`
+}
+
+type clickRequest struct {
+	From      telebot.User `json:"from"`
+	ChatID    int64        `json:"chat_id"`
+	MessageID int          `json:"message_id"`
+	Button    string       `json:"button"`
+}
+
+func (s *Server) serveControl(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/fake/messages" && r.Method == http.MethodGet:
+		chatID, err := strconv.ParseInt(r.URL.Query().Get("chat_id"), 10, 64)
+		if err != nil {
+			writeError(w, badRequest("chat_id required"))
+			return
+		}
+		writeResult(w, s.Messages(chatID))
+
+	case r.URL.Path == "/fake/send" && r.Method == http.MethodPost:
+		var req sendRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.From.ID == 0 || req.Text == "" {
+			writeError(w, badRequest("from.id and text required"))
+			return
+		}
+		var m telebot.Message
+		m, err = s.SendText(req.From, req.Text)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResult(w, m)
+
+	case r.URL.Path == "/fake/click" && r.Method == http.MethodPost:
+		var req clickRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.From.ID == 0 {
+			writeError(w, badRequest("from.id, chat_id, message_id and button required"))
+			return
+		}
+		var id string
+		id, err = s.Click(req.From, req.ChatID, req.MessageID, req.Button)
+		if err != nil {
+			writeError(w, badRequest(err.Error()))
+			return
+		}
+		writeResult(w, map[string]string{"callback_query_id": id})
+
+	default:
+		writeError(w, &apiError{code: http.StatusNotFound, description: "Not Found"})
+	}
+}
@@ -0,0 +1,556 @@
+// Package telegramtest provides a fake Telegram Bot API server. The bot can be pointed to it with the telegram.api_url
+// setting, so it can be run and tested without a real bot token or network access.
+//
+// Only the methods used by the bot are implemented: getMe, sendMessage, editMessageText, editMessageReplyMarkup,
+// deleteMessage, answerCallbackQuery, getUpdates, setWebhook, deleteWebhook and getWebhookInfo.
+// Every chat is a private chat with a user, the ID of the chat is the ID of the user.
+package telegramtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/telebot.v3"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	errChatNotFound       = "Bad Request: chat not found"
+	errMessageNotFound    = "Bad Request: message to edit not found"
+	errDeleteNotFound     = "Bad Request: message to delete not found"
+	errMessageNotModified = "Bad Request: message is not modified: specified new message content and reply markup are exactly the same as a current content and reply markup of the message"
+	errEmptyText          = "Bad Request: message text is empty"
+	errInvalidQuery       = "Bad Request: query is too old and response timeout expired or query ID is invalid"
+	errBlocked            = "Forbidden: bot was blocked by the user"
+	errWebhookActive      = "Conflict: can't use getUpdates method while webhook is active; use deleteWebhook to delete the webhook first"
+)
+
+// apiError is returned to the bot the same way as Telegram does
+type apiError struct {
+	code        int
+	description string
+}
+
+func (e *apiError) Error() string {
+	return e.description
+}
+
+func badRequest(description string) *apiError {
+	return &apiError{code: http.StatusBadRequest, description: description}
+}
+
+// Server is a fake Telegram Bot API, it implements http.Handler
+type Server struct {
+	Token string // only requests with this token are accepted, any token is accepted when empty
+
+	mu sync.Mutex
+
+	me             telebot.User
+	lastMessageID  int
+	lastUpdateID   int
+	lastCallbackID int
+
+	chats     map[int64][]*telebot.Message // messages of each chat, in the order they were sent
+	blocked   map[int64]bool
+	callbacks map[string]*string // the text of the answer, nil until it is answered
+
+	updates        []telebot.Update // not yet confirmed by getUpdates
+	updatesChanged chan struct{}    // closed when new updates arrive
+	polls          int              // getUpdates requests received
+
+	webhookURL    string
+	webhookSecret string
+	client        *http.Client
+}
+
+func NewServer(token string) *Server {
+	return &Server{
+		Token: token,
+		me: telebot.User{
+			ID:        1,
+			IsBot:     true,
+			FirstName: "Fake Bot",
+			Username:  "fake_bot",
+		},
+		chats:          map[int64][]*telebot.Message{},
+		blocked:        map[int64]bool{},
+		callbacks:      map[string]*string{},
+		updatesChanged: make(chan struct{}),
+		client:         &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ServeHTTP serves the Bot API under /bot<token>/<method> and the control endpoints used by developers under /fake/
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/fake/") {
+		s.serveControl(w, r)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/bot")
+	token, method, ok := strings.Cut(path, "/")
+	if path == r.URL.Path || !ok {
+		writeError(w, &apiError{code: http.StatusNotFound, description: "Not Found"})
+		return
+	}
+	if s.Token != "" && token != s.Token {
+		writeError(w, &apiError{code: http.StatusUnauthorized, description: "Unauthorized"})
+		return
+	}
+
+	params, err := parseParams(r)
+	if err != nil {
+		writeError(w, badRequest(err.Error()))
+		return
+	}
+
+	var result interface{}
+	switch method {
+	case "getMe":
+		result = s.me
+	case "sendMessage":
+		result, err = s.sendMessage(params)
+	case "editMessageText":
+		result, err = s.editMessage(params, true)
+	case "editMessageReplyMarkup":
+		result, err = s.editMessage(params, false)
+	case "deleteMessage":
+		result, err = s.deleteMessage(params)
+	case "answerCallbackQuery":
+		result, err = s.answerCallbackQuery(params)
+	case "getUpdates":
+		result, err = s.getUpdates(r.Context(), params)
+	case "setWebhook":
+		result = s.setWebhook(params["url"], params["secret_token"])
+	case "deleteWebhook":
+		result = s.setWebhook("", "")
+		if params["drop_pending_updates"] == "true" {
+			s.mu.Lock()
+			s.updates = nil
+			s.mu.Unlock()
+		}
+	case "getWebhookInfo":
+		s.mu.Lock()
+		result = map[string]interface{}{"url": s.webhookURL, "pending_update_count": len(s.updates)}
+		s.mu.Unlock()
+	default:
+		err = &apiError{code: http.StatusNotFound, description: "Not Found: method not found"}
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, result)
+}
+
+// parseParams reads the parameters of a request, they may be sent as JSON, as a form or in the query string.
+// Every value is returned as a string, just like telebot sends them.
+func parseParams(r *http.Request) (map[string]string, error) {
+	params := map[string]string{}
+	for key, values := range r.URL.Query() {
+		params[key] = values[0]
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		var body map[string]interface{}
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber() // so IDs are not turned into floats
+		err := decoder.Decode(&body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		for key, value := range body {
+			switch v := value.(type) {
+			case string:
+				params[key] = v
+			case json.Number:
+				params[key] = v.String()
+			default:
+				data, _ := json.Marshal(v)
+				params[key] = string(data)
+			}
+		}
+	case "multipart/form-data":
+		err := r.ParseMultipartForm(1 << 20)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range r.MultipartForm.Value {
+			params[key] = values[0]
+		}
+	case "application/x-www-form-urlencoded":
+		err := r.ParseForm()
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range r.PostForm {
+			params[key] = values[0]
+		}
+	}
+	return params, nil
+}
+
+func writeResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		apiErr = &apiError{code: http.StatusInternalServerError, description: "Internal Server Error: " + err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error_code": apiErr.code, "description": apiErr.description})
+}
+
+func parseChatID(params map[string]string) (int64, error) {
+	chatID, err := strconv.ParseInt(params["chat_id"], 10, 64)
+	if err != nil {
+		return 0, badRequest(errChatNotFound)
+	}
+	return chatID, nil
+}
+
+// parseMarkup parses the reply_markup parameter, an empty markup is returned as nil
+func parseMarkup(params map[string]string) (*telebot.ReplyMarkup, error) {
+	if params["reply_markup"] == "" {
+		return nil, nil
+	}
+	var markup telebot.ReplyMarkup
+	err := json.Unmarshal([]byte(params["reply_markup"]), &markup)
+	if err != nil {
+		return nil, badRequest("Bad Request: can't parse reply keyboard markup JSON object")
+	}
+	if len(markup.InlineKeyboard) == 0 {
+		return nil, nil
+	}
+	return &markup, nil
+}
+
+func sameMarkup(a, b *telebot.ReplyMarkup) bool {
+	aData, _ := json.Marshal(a)
+	bData, _ := json.Marshal(b)
+	return bytes.Equal(aData, bData)
+}
+
+// findMessage returns the message and its index within the chat, the lock must be held
+func (s *Server) findMessage(chatID int64, messageID int) (*telebot.Message, int) {
+	for i, m := range s.chats[chatID] {
+		if m.ID == messageID {
+			return m, i
+		}
+	}
+	return nil, -1
+}
+
+// newMessage stores a new message in the chat of the user, the lock must be held
+func (s *Server) newMessage(chatID int64, sender *telebot.User, text string) *telebot.Message {
+	s.lastMessageID++
+	m := &telebot.Message{
+		ID:       s.lastMessageID,
+		Sender:   sender,
+		Unixtime: time.Now().Unix(),
+		Chat:     &telebot.Chat{ID: chatID, Type: telebot.ChatPrivate},
+		Text:     text,
+	}
+	s.chats[chatID] = append(s.chats[chatID], m)
+	return m
+}
+
+func (s *Server) sendMessage(params map[string]string) (*telebot.Message, error) {
+	chatID, err := parseChatID(params)
+	if err != nil {
+		return nil, err
+	}
+	if params["text"] == "" {
+		return nil, badRequest(errEmptyText)
+	}
+	markup, err := parseMarkup(params)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.blocked[chatID] {
+		return nil, &apiError{code: http.StatusForbidden, description: errBlocked}
+	}
+
+	var replyTo *telebot.Message
+	if params["reply_to_message_id"] != "" {
+		replyToID, _ := strconv.Atoi(params["reply_to_message_id"])
+		original, _ := s.findMessage(chatID, replyToID)
+		if original == nil {
+			return nil, badRequest("Bad Request: message to be replied not found")
+		}
+		replyCopy := *original
+		replyCopy.ReplyTo = nil // replies do not contain further replies
+		replyTo = &replyCopy
+	}
+
+	m := s.newMessage(chatID, &s.me, params["text"])
+	m.ReplyMarkup = markup
+	m.ReplyTo = replyTo
+	return m, nil
+}
+
+// editMessage changes the text and the markup, or only the markup of a message
+func (s *Server) editMessage(params map[string]string, withText bool) (*telebot.Message, error) {
+	chatID, err := parseChatID(params)
+	if err != nil {
+		return nil, err
+	}
+	messageID, _ := strconv.Atoi(params["message_id"])
+	markup, err := parseMarkup(params)
+	if err != nil {
+		return nil, err
+	}
+	if withText && params["text"] == "" {
+		return nil, badRequest(errEmptyText)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, _ := s.findMessage(chatID, messageID)
+	if m == nil || m.Sender == nil || m.Sender.ID != s.me.ID {
+		return nil, badRequest(errMessageNotFound)
+	}
+
+	text := m.Text
+	if withText {
+		text = params["text"]
+	}
+	if text == m.Text && sameMarkup(markup, m.ReplyMarkup) {
+		return nil, badRequest(errMessageNotModified)
+	}
+
+	m.Text = text
+	m.ReplyMarkup = markup
+	m.LastEdit = time.Now().Unix()
+	edited := *m
+	return &edited, nil
+}
+
+func (s *Server) deleteMessage(params map[string]string) (bool, error) {
+	chatID, err := parseChatID(params)
+	if err != nil {
+		return false, err
+	}
+	messageID, _ := strconv.Atoi(params["message_id"])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, i := s.findMessage(chatID, messageID)
+	if i == -1 {
+		return false, badRequest(errDeleteNotFound)
+	}
+	s.chats[chatID] = append(s.chats[chatID][:i:i], s.chats[chatID][i+1:]...)
+	return true, nil
+}
+
+func (s *Server) answerCallbackQuery(params map[string]string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	answer, ok := s.callbacks[params["callback_query_id"]]
+	if !ok || answer != nil {
+		return false, badRequest(errInvalidQuery) // a query can only be answered once
+	}
+	text := params["text"]
+	s.callbacks[params["callback_query_id"]] = &text
+	return true, nil
+}
+
+func (s *Server) getUpdates(ctx context.Context, params map[string]string) ([]telebot.Update, error) {
+	offset, _ := strconv.Atoi(params["offset"])
+	limit, _ := strconv.Atoi(params["limit"])
+	if limit <= 0 || limit > 100 {
+		limit = 100
+	}
+	timeout, _ := strconv.Atoi(params["timeout"])
+	deadline := time.After(time.Duration(timeout) * time.Second)
+
+	s.mu.Lock()
+	s.polls++
+	s.mu.Unlock()
+
+	for {
+		s.mu.Lock()
+		if s.webhookURL != "" {
+			s.mu.Unlock()
+			return nil, &apiError{code: http.StatusConflict, description: errWebhookActive}
+		}
+
+		// updates before the offset are confirmed, they are not sent again
+		for len(s.updates) > 0 && s.updates[0].ID < offset {
+			s.updates = s.updates[1:]
+		}
+		if len(s.updates) > 0 {
+			updates := s.updates
+			if len(updates) > limit {
+				updates = updates[:limit]
+			}
+			s.mu.Unlock()
+			return append([]telebot.Update(nil), updates...), nil
+		}
+		changed := s.updatesChanged
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return []telebot.Update{}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *Server) setWebhook(url, secret string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.webhookURL = url
+	s.webhookSecret = secret
+	return true
+}
+
+// pushUpdate queues the update for getUpdates, or posts it to the webhook if one is set.
+// The lock must be held, it is released before returning.
+func (s *Server) pushUpdate(update telebot.Update) error {
+	s.lastUpdateID++
+	update.ID = s.lastUpdateID
+
+	url, secret := s.webhookURL, s.webhookSecret
+	if url == "" {
+		s.updates = append(s.updates, update)
+		close(s.updatesChanged)
+		s.updatesChanged = make(chan struct{})
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// SendText sends a message to the bot from the user, in the private chat of the user
+func (s *Server) SendText(from telebot.User, text string) (telebot.Message, error) {
+	s.mu.Lock()
+	m := s.newMessage(from.ID, &from, text)
+	sent := *m
+	return sent, s.pushUpdate(telebot.Update{Message: &sent})
+}
+
+// Click presses the inline button with the given text on a message of the bot, and returns the ID of the callback query
+func (s *Server) Click(from telebot.User, chatID int64, messageID int, buttonText string) (string, error) {
+	s.mu.Lock()
+	m, _ := s.findMessage(chatID, messageID)
+	if m == nil {
+		s.mu.Unlock()
+		return "", fmt.Errorf("message %d not found in chat %d", messageID, chatID)
+	}
+
+	var button *telebot.InlineButton
+	if m.ReplyMarkup != nil {
+		for _, row := range m.ReplyMarkup.InlineKeyboard {
+			for i := range row {
+				if row[i].Text == buttonText {
+					button = &row[i]
+				}
+			}
+		}
+	}
+	if button == nil {
+		s.mu.Unlock()
+		return "", fmt.Errorf("message %d has no button %q", messageID, buttonText)
+	}
+
+	s.lastCallbackID++
+	id := strconv.Itoa(s.lastCallbackID)
+	s.callbacks[id] = nil
+	message := *m
+	return id, s.pushUpdate(telebot.Update{Callback: &telebot.Callback{
+		ID:      id,
+		Sender:  &from,
+		Message: &message,
+		Data:    button.Data,
+	}})
+}
+
+// Messages returns the current state of the messages in the chat, in the order they were sent
+func (s *Server) Messages(chatID int64) []telebot.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages := make([]telebot.Message, len(s.chats[chatID]))
+	for i, m := range s.chats[chatID] {
+		messages[i] = *m
+	}
+	return messages
+}
+
+// CallbackAnswer returns the text the bot answered the callback query with, and whether it was answered at all
+func (s *Server) CallbackAnswer(id string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	answer := s.callbacks[id]
+	if answer == nil {
+		return "", false
+	}
+	return *answer, true
+}
+
+// Block makes sending messages to the user fail, as if the user blocked the bot
+func (s *Server) Block(userID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocked[userID] = true
+}
+
+// Polls returns the number of getUpdates requests received, so tests can wait for the bot to start polling
+func (s *Server) Polls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.polls
+}
+
+// WebhookURL returns the URL set by the bot with setWebhook
+func (s *Server) WebhookURL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.webhookURL
+}
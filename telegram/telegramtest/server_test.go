@@ -0,0 +1,227 @@
+package telegramtest
+
+import (
+	"encoding/json"
+	"errors"
+	"gopkg.in/telebot.v3"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testToken = "123:test"
+
+// newTestBot returns a telebot client of a fake server, the bot is not started
+func newTestBot(t *testing.T) (*Server, *telebot.Bot) {
+	t.Helper()
+
+	fake := NewServer(testToken)
+	hs := httptest.NewServer(fake)
+	t.Cleanup(hs.Close)
+
+	bot, err := telebot.NewBot(telebot.Settings{
+		Token: testToken,
+		URL:   hs.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, bot
+}
+
+func TestWrongToken(t *testing.T) {
+	hs := httptest.NewServer(NewServer(testToken))
+	defer hs.Close()
+
+	_, err := telebot.NewBot(telebot.Settings{Token: "123:wrong", URL: hs.URL})
+	if !errors.Is(err, telebot.ErrUnauthorized) {
+		t.Fatalf("expected telebot.ErrUnauthorized, got %v", err)
+	}
+}
+
+func TestSendEditDelete(t *testing.T) {
+	fake, bot := newTestBot(t)
+	user := &telebot.User{ID: 42}
+
+	markup := &telebot.ReplyMarkup{}
+	markup.Inline(markup.Row(markup.Data("Yes", "q", "y")))
+	m, err := bot.Send(user, "Deploy?", markup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = bot.EditReplyMarkup(m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bot.EditReplyMarkup(m, nil)
+	if !errors.Is(err, telebot.ErrSameMessageContent) {
+		t.Fatalf("expected telebot.ErrSameMessageContent, got %v", err)
+	}
+
+	_, err = bot.Reply(m, "Answered")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := fake.Messages(42)
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if messages[0].ReplyMarkup != nil || messages[0].LastEdit == 0 {
+		t.Fatalf("buttons not removed: %+v", messages[0])
+	}
+	if messages[1].ReplyTo == nil || messages[1].ReplyTo.ID != m.ID {
+		t.Fatalf("reply not linked: %+v", messages[1])
+	}
+
+	_, err = bot.Edit(m, "Deployed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bot.Delete(&messages[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages = fake.Messages(42)
+	if len(messages) != 1 || messages[0].Text != "Deployed" {
+		t.Fatalf("unexpected messages: %+v", messages)
+	}
+
+	err = bot.Delete(&messages[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bot.Delete(m)
+	if err == nil {
+		t.Fatal("deleting a deleted message succeeded")
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	fake, bot := newTestBot(t)
+	fake.Block(42)
+
+	_, err := bot.Send(&telebot.User{ID: 42}, "Hi")
+	if !errors.Is(err, telebot.ErrBlockedByUser) {
+		t.Fatalf("expected telebot.ErrBlockedByUser, got %v", err)
+	}
+}
+
+func TestClickAndPoll(t *testing.T) {
+	fake, bot := newTestBot(t)
+	user := telebot.User{ID: 42, FirstName: "Test"}
+
+	markup := &telebot.ReplyMarkup{}
+	markup.Inline(markup.Row(markup.Data("Yes", "q", "y")))
+	m, err := bot.Send(&user, "Deploy?", markup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fake.Click(user, 42, m.ID, "No")
+	if err == nil {
+		t.Fatal("nonexistent button clicked")
+	}
+	callbackID, err := fake.Click(user, 42, m.ID, "Yes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fake.SendText(user, "/id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp struct {
+		Result []telebot.Update
+	}
+	data, err := bot.Raw("getUpdates", map[string]string{"offset": "0", "timeout": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Result) != 2 {
+		t.Fatalf("expected 2 updates, got %d", len(resp.Result))
+	}
+	callback := resp.Result[0].Callback
+	if callback == nil || callback.ID != callbackID || callback.Data != "\fq|y" || callback.Message.ID != m.ID {
+		t.Fatalf("unexpected callback: %+v", callback)
+	}
+	if resp.Result[1].Message == nil || resp.Result[1].Message.Text != "/id" {
+		t.Fatalf("unexpected message: %+v", resp.Result[1].Message)
+	}
+
+	err = bot.Respond(callback, &telebot.CallbackResponse{Text: "Thanks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, answered := fake.CallbackAnswer(callbackID)
+	if !answered || text != "Thanks" {
+		t.Fatalf("callback answer not recorded: %q %t", text, answered)
+	}
+
+	// confirmed updates are not returned again, and the request waits for new ones until the timeout
+	start := time.Now()
+	data, err = bot.Raw("getUpdates", map[string]string{"offset": "3", "timeout": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Result) != 0 || time.Since(start) < time.Second {
+		t.Fatalf("expected to wait for updates, got %d after %s", len(resp.Result), time.Since(start))
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	fake, bot := newTestBot(t)
+
+	received := make(chan telebot.Update, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Telegram-Bot-Api-Secret-Token") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var update telebot.Update
+		_ = json.NewDecoder(r.Body).Decode(&update)
+		received <- update
+	}))
+	defer receiver.Close()
+
+	err := bot.SetWebhook(&telebot.Webhook{Endpoint: &telebot.WebhookEndpoint{PublicURL: receiver.URL}, SecretToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.WebhookURL() != receiver.URL {
+		t.Fatalf("webhook not set: %q", fake.WebhookURL())
+	}
+
+	_, err = bot.Raw("getUpdates", map[string]string{"offset": "0"})
+	if err == nil {
+		t.Fatal("getUpdates allowed while a webhook is set")
+	}
+
+	_, err = fake.SendText(telebot.User{ID: 42}, "/start")
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := <-received
+	if update.Message == nil || update.Message.Text != "/start" {
+		t.Fatalf("unexpected update: %+v", update)
+	}
+
+	err = bot.RemoveWebhook()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.WebhookURL() != "" {
+		t.Fatal("webhook not removed")
+	}
+}
@@ -0,0 +1,23 @@
+package telegram
+
+import (
+	"context"
+	"github.com/marcsello/marcsellocorp-bot/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startSend starts a span for a Bot API call, it must be finished with finishSend
+func startSend(ctx context.Context, method string, chatId int64) trace.Span {
+	_, span := tracing.Start(ctx, "telegram."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.Int64("telegram.chat_id", chatId)),
+	)
+	return span
+}
+
+// finishSend ends the span of the Bot API call, and counts it in the send metrics
+func finishSend(span trace.Span, kind string, err error) {
+	observeSend(kind, err)
+	tracing.End(span, err)
+}
@@ -1,8 +1,14 @@
 package telegram
 
 import (
+	"fmt"
 	"github.com/marcsello/marcsellocorp-bot/db"
+	"github.com/marcsello/marcsellocorp-bot/utils"
 	"gopkg.in/telebot.v3"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 )
 
 func getUserFromContext(ctx telebot.Context) *db.User {
@@ -21,3 +27,63 @@ func getUserFromContext(ctx telebot.Context) *db.User {
 
 	return u
 }
+
+// splitPayload splits off the first n whitespace separated arguments of the payload, and returns them along with the remaining text (whitespace preserved)
+func splitPayload(payload string, n int) ([]string, string, bool) {
+	args := make([]string, 0, n)
+	rest := strings.TrimSpace(payload)
+	for len(args) < n {
+		if rest == "" {
+			return nil, "", false
+		}
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end == -1 {
+			end = len(rest)
+		}
+		args = append(args, rest[:end])
+		rest = strings.TrimSpace(rest[end:])
+	}
+	return args, rest, true
+}
+
+// parseValidity converts a validity period given by the user to an expiry time, "never" means no expiry
+func parseValidity(validity string) (*time.Time, error) {
+	if validity == "never" {
+		return nil, nil
+	}
+
+	d, err := utils.ParseDuration(validity)
+	if err != nil {
+		return nil, err
+	}
+	if d <= 0 {
+		return nil, fmt.Errorf("must be positive")
+	}
+
+	expiresAt := time.Now().Add(d)
+	return &expiresAt, nil
+}
+
+// parseLimits parses rate limits and quotas given by the user, they must be non-negative, 0 meaning unlimited
+func parseLimits(args []string) ([]int, error) {
+	limits := make([]int, len(args))
+	for i, arg := range args {
+		v, err := strconv.Atoi(strings.TrimSpace(arg))
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid limit: %s", arg)
+		}
+		limits[i] = v
+	}
+	return limits, nil
+}
+
+// formatLimit formats a rate limit or quota for display
+func formatLimit(limit int, unit string, burst int) string {
+	if limit == 0 {
+		return "Unlimited"
+	}
+	if burst > 0 {
+		return fmt.Sprintf("%d%s (burst %d)", limit, unit, burst)
+	}
+	return fmt.Sprintf("%d%s", limit, unit)
+}
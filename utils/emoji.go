@@ -1,5 +1,10 @@
 package utils
 
+import (
+	"strings"
+	"unicode"
+)
+
 func BoolToEmoji(val bool) string {
 	if val {
 		return "✅"
@@ -7,3 +12,112 @@ func BoolToEmoji(val bool) string {
 		return "❌"
 	}
 }
+
+const (
+	zeroWidthJoiner    = '\u200d'
+	variationSelector  = '\ufe0f'
+	combiningKeycap    = '\u20e3'
+	blackFlag          = '\U0001f3f4'
+	cancelTag          = '\U000e007f'
+	regionalIndicatorA = '\U0001f1e6'
+	regionalIndicatorZ = '\U0001f1ff'
+	skinToneLight      = '\U0001f3fb'
+	skinToneDark       = '\U0001f3ff'
+)
+
+// emojiBase approximates the code points displayed as an emoji on their own, skin tones and regional indicators are handled separately
+var emojiBase = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x00a9, Hi: 0x00ae, Stride: 5},
+		{Lo: 0x203c, Hi: 0x2049, Stride: 13},
+		{Lo: 0x2122, Hi: 0x2139, Stride: 23},
+		{Lo: 0x2194, Hi: 0x2199, Stride: 1},
+		{Lo: 0x21a9, Hi: 0x21aa, Stride: 1},
+		{Lo: 0x231a, Hi: 0x231b, Stride: 1},
+		{Lo: 0x2328, Hi: 0x23cf, Stride: 167},
+		{Lo: 0x23e9, Hi: 0x23f3, Stride: 1},
+		{Lo: 0x23f8, Hi: 0x23fa, Stride: 1},
+		{Lo: 0x24c2, Hi: 0x25aa, Stride: 232},
+		{Lo: 0x25ab, Hi: 0x25b6, Stride: 11},
+		{Lo: 0x25c0, Hi: 0x25c0, Stride: 1},
+		{Lo: 0x25fb, Hi: 0x25fe, Stride: 1},
+		{Lo: 0x2600, Hi: 0x27bf, Stride: 1},
+		{Lo: 0x2934, Hi: 0x2935, Stride: 1},
+		{Lo: 0x2b05, Hi: 0x2b07, Stride: 1},
+		{Lo: 0x2b1b, Hi: 0x2b1c, Stride: 1},
+		{Lo: 0x2b50, Hi: 0x2b55, Stride: 5},
+		{Lo: 0x3030, Hi: 0x303d, Stride: 13},
+		{Lo: 0x3297, Hi: 0x3299, Stride: 2},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1f000, Hi: 0x1f1e5, Stride: 1},
+		{Lo: 0x1f200, Hi: 0x1f3fa, Stride: 1},
+		{Lo: 0x1f400, Hi: 0x1faff, Stride: 1},
+	},
+	LatinOffset: 1,
+}
+
+// IsSingleEmoji reports whether s is exactly one emoji as displayed, including flags, keycaps, skin tones and ZWJ sequences
+func IsSingleEmoji(s string) bool {
+	runes := []rune(s)
+	if len(runes) == 0 {
+		return false
+	}
+
+	// flags are made of two regional indicators
+	if isRegionalIndicator(runes[0]) {
+		return len(runes) == 2 && isRegionalIndicator(runes[1])
+	}
+
+	// keycaps are a digit, # or * with an optional variation selector and the combining keycap
+	if strings.ContainsRune("0123456789#*", runes[0]) {
+		rest := runes[1:]
+		if len(rest) > 0 && rest[0] == variationSelector {
+			rest = rest[1:]
+		}
+		return len(rest) == 1 && rest[0] == combiningKeycap
+	}
+
+	// subdivision flags are the black flag followed by tag characters
+	if runes[0] == blackFlag && len(runes) > 1 && isTag(runes[1]) {
+		for i, r := range runes[1:] {
+			if r == cancelTag {
+				return i == len(runes)-2
+			}
+			if !isTag(r) {
+				return false
+			}
+		}
+		return false
+	}
+
+	// everything else is a sequence of optionally modified emojis joined by ZWJs
+	i := 0
+	for {
+		if i >= len(runes) || !unicode.Is(emojiBase, runes[i]) {
+			return false
+		}
+		i++
+		if i < len(runes) && runes[i] == variationSelector {
+			i++
+		}
+		if i < len(runes) && runes[i] >= skinToneLight && runes[i] <= skinToneDark {
+			i++
+		}
+		if i == len(runes) {
+			return true
+		}
+		if runes[i] != zeroWidthJoiner {
+			return false
+		}
+		i++
+	}
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= regionalIndicatorA && r <= regionalIndicatorZ
+}
+
+func isTag(r rune) bool {
+	return r >= 0xe0020 && r <= cancelTag
+}
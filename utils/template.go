@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"strings"
+	"text/template"
+)
+
+func parseTemplate(body string) (*template.Template, error) {
+	return template.New("").Option("missingkey=error").Parse(body)
+}
+
+// ValidateTemplate returns the parse error of the template body, if any
+func ValidateTemplate(body string) error {
+	_, err := parseTemplate(body)
+	return err
+}
+
+// RenderTemplate executes a Go text/template with the given variables, referencing an undefined variable is an error
+func RenderTemplate(body string, vars map[string]interface{}) (string, error) {
+	tmpl, err := parseTemplate(body)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	err = tmpl.Execute(&sb, vars)
+	if err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
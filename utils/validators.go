@@ -9,6 +9,7 @@ const minLen = 3
 const maxLen = 48 // IMPORTANT: This is declared in the model as well
 
 var re = regexp.MustCompile(`^[a-z]+[a-z0-9]*$`)
+var patternRe = regexp.MustCompile(`^[a-z0-9*?]+$`)
 
 func IsValidTokenName(name string) bool {
 	if !re.MatchString(name) {
@@ -26,3 +27,11 @@ func IsValidTokenName(name string) bool {
 func IsValidChannelName(name string) bool {
 	return IsValidTokenName(name)
 }
+
+// IsValidChannelPattern accepts channel names, and patterns with * and ? wildcards
+func IsValidChannelPattern(pattern string) bool {
+	if !patternRe.MatchString(pattern) {
+		return false
+	}
+	return len(pattern) <= maxLen
+}
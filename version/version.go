@@ -0,0 +1,45 @@
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Version is set at build time with -ldflags "-X github.com/marcsello/marcsellocorp-bot/version.Version=..."
+var Version = "dev"
+
+// Commit is set at build time the same way, it is reported when the VCS information is not embedded (e.g. in docker builds)
+var Commit = ""
+
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"` // built from a dirty working tree
+}
+
+// Info collects the version and the VCS information embedded by the Go toolchain, if available
+func Info() BuildInfo {
+	info := BuildInfo{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+		Revision:  Commit,
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.time":
+			info.BuildTime = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}